@@ -3,32 +3,37 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	// the zone database is embedded for the quota time zone, the alpine image has none
+	_ "time/tzdata"
 
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/app"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/config"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/jsonpersistence"
-	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/ratelimiter"
-)
-
-const (
-	AppPortEnv = "APP_PORT"
-	AppPort    = ":8000"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/walpersistence"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/snapshot"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/pkg/limiter"
 )
 
 // serve handles the logic of running  server in a goroutine and waiting for signal to gracefully stop the server
 // on ctx.Done signal a request to shut down the server is sent, so that no new requests will be served
 // after that the window is dumped to the file
-func serve(ctx context.Context, counterApp *app.App) {
+// requests are served through the middleware of counterApp, admin serves the admin API under /admin/ unless it is nil
+func serve(ctx context.Context, port string, counterApp *app.App, admin http.Handler) {
 	mux := http.NewServeMux()
-	mux.Handle("/", http.HandlerFunc(counterApp.Hit))
-	port := os.Getenv(AppPortEnv)
-	if port == "" {
-		port = AppPort
+	mux.Handle("/", counterApp.Handler())
+	if admin != nil {
+		mux.Handle("/admin/", admin)
 	}
 	srv := &http.Server{Addr: port, Handler: mux}
 	go func() {
@@ -57,22 +62,219 @@ func serve(ctx context.Context, counterApp *app.App) {
 	log.Println("dumping window complete. app exiting!!")
 }
 
+// newRateLimiterService returns the rate limiter of cfg, the token bucket and GCRA spread the rate of a window evenly over it.
+// onShadowReject is called for every request the shadow policy would reject.
+func newRateLimiterService(cfg config.Config, dataPersistence limiter.Persistence, onShadowReject limiter.ShadowRejectFunc) (limiter.Limiter, error) {
+	overrides, err := cfg.ParsedOverrides()
+	if err != nil {
+		return nil, err
+	}
+	windows, err := cfg.ParsedWindows()
+	if err != nil {
+		return nil, err
+	}
+	quotaLocation, err := cfg.QuotaLocation()
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := cfg.ParsedShadowWindows()
+	if err != nil {
+		return nil, err
+	}
+	opts := []limiter.Option{
+		limiter.WithAlgorithm(limiter.Algorithm(cfg.Algorithm)),
+		limiter.WithLimit(cfg.Limit, time.Duration(cfg.Window)),
+		limiter.WithGlobalLimit(cfg.GlobalLimit, time.Duration(cfg.GlobalWindow)),
+		limiter.WithMaxKeys(cfg.MaxKeys),
+		limiter.WithOverrides(overrides...),
+		limiter.WithIPPrefixes(cfg.IPv4Prefix, cfg.IPv6Prefix),
+		limiter.WithWindows(windows...),
+		limiter.WithQuotaLocation(quotaLocation),
+		limiter.WithPenalty(cfg.Penalty()),
+		limiter.WithShadow(onShadowReject, shadow...),
+		limiter.WithPersistence(dataPersistence),
+	}
+	// the resolution and the counter mode always have a value in cfg, they are passed only to the sliding window supporting them
+	if limiter.Algorithm(cfg.Algorithm) == limiter.SlidingWindow {
+		opts = append(opts,
+			limiter.WithResolution(time.Duration(cfg.Resolution)),
+			limiter.WithCounterMode(limiter.CounterMode(cfg.CounterMode)),
+		)
+	}
+	return limiter.New(opts...)
+}
+
+// reloadable are the settings reloadLimits applies, the other ones take effect on restart
+var reloadable = map[string]bool{
+	"limit":         true,
+	"window":        true,
+	"global_limit":  true,
+	"global_window": true,
+	"windows":       true,
+	"overrides":     true,
+}
+
+// reloadLimits loads the configuration again and swaps the limits of rateLimiterService for its limit, global limit, windows
+// and overrides, keeping the hits. The other settings take effect on restart, a warning lists the ones which differ from running,
+// the configuration the app was started with.
+func reloadLimits(rateLimiterService limiter.Limiter, running config.Config) error {
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		return err
+	}
+	overrides, err := cfg.ParsedOverrides()
+	if err != nil {
+		return err
+	}
+	windows, err := cfg.ParsedWindows()
+	if err != nil {
+		return err
+	}
+	err = limiter.Reload(rateLimiterService,
+		limiter.WithLimit(cfg.Limit, time.Duration(cfg.Window)),
+		limiter.WithGlobalLimit(cfg.GlobalLimit, time.Duration(cfg.GlobalWindow)),
+		limiter.WithWindows(windows...),
+		limiter.WithOverrides(overrides...),
+	)
+	if err != nil {
+		return err
+	}
+	log.Printf("limits reloaded: limit %d per %s, global limit %d per %s, windows %q, overrides %q",
+		cfg.Limit, time.Duration(cfg.Window), cfg.GlobalLimit, time.Duration(cfg.GlobalWindow), cfg.Windows, cfg.Overrides)
+	var restartOnly []string
+	for _, name := range running.Changed(cfg) {
+		if !reloadable[name] {
+			restartOnly = append(restartOnly, name)
+		}
+	}
+	if len(restartOnly) > 0 {
+		log.Printf("warning: %s changed and take effect on restart only", strings.Join(restartOnly, ", "))
+	}
+	return nil
+}
+
+// shadowLogKeys is the number of keys logged per interval by shadowRejectLog, the most rejected first
+const shadowLogKeys = 20
+
+// shadowRejectLog counts the requests the shadow policy would have rejected by key and logs the counts once per interval,
+// so that a key hammering the shadow policy costs a log line per interval instead of one per request
+type shadowRejectLog struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newShadowRejectLog() *shadowRejectLog {
+	return &shadowRejectLog{counts: make(map[string]int64)}
+}
+
+// record counts a request of key the shadow policy would have rejected
+func (l *shadowRejectLog) record(key string, _ limiter.Decision) {
+	l.mu.Lock()
+	l.counts[key]++
+	l.mu.Unlock()
+}
+
+// run logs the counts every interval until ctx is done, and once more when it is done
+func (l *shadowRejectLog) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.flush(interval)
+			return
+		case <-ticker.C:
+			l.flush(interval)
+		}
+	}
+}
+
+// flush logs the counts of the shadowLogKeys most rejected keys and resets them
+func (l *shadowRejectLog) flush(interval time.Duration) {
+	l.mu.Lock()
+	counts := l.counts
+	l.counts = make(map[string]int64)
+	l.mu.Unlock()
+	keys := make([]string, 0, len(counts))
+	var total int64
+	for key, count := range counts {
+		keys = append(keys, key)
+		total += count
+	}
+	if total == 0 {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	log.Printf("shadow policy would have rejected %d requests of %d keys in the last %s", total, len(keys), interval)
+	for i, key := range keys {
+		if i == shadowLogKeys {
+			log.Printf("shadow policy would have rejected the requests of %d more keys", len(keys)-shadowLogKeys)
+			break
+		}
+		log.Printf("shadow policy would have rejected %d requests of %s", counts[key], key)
+	}
+}
+
 // main initiates new app and calls serve to start the server
 // it also spawns a goroutine to listen to os signals SIGINT or SIGTERM
 // once the os signal is received the cancel func of ctx passed to serve is called
 // notifying it to initiate a graceful shutdown
+// on SIGHUP the limits are reloaded from the configuration without restarting
 func main() {
-	persistence, err := jsonpersistence.NewPersistence()
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
 	if err != nil {
-		log.Fatalf("error while initializing persistence %s", err.Error())
+		log.Fatalf("error while loading config %s", err.Error())
+	}
+	log.Printf("effective config:\n%s", cfg)
+
+	var persistence limiter.Persistence
+	switch cfg.Persistence {
+	case config.PersistenceWAL:
+		walPersistence, err := walpersistence.NewWALPersistence(cfg.DumpFile, cfg.WALCompactionThreshold)
+		if err != nil {
+			log.Fatalf("error while initializing persistence %s", err.Error())
+		}
+		// closed once the window is dumped on shutdown
+		defer walPersistence.Close()
+		persistence = walPersistence
+	default:
+		persistence, err = jsonpersistence.NewFilePersistence(cfg.DumpFile)
+		if err != nil {
+			log.Fatalf("error while initializing persistence %s", err.Error())
+		}
 	}
 
-	rateLimiterService, err := ratelimiter.NewRateLimiter(60, 20, 15, persistence)
+	shadowLog := newShadowRejectLog()
+	rateLimiterService, err := newRateLimiterService(cfg, persistence, shadowLog.record)
 	if err != nil {
 		log.Fatalf("error while initializing counter service %s", err.Error())
 	}
 
 	counterApp := app.NewApp(rateLimiterService)
+	counterApp.SetHeaderStyle(app.HeaderStyle(cfg.Headers))
+	// the route costs are authoritative, the cost header is read only for the other paths and only when it is trusted
+	routeCosts, err := cfg.ParsedRouteCosts()
+	if err != nil {
+		log.Fatalf("error while initializing route costs %s", err.Error())
+	}
+	for path, cost := range routeCosts {
+		counterApp.SetRouteCost(path, cost)
+	}
+	counterApp.SetCostHeader(cfg.TrustCostHeader)
+	// the requests in flight are capped per IP, and across all IPs with a global limit, when max in flight is set
+	if cfg.MaxInFlight > 0 {
+		concurrencyLimiter, err := limiter.NewConcurrencyLimiter(cfg.MaxInFlight, cfg.GlobalMaxInFlight,
+			limiter.WithIPPrefixes(cfg.IPv4Prefix, cfg.IPv6Prefix))
+		if err != nil {
+			log.Fatalf("error while initializing concurrency limiter %s", err.Error())
+		}
+		counterApp.SetConcurrencyLimiter(concurrencyLimiter)
+	}
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("recovering from panic, dumping window")
@@ -94,5 +296,51 @@ func main() {
 		log.Printf("system call received")
 		cancel()
 	}()
-	serve(ctx, counterApp)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadLimits(rateLimiterService, cfg); err != nil {
+				log.Printf("reloading limits failed, keeping the current ones: %s", err.Error())
+			}
+		}
+	}()
+
+	// the metrics are served on /admin/vars with the admin API
+	// evicted and tracked IPs and the total would-be rejections of the shadow policy are published under ratelimiter
+	if evictor, ok := rateLimiterService.(limiter.Evictor); ok {
+		expvar.Publish("ratelimiter", expvar.Func(func() interface{} {
+			return evictor.Stats()
+		}))
+		go evictor.RunJanitor(ctx, time.Duration(cfg.EvictionInterval))
+	}
+	// the windows are dumped every snapshot interval, the snapshots are published under snapshots
+	if cfg.SnapshotInterval > 0 {
+		scheduler, err := snapshot.NewScheduler(rateLimiterService, time.Duration(cfg.SnapshotInterval), clock.RealClock{})
+		if err != nil {
+			log.Fatalf("error while initializing snapshots %s", err.Error())
+		}
+		expvar.Publish("snapshots", expvar.Func(func() interface{} {
+			return scheduler.Stats()
+		}))
+		go scheduler.Run(ctx)
+	}
+	// would-be rejections of the shadow policy are logged by key every minute
+	if cfg.ShadowWindows != "" {
+		go shadowLog.run(ctx, time.Minute)
+	}
+	var admin http.Handler
+	if cfg.AdminToken != "" {
+		penaltyBox, ok := rateLimiterService.(limiter.PenaltyBox)
+		adminAPI := app.NewAdmin(penaltyBox, cfg.AdminToken)
+		if ok {
+			adminAPI.SetReload(func() error {
+				return reloadLimits(rateLimiterService, cfg)
+			})
+		}
+		adminAPI.SetVars(expvar.Handler())
+		admin = adminAPI
+	}
+	serve(ctx, cfg.Port, counterApp, admin)
 }
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+)
+
+const (
+	// BansPath is the path of the admin API listing and lifting bans.
+	BansPath = "/admin/bans"
+	// ReloadPath is the path of the admin API reloading the configuration.
+	ReloadPath = "/admin/reload"
+	// VarsPath is the path of the admin API serving the metrics.
+	VarsPath = "/admin/vars"
+)
+
+// Admin serves the admin API to requests carrying its token as a bearer token in the Authorization header.
+// GET BansPath lists the banned keys as JSON and DELETE BansPath?key=<key> lifts the ban of a key, once a penalty box is set.
+// POST ReloadPath reloads the configuration once a reload func is set.
+// VarsPath serves the metrics once a vars handler is set.
+type Admin struct {
+	penaltyBox services.PenaltyBoxInterface
+	reload     func() error
+	vars       http.Handler
+	token      string
+	mux        *http.ServeMux
+}
+
+// NewAdmin returns the admin API of penaltyBox guarded by token, every request is rejected when token is empty.
+// BansPath answers 404 when penaltyBox is nil.
+func NewAdmin(penaltyBox services.PenaltyBoxInterface, token string) *Admin {
+	a := &Admin{
+		penaltyBox: penaltyBox,
+		token:      token,
+		mux:        http.NewServeMux(),
+	}
+	a.mux.HandleFunc(BansPath, a.bans)
+	a.mux.HandleFunc(ReloadPath, a.reloadConfig)
+	a.mux.HandleFunc(VarsPath, a.serveVars)
+	return a
+}
+
+// SetReload sets the func POST ReloadPath calls, ReloadPath answers 404 until it is set.
+func (a *Admin) SetReload(reload func() error) {
+	a.reload = reload
+}
+
+// SetVars sets the handler serving VarsPath, like expvar.Handler, VarsPath answers 404 until it is set.
+func (a *Admin) SetVars(vars http.Handler) {
+	a.vars = vars
+}
+
+// ServeHTTP serves authorized requests to the admin API and answers others with 401.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// authorized returns whether r carries the admin token
+func (a *Admin) authorized(r *http.Request) bool {
+	expected := "Bearer " + a.token
+	return a.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+// bans lists the banned keys on GET and lifts the ban of the key query parameter on DELETE,
+// it answers 404 when the key has no ban
+func (a *Admin) bans(w http.ResponseWriter, r *http.Request) {
+	if a.penaltyBox == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.penaltyBox.Bans())
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		if !a.penaltyBox.Unban(key) {
+			http.Error(w, "no ban for key "+key, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// reloadConfig calls the reload func on POST and answers 204, or 500 with the error when the reload fails
+func (a *Admin) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if a.reload == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.reload(); err != nil {
+		http.Error(w, "reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveVars serves the metrics with the vars handler
+func (a *Admin) serveVars(w http.ResponseWriter, r *http.Request) {
+	if a.vars == nil {
+		http.NotFound(w, r)
+		return
+	}
+	a.vars.ServeHTTP(w, r)
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/services_mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin_Bans(t *testing.T) {
+	newRequest := func(method, target, token string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req
+	}
+	t.Run("should list the bans as JSON", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockPenaltyBox := services_mock.NewMockPenaltyBoxInterface(ctrl)
+		mockPenaltyBox.EXPECT().Bans().Return([]models.Ban{{Key: "10.0.0.1", Until: time.Unix(1624974458, 0).UTC(), Offences: 2}})
+		rec := httptest.NewRecorder()
+		NewAdmin(mockPenaltyBox, "secret").ServeHTTP(rec, newRequest(http.MethodGet, BansPath, "secret"))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.JSONEq(t, `[{"key":"10.0.0.1","until":"2021-06-29T13:47:38Z","offences":2}]`, rec.Body.String())
+	})
+	t.Run("should lift a ban and answer 404 for keys without one", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockPenaltyBox := services_mock.NewMockPenaltyBoxInterface(ctrl)
+		mockPenaltyBox.EXPECT().Unban("10.0.0.0/24").Return(true)
+		mockPenaltyBox.EXPECT().Unban("10.0.0.2").Return(false)
+		admin := NewAdmin(mockPenaltyBox, "secret")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, newRequest(http.MethodDelete, BansPath+"?key=10.0.0.0%2F24", "secret"))
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		rec = httptest.NewRecorder()
+		admin.ServeHTTP(rec, newRequest(http.MethodDelete, BansPath+"?key=10.0.0.2", "secret"))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		rec = httptest.NewRecorder()
+		admin.ServeHTTP(rec, newRequest(http.MethodDelete, BansPath, "secret"))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		rec = httptest.NewRecorder()
+		admin.ServeHTTP(rec, newRequest(http.MethodPost, BansPath, "secret"))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+	t.Run("should answer 401 without the token", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockPenaltyBox := services_mock.NewMockPenaltyBoxInterface(ctrl)
+		for _, tt := range []struct{ configured, sent string }{{"secret", ""}, {"secret", "guess"}, {"", ""}} {
+			rec := httptest.NewRecorder()
+			NewAdmin(mockPenaltyBox, tt.configured).ServeHTTP(rec, newRequest(http.MethodGet, BansPath, tt.sent))
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		}
+	})
+}
+
+func TestAdmin_Reload(t *testing.T) {
+	newRequest := func(method string) *http.Request {
+		req := httptest.NewRequest(method, ReloadPath, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		return req
+	}
+	t.Run("should reload and report failures", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		admin := NewAdmin(services_mock.NewMockPenaltyBoxInterface(ctrl), "secret")
+		var reloads int
+		var reloadErr error
+		admin.SetReload(func() error {
+			reloads++
+			return reloadErr
+		})
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, newRequest(http.MethodPost))
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		reloadErr = errors.New("invalid config")
+		rec = httptest.NewRecorder()
+		admin.ServeHTTP(rec, newRequest(http.MethodPost))
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.Contains(t, rec.Body.String(), "invalid config")
+		rec = httptest.NewRecorder()
+		admin.ServeHTTP(rec, newRequest(http.MethodGet))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+		assert.Equal(t, 2, reloads)
+	})
+	t.Run("should answer 404 without a reload func", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		rec := httptest.NewRecorder()
+		NewAdmin(services_mock.NewMockPenaltyBoxInterface(ctrl), "secret").ServeHTTP(rec, newRequest(http.MethodPost))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestAdmin_Vars(t *testing.T) {
+	t.Run("should serve the metrics only with the token", func(t *testing.T) {
+		admin := NewAdmin(nil, "secret")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, VarsPath, nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		req := httptest.NewRequest(http.MethodGet, VarsPath, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec = httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		admin.SetVars(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"ratelimiter":{}}`))
+		}))
+		rec = httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, `{"ratelimiter":{}}`, rec.Body.String())
+	})
+	t.Run("should answer 404 on bans without a penalty box", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, BansPath, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		NewAdmin(nil, "secret").ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
@@ -2,39 +2,194 @@ package app
 
 import (
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
 )
 
 // IpAddrKey is the header name in which IP address would be present.
 const IpAddrKey = "IP_ADDR"
 
+// CostKey is the header name in which the cost of the request would be present when the app trusts it, see SetCostHeader.
+const CostKey = "HIT_COST"
+
+// HeaderStyle selects the rate limit headers written on responses.
+type HeaderStyle string
+
+const (
+	// HeaderStyleIETF writes RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset from the IETF draft,
+	// RateLimit-Reset being the seconds until the limit resets.
+	HeaderStyleIETF HeaderStyle = "ietf"
+	// HeaderStyleLegacy writes X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset,
+	// X-RateLimit-Reset being the epoch second the limit resets at.
+	HeaderStyleLegacy HeaderStyle = "legacy"
+	// HeaderStyleBoth writes both HeaderStyleIETF and HeaderStyleLegacy headers.
+	HeaderStyleBoth HeaderStyle = "both"
+	// HeaderStyleNone writes no rate limit headers.
+	HeaderStyleNone HeaderStyle = "none"
+)
+
 // App handles the hit and dump from high level
 type App struct {
 	rateLimiterService services.RateLimiterInterface
+	// concurrencyLimiter caps the requests in flight when it is set
+	concurrencyLimiter services.ConcurrencyLimiterInterface
+	// routeCosts holds the cost of requests to a path, it takes precedence over CostKey header
+	routeCosts map[string]int64
+	// costHeader is set when the cost of requests to paths without a route cost is read from CostKey header
+	costHeader bool
+	// headerStyle is the style of the rate limit headers, Retry-After is written on rate limited responses regardless of it
+	headerStyle HeaderStyle
+	clock       clock.Clock
+	// handler is the Middleware serving the requests, built by NewApp and rebuilt by the setters of the middleware,
+	// the route costs and CostKey header are read by cost on every request
+	handler http.Handler
 }
 
 // NewApp returns app configured with passed counterService
+// It writes HeaderStyleBoth headers unless configured otherwise with SetHeaderStyle.
 func NewApp(rateLimiterService services.RateLimiterInterface) *App {
-	return &App{
+	a := &App{
 		rateLimiterService: rateLimiterService,
+		routeCosts:         make(map[string]int64),
+		headerStyle:        HeaderStyleBoth,
+		clock:              clock.RealClock{},
+	}
+	a.handler = a.newHandler()
+	return a
+}
+
+// SetHeaderStyle sets the style of the rate limit headers, it is meant to be called before the app starts serving.
+func (a *App) SetHeaderStyle(style HeaderStyle) {
+	a.headerStyle = style
+	a.handler = a.newHandler()
+}
+
+// SetConcurrencyLimiter sets the limiter capping the requests in flight, it is meant to be called before the app starts serving.
+func (a *App) SetConcurrencyLimiter(concurrencyLimiter services.ConcurrencyLimiterInterface) {
+	a.concurrencyLimiter = concurrencyLimiter
+	a.handler = a.newHandler()
+}
+
+// SetRouteCost sets the cost of every request to path, it is meant to be called before the app starts serving.
+func (a *App) SetRouteCost(path string, cost int64) {
+	a.routeCosts[path] = cost
+}
+
+// SetCostHeader sets whether the cost of requests to paths without a route cost is read from CostKey header,
+// it is meant to be called before the app starts serving. The header is ignored unless it is set, since any client can send it.
+func (a *App) SetCostHeader(trusted bool) {
+	a.costHeader = trusted
+}
+
+// cost returns the cost of r from route costs, falling back to CostKey header when it is trusted and then to 1
+func (a *App) cost(r *http.Request) (int64, error) {
+	if cost, ok := a.routeCosts[r.URL.Path]; ok {
+		return cost, nil
 	}
+	if !a.costHeader {
+		return 1, nil
+	}
+	header := r.Header.Get(CostKey)
+	if header == "" {
+		return 1, nil
+	}
+	cost, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || cost < 1 {
+		return 0, fmt.Errorf("invalid %s header %q", CostKey, header)
+	}
+	return cost, nil
+}
+
+// Handler returns the handler of the app, a Middleware keying the requests by IpAddrKey header with their cost
+// and the concurrency limiter of the app, in front of the handler writing the counts.
+func (a *App) Handler() http.Handler {
+	return a.handler
+}
+
+// newHandler builds the Middleware of the app from its settings
+func (a *App) newHandler() http.Handler {
+	middleware := NewMiddleware(a.rateLimiterService, HeaderKey(IpAddrKey), http.HandlerFunc(a.respond))
+	middleware.SetCost(a.cost)
+	middleware.SetReject(a.reject)
+	middleware.SetHeaderStyle(a.headerStyle)
+	if a.concurrencyLimiter != nil {
+		middleware.SetConcurrencyLimiter(a.concurrencyLimiter)
+	}
+	middleware.clock = a.clock
+	return middleware
 }
 
 // Hit is the http handler function for handling the request
 func (a *App) Hit(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Println("panic recovered ", err)
+			log.Printf("panic recovered %v", err)
 		}
 	}()
-	ipAddr := r.Header.Get(IpAddrKey)
-	globalCounter, ipCounter, discardRequest := a.rateLimiterService.Hit(ipAddr)
-	if discardRequest {
-		w.WriteHeader(http.StatusTooManyRequests)
+	a.handler.ServeHTTP(w, r)
+}
+
+// respond writes the counts of an allowed request
+func (a *App) respond(w http.ResponseWriter, r *http.Request) {
+	decision, _ := DecisionFromContext(r.Context())
+	fmt.Fprintf(w, "global counter - %d, IP Counter - %d, rateLimited - %t", decision.GlobalHits, decision.IPHits, false)
+}
+
+// reject writes the counts and the reason of a rejected request
+func (a *App) reject(w http.ResponseWriter, r *http.Request, decision models.Decision) {
+	w.WriteHeader(rejectStatus(decision))
+	fmt.Fprintf(w, "global counter - %d, IP Counter - %d, rateLimited - %t, reason - %s", decision.GlobalHits, decision.IPHits, true, decision.Reason)
+}
+
+// rejectStatus returns 403 for requests from denied keys and 429 for rate limited requests
+func rejectStatus(decision models.Decision) int {
+	if decision.Reason == models.RejectReasonDenied {
+		return http.StatusForbidden
+	}
+	return http.StatusTooManyRequests
+}
+
+// writeHeaders writes the rate limit headers of decision in style and Retry-After for rate limited requests.
+// Decisions without a limit, for unlimited and denied keys, get no headers.
+func writeHeaders(w http.ResponseWriter, style HeaderStyle, now time.Time, decision models.Decision) {
+	if decision.Limit <= 0 {
+		return
+	}
+	header := w.Header()
+	limit := strconv.FormatInt(decision.Limit, 10)
+	remaining := strconv.FormatInt(decision.Remaining, 10)
+	if style == HeaderStyleIETF || style == HeaderStyleBoth {
+		header.Set("RateLimit-Limit", limit)
+		header.Set("RateLimit-Remaining", remaining)
+		header.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(decision.ResetAt.Sub(now)), 10))
+	}
+	if style == HeaderStyleLegacy || style == HeaderStyleBoth {
+		header.Set("X-RateLimit-Limit", limit)
+		header.Set("X-RateLimit-Remaining", remaining)
+		resetAt := decision.ResetAt
+		if resetAt.Before(now) {
+			resetAt = now
+		}
+		// round up to the next epoch second so clients do not retry before the reset
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(resetAt.Add(time.Second-time.Nanosecond).Unix(), 10))
+	}
+	if !decision.Allowed {
+		header.Set("Retry-After", strconv.FormatInt(ceilSeconds(decision.RetryAfter), 10))
+	}
+}
+
+// ceilSeconds returns d in seconds rounded up, negative durations are 0
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
 	}
-	fmt.Fprintf(w, "global counter - %d, IP Counter - %d, rateLimited - %t", globalCounter, ipCounter, discardRequest)
+	return int64((d + time.Second - 1) / time.Second)
 }
 
 // Dump calls service dump to dump the window
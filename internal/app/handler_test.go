@@ -6,8 +6,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/concurrency"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/services_mock"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,7 +32,7 @@ func TestApp_Hit(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		ipAddr := "10.0.0.1"
 		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
-		mockService.EXPECT().Hit(ipAddr).Return(int64(100), int64(12), false)
+		mockService.EXPECT().HitN(ipAddr, int64(1)).Return(models.Decision{Allowed: true, GlobalHits: 100, IPHits: 12})
 		counterApp := NewApp(mockService)
 		ts := httptest.NewServer(http.HandlerFunc(counterApp.Hit))
 		defer ts.Close()
@@ -48,7 +52,7 @@ func TestApp_Hit(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		ipAddr := "10.0.0.1"
 		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
-		mockService.EXPECT().Hit(ipAddr).Return(int64(100), int64(15), true)
+		mockService.EXPECT().HitN(ipAddr, int64(1)).Return(models.Decision{Reason: models.RejectReasonIP, GlobalHits: 100, IPHits: 15})
 		counterApp := NewApp(mockService)
 		ts := httptest.NewServer(http.HandlerFunc(counterApp.Hit))
 		defer ts.Close()
@@ -60,7 +64,231 @@ func TestApp_Hit(t *testing.T) {
 		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
 		assert.NoError(t, err)
-		assert.Equal(t, fmt.Sprintf("global counter - %d, IP Counter - %d, rateLimited - %t", 100, 15, true), string(body))
+		assert.Equal(t, fmt.Sprintf("global counter - %d, IP Counter - %d, rateLimited - %t, reason - %s", 100, 15, true, "ip"), string(body))
 		assert.Equal(t, 429, resp.StatusCode)
 	})
+
+	t.Run("should return status code 429(too many requests) with global reason on globally rate limited requests", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		ipAddr := "10.0.0.1"
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN(ipAddr, int64(1)).Return(models.Decision{Reason: models.RejectReasonGlobal, GlobalHits: 100, IPHits: 3})
+		counterApp := NewApp(mockService)
+		ts := httptest.NewServer(http.HandlerFunc(counterApp.Hit))
+		defer ts.Close()
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		assert.NoError(t, err)
+		req.Header.Add(IpAddrKey, ipAddr)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("global counter - %d, IP Counter - %d, rateLimited - %t, reason - %s", 100, 3, true, "global"), string(body))
+		assert.Equal(t, 429, resp.StatusCode)
+	})
+
+	t.Run("should call service hit with the cost from cost header", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		ipAddr := "10.0.0.1"
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN(ipAddr, int64(5)).Return(models.Decision{Allowed: true, GlobalHits: 100, IPHits: 12})
+		counterApp := NewApp(mockService)
+		counterApp.SetCostHeader(true)
+		ts := httptest.NewServer(http.HandlerFunc(counterApp.Hit))
+		defer ts.Close()
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		assert.NoError(t, err)
+		req.Header.Add(IpAddrKey, ipAddr)
+		req.Header.Add(CostKey, "5")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("should call service hit with the route cost ignoring cost header", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		ipAddr := "10.0.0.1"
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN(ipAddr, int64(10)).Return(models.Decision{Allowed: true, GlobalHits: 100, IPHits: 12})
+		counterApp := NewApp(mockService)
+		counterApp.SetRouteCost("/export", 10)
+		counterApp.SetCostHeader(true)
+		ts := httptest.NewServer(http.HandlerFunc(counterApp.Hit))
+		defer ts.Close()
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/export", nil)
+		assert.NoError(t, err)
+		req.Header.Add(IpAddrKey, ipAddr)
+		req.Header.Add(CostKey, "1")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("should call service hit with cost 1 ignoring the cost header unless it is trusted", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		ipAddr := "10.0.0.1"
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN(ipAddr, int64(1)).Return(models.Decision{Allowed: true, GlobalHits: 100, IPHits: 12}).Times(2)
+		counterApp := NewApp(mockService)
+		ts := httptest.NewServer(http.HandlerFunc(counterApp.Hit))
+		defer ts.Close()
+		for _, cost := range []string{"0", "5"} {
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			assert.NoError(t, err)
+			req.Header.Add(IpAddrKey, ipAddr)
+			req.Header.Add(CostKey, cost)
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, 200, resp.StatusCode)
+		}
+	})
+
+	t.Run("should return status code 400(bad request) on invalid cost header without calling service", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		counterApp := NewApp(mockService)
+		counterApp.SetCostHeader(true)
+		ts := httptest.NewServer(http.HandlerFunc(counterApp.Hit))
+		defer ts.Close()
+		for _, cost := range []string{"0", "-2", "many"} {
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			assert.NoError(t, err)
+			req.Header.Add(IpAddrKey, "10.0.0.1")
+			req.Header.Add(CostKey, cost)
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, 400, resp.StatusCode)
+		}
+	})
+}
+
+func TestApp_Hit_ConcurrencyLimiter(t *testing.T) {
+	t.Run("should reject without a hit when the requests in flight are at the limit", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		concurrencyLimiter, err := concurrency.NewConcurrencyLimiter(concurrency.Config{MaxInFlight: 1})
+		assert.NoError(t, err)
+		_, release := concurrencyLimiter.Acquire("10.0.0.1")
+		defer release()
+		counterApp := NewApp(mockService)
+		counterApp.SetConcurrencyLimiter(concurrencyLimiter)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Add(IpAddrKey, "10.0.0.1")
+		rec := httptest.NewRecorder()
+		counterApp.Handler().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "global counter - 0, IP Counter - 0, rateLimited - true, reason - concurrency", rec.Body.String())
+	})
+}
+
+func TestApp_Hit_Headers(t *testing.T) {
+	now := time.Unix(1624974458, 0)
+	allowed := models.Decision{Allowed: true, GlobalHits: 100, IPHits: 12, Limit: 15, Remaining: 3, ResetAt: now.Add(5500 * time.Millisecond)}
+	limited := models.Decision{Reason: models.RejectReasonIP, GlobalHits: 100, IPHits: 15, Limit: 15, ResetAt: now.Add(5500 * time.Millisecond), RetryAfter: 2100 * time.Millisecond}
+	tests := []struct {
+		name            string
+		style           HeaderStyle
+		decision        models.Decision
+		expectedHeaders map[string]string
+	}{
+		{
+			name:     "should write both header styles by default",
+			decision: allowed,
+			expectedHeaders: map[string]string{
+				"RateLimit-Limit": "15", "RateLimit-Remaining": "3", "RateLimit-Reset": "6",
+				"X-RateLimit-Limit": "15", "X-RateLimit-Remaining": "3", "X-RateLimit-Reset": "1624974464",
+				"Retry-After": "",
+			},
+		},
+		{
+			name:     "should write only IETF headers and retry after on rate limited requests",
+			style:    HeaderStyleIETF,
+			decision: limited,
+			expectedHeaders: map[string]string{
+				"RateLimit-Limit": "15", "RateLimit-Remaining": "0", "RateLimit-Reset": "6",
+				"X-RateLimit-Limit": "", "X-RateLimit-Remaining": "", "X-RateLimit-Reset": "",
+				"Retry-After": "3",
+			},
+		},
+		{
+			name:     "should write only legacy headers",
+			style:    HeaderStyleLegacy,
+			decision: allowed,
+			expectedHeaders: map[string]string{
+				"RateLimit-Limit": "", "RateLimit-Remaining": "", "RateLimit-Reset": "",
+				"X-RateLimit-Limit": "15", "X-RateLimit-Remaining": "3", "X-RateLimit-Reset": "1624974464",
+			},
+		},
+		{
+			name:     "should write only retry after when headers are disabled",
+			style:    HeaderStyleNone,
+			decision: limited,
+			expectedHeaders: map[string]string{
+				"RateLimit-Limit": "", "X-RateLimit-Limit": "", "Retry-After": "3",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+			mockService.EXPECT().HitN("10.0.0.1", int64(1)).Return(tt.decision)
+			counterApp := NewApp(mockService)
+			counterApp.clock = clock.NewFakeClock(now)
+			counterApp.handler = counterApp.newHandler()
+			if tt.style != "" {
+				counterApp.SetHeaderStyle(tt.style)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Add(IpAddrKey, "10.0.0.1")
+			rec := httptest.NewRecorder()
+			counterApp.Hit(rec, req)
+			for name, value := range tt.expectedHeaders {
+				assert.Equal(t, value, rec.Header().Get(name), name)
+			}
+		})
+	}
+}
+
+func TestApp_Handler(t *testing.T) {
+	t.Run("should serve every request with the handler built for the settings", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN("10.0.0.1", int64(1)).Return(models.Decision{Allowed: true, Limit: 15, Remaining: 14}).Times(2)
+		counterApp := NewApp(mockService)
+		handler := counterApp.Handler()
+		assert.Same(t, handler, counterApp.Handler())
+		counterApp.SetHeaderStyle(HeaderStyleLegacy)
+		assert.NotSame(t, handler, counterApp.Handler())
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Add(IpAddrKey, "10.0.0.1")
+			rec := httptest.NewRecorder()
+			counterApp.Hit(rec, req)
+			assert.Equal(t, "15", rec.Header().Get("X-RateLimit-Limit"))
+			assert.Equal(t, "", rec.Header().Get("RateLimit-Limit"))
+		}
+	})
+}
+
+func TestApp_Hit_Denied(t *testing.T) {
+	t.Run("should return status code 403 without rate limit headers for denied keys", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN("198.51.100.7", int64(1)).Return(models.Decision{Reason: models.RejectReasonDenied, Rule: "198.51.100.0/24", GlobalHits: 100})
+		counterApp := NewApp(mockService)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Add(IpAddrKey, "198.51.100.7")
+		rec := httptest.NewRecorder()
+		counterApp.Hit(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, "global counter - 100, IP Counter - 0, rateLimited - true, reason - denied", rec.Body.String())
+		assert.Equal(t, "", rec.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "", rec.Header().Get("Retry-After"))
+	})
 }
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+)
+
+// KeyFunc returns the key a request is rate limited by.
+type KeyFunc func(r *http.Request) string
+
+// RejectFunc writes the response for a request rejected with decision, rate limit headers are already written.
+type RejectFunc func(w http.ResponseWriter, r *http.Request, decision models.Decision)
+
+// HeaderKey returns a KeyFunc keying requests by the value of header name, like IpAddrKey.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// RemoteAddrKey keys requests by the host of their remote address.
+func RemoteAddrKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// CostFunc returns the cost of a request, requests it returns an error for are answered with 400 without a hit.
+type CostFunc func(r *http.Request) (int64, error)
+
+// decisionKey is the context key of the decision of a request passed to the next handler
+type decisionKey struct{}
+
+// DecisionFromContext returns the decision of the allowed request ctx belongs to, false for requests not passed through a Middleware.
+func DecisionFromContext(ctx context.Context) (models.Decision, bool) {
+	decision, ok := ctx.Value(decisionKey{}).(models.Decision)
+	return decision, ok
+}
+
+// DefaultReject responds with 429, or 403 for denied keys, and the reason of decision.
+func DefaultReject(w http.ResponseWriter, r *http.Request, decision models.Decision) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(rejectStatus(decision))
+	fmt.Fprintf(w, "rate limited - %s", decision.Reason)
+}
+
+// Middleware rate limits requests to the next handler, allowed requests are passed through with their decision in the context
+// and rejected requests are answered by the reject func. Every request costs 1 unless a cost func is set.
+// With a concurrency limiter it also caps the requests in flight, holding a slot until the next handler returns.
+type Middleware struct {
+	rateLimiterService services.RateLimiterInterface
+	concurrencyLimiter services.ConcurrencyLimiterInterface
+	key                KeyFunc
+	cost               CostFunc
+	next               http.Handler
+	reject             RejectFunc
+	headerStyle        HeaderStyle
+	clock              clock.Clock
+}
+
+// NewMiddleware returns a middleware rate limiting requests to next by the key returned from key.
+// It rejects with DefaultReject and writes HeaderStyleBoth headers unless configured otherwise.
+func NewMiddleware(rateLimiterService services.RateLimiterInterface, key KeyFunc, next http.Handler) *Middleware {
+	return &Middleware{
+		rateLimiterService: rateLimiterService,
+		key:                key,
+		next:               next,
+		reject:             DefaultReject,
+		headerStyle:        HeaderStyleBoth,
+		clock:              clock.RealClock{},
+	}
+}
+
+// SetReject sets the func writing rejected responses, it is meant to be called before the middleware starts serving.
+func (m *Middleware) SetReject(reject RejectFunc) {
+	m.reject = reject
+}
+
+// SetHeaderStyle sets the style of the rate limit headers, it is meant to be called before the middleware starts serving.
+func (m *Middleware) SetHeaderStyle(style HeaderStyle) {
+	m.headerStyle = style
+}
+
+// SetCost sets the func returning the cost of a request, it is meant to be called before the middleware starts serving.
+func (m *Middleware) SetCost(cost CostFunc) {
+	m.cost = cost
+}
+
+// SetConcurrencyLimiter sets the limiter capping the requests in flight, it is meant to be called before the middleware starts serving.
+func (m *Middleware) SetConcurrencyLimiter(concurrencyLimiter services.ConcurrencyLimiterInterface) {
+	m.concurrencyLimiter = concurrencyLimiter
+}
+
+// ServeHTTP records the cost of r for its key and passes r to the next handler if it is allowed.
+// With a concurrency limiter a slot is acquired first, requests without a free slot are rejected
+// without a hit or rate limit headers, and the slot is released when the next handler returns or the request is rate limited.
+// The decision passed to the next handler reports the requests in flight of the concurrency limiter.
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := m.key(r)
+	cost := int64(1)
+	if m.cost != nil {
+		var err error
+		if cost, err = m.cost(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var inFlight, globalInFlight int64
+	if m.concurrencyLimiter != nil {
+		concurrencyDecision, release := m.concurrencyLimiter.Acquire(key)
+		if !concurrencyDecision.Allowed {
+			m.reject(w, r, concurrencyDecision)
+			return
+		}
+		defer release()
+		inFlight, globalInFlight = concurrencyDecision.InFlight, concurrencyDecision.GlobalInFlight
+	}
+	decision := m.rateLimiterService.HitN(key, cost)
+	decision.InFlight, decision.GlobalInFlight = inFlight, globalInFlight
+	writeHeaders(w, m.headerStyle, m.clock.Now(), decision)
+	if !decision.Allowed {
+		m.reject(w, r, decision)
+		return
+	}
+	m.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), decisionKey{}, decision)))
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/concurrency"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/services_mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware_ServeHTTP(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("next"))
+	})
+	t.Run("should pass allowed requests to the next handler with rate limit headers", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN("10.0.0.1", int64(1)).Return(models.Decision{Allowed: true, Limit: 15, Remaining: 14})
+		middleware := NewMiddleware(mockService, HeaderKey(IpAddrKey), next)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Add(IpAddrKey, "10.0.0.1")
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.Equal(t, "next", rec.Body.String())
+		assert.Equal(t, "14", rec.Header().Get("RateLimit-Remaining"))
+	})
+	t.Run("should reject denied requests with 429 without calling the next handler", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		now := time.Unix(1624974458, 0)
+		mockService.EXPECT().HitN("192.0.2.1", int64(1)).Return(models.Decision{Reason: models.RejectReasonGlobal, Limit: 15, RetryAfter: 1500 * time.Millisecond})
+		middleware := NewMiddleware(mockService, RemoteAddrKey, next)
+		middleware.clock = clock.NewFakeClock(now)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "rate limited - global", rec.Body.String())
+		assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	})
+	t.Run("should render rejections with the configured reject func", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN("10.0.0.1", int64(1)).Return(models.Decision{Reason: models.RejectReasonIP})
+		middleware := NewMiddleware(mockService, HeaderKey(IpAddrKey), next)
+		middleware.SetHeaderStyle(HeaderStyleNone)
+		middleware.SetReject(func(w http.ResponseWriter, r *http.Request, decision models.Decision) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"` + string(decision.Reason) + `"}`))
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Add(IpAddrKey, "10.0.0.1")
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, `{"error":"ip"}`, rec.Body.String())
+		assert.Equal(t, "", rec.Header().Get("RateLimit-Limit"))
+	})
+}
+
+func TestMiddleware_Cost(t *testing.T) {
+	t.Run("should record the cost of the request and pass its decision to the next handler", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		decision := models.Decision{Allowed: true, IPHits: 4, Limit: 15, Remaining: 11}
+		mockService.EXPECT().HitN("10.0.0.1", int64(4)).Return(decision)
+		var passed models.Decision
+		middleware := NewMiddleware(mockService, HeaderKey(IpAddrKey), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			passed, _ = DecisionFromContext(r.Context())
+		}))
+		middleware.SetCost(func(r *http.Request) (int64, error) { return 4, nil })
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Add(IpAddrKey, "10.0.0.1")
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, decision, passed)
+	})
+	t.Run("should return status code 400 without a hit when the cost is invalid", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockConcurrencyLimiter := services_mock.NewMockConcurrencyLimiterInterface(ctrl)
+		middleware := NewMiddleware(mockService, HeaderKey(IpAddrKey), http.NotFoundHandler())
+		middleware.SetConcurrencyLimiter(mockConcurrencyLimiter)
+		middleware.SetCost(func(r *http.Request) (int64, error) { return 0, errors.New("invalid cost") })
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestMiddleware_ConcurrencyLimiter(t *testing.T) {
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Add(IpAddrKey, "10.0.0.1")
+		return req
+	}
+	t.Run("should hold a slot while the next handler runs and release it after", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN("10.0.0.1", int64(1)).Return(models.Decision{Allowed: true, Limit: 15, Remaining: 14})
+		concurrencyLimiter, err := concurrency.NewConcurrencyLimiter(concurrency.Config{MaxInFlight: 2})
+		assert.NoError(t, err)
+		var inFlight int64
+		middleware := NewMiddleware(mockService, HeaderKey(IpAddrKey), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inFlight, _ = concurrencyLimiter.InFlight("10.0.0.1")
+		}))
+		middleware.SetConcurrencyLimiter(concurrencyLimiter)
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, newRequest())
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, int64(1), inFlight)
+		inFlight, globalInFlight := concurrencyLimiter.InFlight("10.0.0.1")
+		assert.Zero(t, inFlight)
+		assert.Zero(t, globalInFlight)
+	})
+	t.Run("should pass the requests in flight in the decision", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN("10.0.0.1", int64(1)).Return(models.Decision{Allowed: true, Limit: 15, Remaining: 14})
+		concurrencyLimiter, err := concurrency.NewConcurrencyLimiter(concurrency.Config{MaxInFlight: 2, GlobalMaxInFlight: 3})
+		assert.NoError(t, err)
+		_, release := concurrencyLimiter.Acquire("10.0.0.2")
+		defer release()
+		var passed models.Decision
+		var ok bool
+		middleware := NewMiddleware(mockService, HeaderKey(IpAddrKey), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			passed, ok = DecisionFromContext(r.Context())
+		}))
+		middleware.SetConcurrencyLimiter(concurrencyLimiter)
+		middleware.ServeHTTP(httptest.NewRecorder(), newRequest())
+		assert.True(t, ok)
+		assert.Equal(t, int64(1), passed.InFlight)
+		assert.Equal(t, int64(2), passed.GlobalInFlight)
+		assert.Equal(t, int64(14), passed.Remaining)
+	})
+	t.Run("should reject without a hit when no slot is free", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		concurrencyLimiter, err := concurrency.NewConcurrencyLimiter(concurrency.Config{MaxInFlight: 1})
+		assert.NoError(t, err)
+		_, release := concurrencyLimiter.Acquire("10.0.0.1")
+		defer release()
+		middleware := NewMiddleware(mockService, HeaderKey(IpAddrKey), http.NotFoundHandler())
+		middleware.SetConcurrencyLimiter(concurrencyLimiter)
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, newRequest())
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "rate limited - concurrency", rec.Body.String())
+		assert.Equal(t, "", rec.Header().Get("RateLimit-Limit"))
+	})
+	t.Run("should release the slot of rate limited requests", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := services_mock.NewMockRateLimiterInterface(ctrl)
+		mockService.EXPECT().HitN("10.0.0.1", int64(1)).Return(models.Decision{Reason: models.RejectReasonIP, Limit: 15})
+		mockConcurrencyLimiter := services_mock.NewMockConcurrencyLimiterInterface(ctrl)
+		released := false
+		mockConcurrencyLimiter.EXPECT().Acquire("10.0.0.1").Return(models.Decision{Allowed: true, InFlight: 1}, func() { released = true })
+		middleware := NewMiddleware(mockService, HeaderKey(IpAddrKey), http.NotFoundHandler())
+		middleware.SetConcurrencyLimiter(mockConcurrencyLimiter)
+		rec := httptest.NewRecorder()
+		middleware.ServeHTTP(rec, newRequest())
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.True(t, released)
+	})
+}
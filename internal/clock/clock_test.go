@@ -0,0 +1,25 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	t.Run("should return the time it is set to", func(t *testing.T) {
+		now := time.Unix(1624974458, 0)
+		fakeClock := NewFakeClock(now)
+		assert.Equal(t, now, fakeClock.Now())
+		later := now.Add(time.Hour)
+		fakeClock.Set(later)
+		assert.Equal(t, later, fakeClock.Now())
+	})
+	t.Run("should move forward only when advanced", func(t *testing.T) {
+		now := time.Unix(1624974458, 0)
+		fakeClock := NewFakeClock(now)
+		fakeClock.Advance(1500 * time.Millisecond)
+		assert.Equal(t, now.Add(1500*time.Millisecond), fakeClock.Now())
+	})
+}
@@ -0,0 +1,463 @@
+// Package config loads the configuration of the application from a YAML file, environment variables and command line flags,
+// each overriding the one before, and validates it.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/walpersistence"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/pkg/limiter"
+)
+
+const (
+	// FileEnv is the environment variable holding the path of the YAML config file, the -config flag takes precedence over it.
+	FileEnv = "CONFIG_FILE"
+	// FileFlag is the flag holding the path of the YAML config file.
+	FileFlag = "config"
+
+	// PersistenceJSON dumps the windows to the dump file.
+	PersistenceJSON = "json"
+	// PersistenceWAL dumps the windows to the dump file and appends every hit to a write-ahead log next to it.
+	PersistenceWAL = "wal"
+)
+
+// Duration is a time.Duration written as a duration string, like 20s, in YAML.
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration string, like 1m30s.
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	duration, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", node.Line, err.Error())
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalYAML writes the duration as a duration string.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Config is the configuration of the application.
+type Config struct {
+	// Port is the address the server listens on, like :8000.
+	Port string `yaml:"port"`
+	// DumpFile is the JSON file the windows are dumped to and loaded from.
+	DumpFile string `yaml:"dump_file"`
+	// SnapshotInterval is how often the windows are dumped while serving, 0 dumps them only on shutdown.
+	SnapshotInterval Duration `yaml:"snapshot_interval"`
+	// Persistence is how the windows are persisted, json dumps them to DumpFile,
+	// wal also appends every hit to a write-ahead log next to it.
+	Persistence string `yaml:"persistence"`
+	// WALCompactionThreshold is the size in bytes of a write-ahead log segment after which the log is compacted into DumpFile.
+	WALCompactionThreshold int64 `yaml:"wal_compaction_threshold"`
+	// Algorithm is the rate limiting algorithm, sliding_window, token_bucket or gcra.
+	Algorithm string `yaml:"algorithm"`
+	// Limit is the number of requests allowed for an IP in Window.
+	Limit  int64    `yaml:"limit"`
+	Window Duration `yaml:"window"`
+	// GlobalLimit is the number of requests allowed across all IPs in GlobalWindow, 0 disables it.
+	GlobalLimit  int64    `yaml:"global_limit"`
+	GlobalWindow Duration `yaml:"global_window"`
+	// Resolution is the width of the buckets hits are grouped in.
+	Resolution Duration `yaml:"resolution"`
+	// CounterMode is the sliding window counter, exact or approximate.
+	CounterMode string `yaml:"counter_mode"`
+	// Headers is the style of the rate limit headers, ietf, legacy, both or none.
+	Headers string `yaml:"headers"`
+	// RouteCosts are the costs of the requests to paths, like /export=10,/search=5, they take precedence over the cost header.
+	RouteCosts string `yaml:"route_costs"`
+	// TrustCostHeader reads the cost of the requests to other paths from the HIT_COST header, which any client can send.
+	TrustCostHeader bool `yaml:"trust_cost_header"`
+	// MaxKeys is the number of IPs tracked at once, 0 is unlimited.
+	MaxKeys int `yaml:"max_keys"`
+	// EvictionInterval is how often idle IPs are evicted.
+	EvictionInterval Duration `yaml:"eviction_interval"`
+	// Overrides replace the IP limit for keys and CIDRs, like 10.0.0.0/8=unlimited,203.0.113.7=500/1m.
+	Overrides string `yaml:"overrides"`
+	// IPv4Prefix and IPv6Prefix are the prefix lengths IP addresses are keyed by, 0 keys each address.
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+	// Windows are additional IP windows and calendar quotas, like 10/1s,100000/month.
+	Windows string `yaml:"windows"`
+	// QuotaTimezone is the IANA time zone calendar quotas reset in.
+	QuotaTimezone string `yaml:"quota_timezone"`
+	// PenaltyViolations is the number of rejections within PenaltyWindow which ban an IP, 0 disables bans.
+	PenaltyViolations int64    `yaml:"penalty_violations"`
+	PenaltyWindow     Duration `yaml:"penalty_window"`
+	PenaltyBan        Duration `yaml:"penalty_ban"`
+	PenaltyMaxBan     Duration `yaml:"penalty_max_ban"`
+	// ShadowWindows are the windows of a candidate IP policy evaluated without being enforced, like 10/20s.
+	ShadowWindows string `yaml:"shadow_windows"`
+	// MaxInFlight is the number of requests of an IP in flight at once, 0 disables the concurrency limit.
+	MaxInFlight int64 `yaml:"max_in_flight"`
+	// GlobalMaxInFlight is the number of requests across all IPs in flight at once, 0 disables it.
+	GlobalMaxInFlight int64 `yaml:"global_max_in_flight"`
+	// AdminToken is the bearer token of the admin API, the admin API is served only when it is set.
+	AdminToken string `yaml:"admin_token"`
+}
+
+// Default returns the configuration used for every setting which is not configured.
+func Default() Config {
+	return Config{
+		Port:                   ":8000",
+		DumpFile:               "./dump.json",
+		SnapshotInterval:       Duration(time.Minute),
+		Persistence:            PersistenceJSON,
+		WALCompactionThreshold: walpersistence.DefaultCompactionThreshold,
+		Algorithm:              string(limiter.SlidingWindow),
+		Limit:                  15,
+		Window:                 Duration(20 * time.Second),
+		GlobalWindow:           Duration(60 * time.Second),
+		Resolution:             Duration(time.Second),
+		CounterMode:            string(limiter.ExactCounter),
+		Headers:                "both",
+		EvictionInterval:       Duration(time.Minute),
+		QuotaTimezone:          "UTC",
+	}
+}
+
+// setting is a setting configurable by an environment variable and a flag
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func stringSetting(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func intSetting(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func int64Setting(field func(c *Config) *int64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolSetting(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func durationSetting(field func(c *Config) *Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration, like 20s", value)
+		}
+		*field(c) = Duration(duration)
+		return nil
+	}
+}
+
+// settings are the settings overridable by environment variables and flags, in the order of Config
+var settings = []setting{
+	{"APP_PORT", "port", "address the server listens on", stringSetting(func(c *Config) *string { return &c.Port })},
+	{"DUMP_FILE", "dump-file", "JSON file the windows are dumped to", stringSetting(func(c *Config) *string { return &c.DumpFile })},
+	{"SNAPSHOT_INTERVAL", "snapshot-interval", "how often the windows are dumped while serving, like 30s, 0s dumps only on shutdown", durationSetting(func(c *Config) *Duration { return &c.SnapshotInterval })},
+	{"PERSISTENCE", "persistence", "json, or wal to also append every hit to a write-ahead log", stringSetting(func(c *Config) *string { return &c.Persistence })},
+	{"WAL_COMPACTION_THRESHOLD", "wal-compaction-threshold", "size in bytes of a write-ahead log segment after which it is compacted", int64Setting(func(c *Config) *int64 { return &c.WALCompactionThreshold })},
+	{"RATE_LIMITER_ALGORITHM", "algorithm", "sliding_window, token_bucket or gcra", stringSetting(func(c *Config) *string { return &c.Algorithm })},
+	{"IP_ALLOWED_RATE", "limit", "requests allowed for an IP in the window", int64Setting(func(c *Config) *int64 { return &c.Limit })},
+	{"IP_WINDOW", "window", "IP window, like 20s", durationSetting(func(c *Config) *Duration { return &c.Window })},
+	{"GLOBAL_ALLOWED_RATE", "global-limit", "requests allowed across all IPs in the global window, 0 disables it", int64Setting(func(c *Config) *int64 { return &c.GlobalLimit })},
+	{"GLOBAL_WINDOW", "global-window", "global window, like 60s", durationSetting(func(c *Config) *Duration { return &c.GlobalWindow })},
+	{"COUNTER_RESOLUTION", "resolution", "width of the buckets hits are grouped in, like 100ms", durationSetting(func(c *Config) *Duration { return &c.Resolution })},
+	{"COUNTER_MODE", "counter-mode", "exact or approximate", stringSetting(func(c *Config) *string { return &c.CounterMode })},
+	{"RATE_LIMIT_HEADERS", "headers", "ietf, legacy, both or none", stringSetting(func(c *Config) *string { return &c.Headers })},
+	{"ROUTE_COSTS", "route-costs", "costs of the requests to paths, like /export=10,/search=5", stringSetting(func(c *Config) *string { return &c.RouteCosts })},
+	{"TRUST_COST_HEADER", "trust-cost-header", "read the cost of the requests to other paths from the HIT_COST header", boolSetting(func(c *Config) *bool { return &c.TrustCostHeader })},
+	{"MAX_KEYS", "max-keys", "IPs tracked at once, 0 is unlimited", intSetting(func(c *Config) *int { return &c.MaxKeys })},
+	{"KEY_EVICTION_INTERVAL", "eviction-interval", "how often idle IPs are evicted, like 30s", durationSetting(func(c *Config) *Duration { return &c.EvictionInterval })},
+	{"RATE_LIMIT_OVERRIDES", "overrides", "IP limit overrides, like 10.0.0.0/8=unlimited,203.0.113.7=500/1m", stringSetting(func(c *Config) *string { return &c.Overrides })},
+	{"IPV4_PREFIX", "ipv4-prefix", "prefix length IPv4 addresses are keyed by, 0 keys each address", intSetting(func(c *Config) *int { return &c.IPv4Prefix })},
+	{"IPV6_PREFIX", "ipv6-prefix", "prefix length IPv6 addresses are keyed by, 0 keys each address", intSetting(func(c *Config) *int { return &c.IPv6Prefix })},
+	{"IP_WINDOWS", "windows", "additional IP windows and quotas, like 10/1s,100000/month", stringSetting(func(c *Config) *string { return &c.Windows })},
+	{"QUOTA_TIMEZONE", "quota-timezone", "time zone calendar quotas reset in, like Europe/Berlin", stringSetting(func(c *Config) *string { return &c.QuotaTimezone })},
+	{"PENALTY_VIOLATIONS", "penalty-violations", "rejections within the penalty window which ban an IP, 0 disables bans", int64Setting(func(c *Config) *int64 { return &c.PenaltyViolations })},
+	{"PENALTY_WINDOW", "penalty-window", "window rejections are counted in for bans, like 10s", durationSetting(func(c *Config) *Duration { return &c.PenaltyWindow })},
+	{"PENALTY_BAN", "penalty-ban", "length of the first ban, like 1m", durationSetting(func(c *Config) *Duration { return &c.PenaltyBan })},
+	{"PENALTY_MAX_BAN", "penalty-max-ban", "cap of the doubled bans, like 1h", durationSetting(func(c *Config) *Duration { return &c.PenaltyMaxBan })},
+	{"SHADOW_WINDOWS", "shadow-windows", "windows of a candidate IP policy evaluated without being enforced, like 10/20s", stringSetting(func(c *Config) *string { return &c.ShadowWindows })},
+	{"MAX_IN_FLIGHT", "max-in-flight", "requests of an IP in flight at once, 0 disables the concurrency limit", int64Setting(func(c *Config) *int64 { return &c.MaxInFlight })},
+	{"GLOBAL_MAX_IN_FLIGHT", "global-max-in-flight", "requests across all IPs in flight at once, 0 disables it", int64Setting(func(c *Config) *int64 { return &c.GlobalMaxInFlight })},
+	{"ADMIN_TOKEN", "admin-token", "bearer token of the admin API, the admin API is served only when it is set", stringSetting(func(c *Config) *string { return &c.AdminToken })},
+}
+
+// Load returns the configuration of the defaults overridden by the YAML file, then by the environment variables read with getenv
+// and then by the flags in args, and validates it. The file is the one of the -config flag or of FileEnv, no file is read when neither is set.
+func Load(args []string, getenv func(string) string) (Config, error) {
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+	fs := flag.NewFlagSet("sliding-window-rate-limiter", flag.ContinueOnError)
+	file := fs.String(FileFlag, "", "YAML config file, overrides "+FileEnv)
+	for _, s := range settings {
+		s := s
+		fs.Func(s.flag, s.usage+", overrides "+s.env, func(value string) error {
+			flagValues = append(flagValues, flagValue{s, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	config := Default()
+	if *file == "" {
+		*file = getenv(FileEnv)
+	}
+	if *file != "" {
+		if err := config.readFile(*file); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(&config, value); err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %s", s.env, err.Error())
+			}
+		}
+	}
+	for _, f := range flagValues {
+		if err := f.setting.set(&config, f.value); err != nil {
+			return Config{}, fmt.Errorf("invalid -%s: %s", f.setting.flag, err.Error())
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// readFile overrides the configuration with the settings of the YAML file, unknown settings are an error
+func (c *Config) readFile(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("reading config file: %s", err.Error())
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %s", file, err.Error())
+	}
+	return nil
+}
+
+// Validate returns an error listing every invalid setting.
+func (c Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Port != "", "port must be set")
+	check(c.DumpFile != "", "dump_file must be set")
+	check(c.SnapshotInterval >= 0, "snapshot_interval must not be negative, got %s", time.Duration(c.SnapshotInterval))
+	switch c.Persistence {
+	case PersistenceJSON:
+	case PersistenceWAL:
+		check(limiter.Algorithm(c.Algorithm) == limiter.SlidingWindow, "persistence wal is only supported by algorithm sliding_window, got %q", c.Algorithm)
+		check(c.WALCompactionThreshold > 0, "wal_compaction_threshold must be positive, got %d", c.WALCompactionThreshold)
+	default:
+		problems = append(problems, fmt.Sprintf("persistence must be json or wal, got %q", c.Persistence))
+	}
+	switch limiter.Algorithm(c.Algorithm) {
+	case limiter.SlidingWindow, limiter.TokenBucket, limiter.GCRA:
+	default:
+		problems = append(problems, fmt.Sprintf("algorithm must be sliding_window, token_bucket or gcra, got %q", c.Algorithm))
+	}
+	check(c.Limit > 0, "limit must be positive, got %d", c.Limit)
+	check(c.Window > 0, "window must be positive, got %s", time.Duration(c.Window))
+	check(c.GlobalLimit >= 0, "global_limit must not be negative, got %d", c.GlobalLimit)
+	check(c.GlobalLimit == 0 || c.GlobalWindow > 0, "global_window must be positive, got %s", time.Duration(c.GlobalWindow))
+	check(c.Resolution > 0, "resolution must be positive, got %s", time.Duration(c.Resolution))
+	switch limiter.CounterMode(c.CounterMode) {
+	case limiter.ExactCounter, limiter.ApproximateCounter:
+	default:
+		problems = append(problems, fmt.Sprintf("counter_mode must be exact or approximate, got %q", c.CounterMode))
+	}
+	check(limiter.CounterMode(c.CounterMode) != limiter.ApproximateCounter || limiter.Algorithm(c.Algorithm) == limiter.SlidingWindow,
+		"counter_mode approximate is only supported by algorithm sliding_window, got %q", c.Algorithm)
+	check(c.MaxKeys == 0 || limiter.Algorithm(c.Algorithm) == limiter.SlidingWindow, "max_keys is only supported by algorithm sliding_window, got %q", c.Algorithm)
+	// the header styles of app.HeaderStyle, config is loaded before the app is built and does not depend on it
+	switch c.Headers {
+	case "ietf", "legacy", "both", "none":
+	default:
+		problems = append(problems, fmt.Sprintf("headers must be ietf, legacy, both or none, got %q", c.Headers))
+	}
+	if _, err := c.ParsedRouteCosts(); err != nil {
+		problems = append(problems, "route_costs: "+err.Error())
+	}
+	check(c.MaxKeys >= 0, "max_keys must not be negative, got %d", c.MaxKeys)
+	check(c.EvictionInterval > 0, "eviction_interval must be positive, got %s", time.Duration(c.EvictionInterval))
+	if _, err := c.ParsedOverrides(); err != nil {
+		problems = append(problems, "overrides: "+err.Error())
+	}
+	check(c.IPv4Prefix >= 0 && c.IPv4Prefix <= 32, "ipv4_prefix must be between 0 and 32, got %d", c.IPv4Prefix)
+	check(c.IPv6Prefix >= 0 && c.IPv6Prefix <= 128, "ipv6_prefix must be between 0 and 128, got %d", c.IPv6Prefix)
+	if windows, err := c.ParsedWindows(); err != nil {
+		problems = append(problems, "windows: "+err.Error())
+	} else {
+		problems = append(problems, windowProblems("windows", windows)...)
+	}
+	if _, err := c.QuotaLocation(); err != nil {
+		problems = append(problems, "quota_timezone: "+err.Error())
+	}
+	check(c.PenaltyViolations >= 0, "penalty_violations must not be negative, got %d", c.PenaltyViolations)
+	if c.PenaltyViolations > 0 {
+		check(c.PenaltyWindow > 0, "penalty_window must be positive, got %s", time.Duration(c.PenaltyWindow))
+		check(c.PenaltyBan > 0, "penalty_ban must be positive, got %s", time.Duration(c.PenaltyBan))
+		check(c.PenaltyMaxBan == 0 || c.PenaltyMaxBan >= c.PenaltyBan, "penalty_max_ban must not be shorter than penalty_ban, got %s", time.Duration(c.PenaltyMaxBan))
+	}
+	if windows, err := c.ParsedShadowWindows(); err != nil {
+		problems = append(problems, "shadow_windows: "+err.Error())
+	} else {
+		problems = append(problems, windowProblems("shadow_windows", windows)...)
+	}
+	check(c.MaxInFlight >= 0, "max_in_flight must not be negative, got %d", c.MaxInFlight)
+	check(c.GlobalMaxInFlight >= 0, "global_max_in_flight must not be negative, got %d", c.GlobalMaxInFlight)
+	check(c.GlobalMaxInFlight == 0 || c.MaxInFlight > 0, "global_max_in_flight requires max_in_flight")
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// windowProblems returns a problem for every window of the setting name which is empty or allows no requests
+func windowProblems(name string, windows []limiter.Window) []string {
+	var problems []string
+	for _, window := range windows {
+		if window.Period == "" && window.Size <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: window size must be positive, got %s", name, window.Size))
+		}
+		if window.AllowedRate <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: rate must be positive, got %d", name, window.AllowedRate))
+		}
+	}
+	return problems
+}
+
+// ParsedOverrides returns the parsed Overrides.
+func (c Config) ParsedOverrides() ([]limiter.Override, error) {
+	return limiter.ParseOverrides(c.Overrides)
+}
+
+// ParsedRouteCosts returns the cost of each path of RouteCosts, a comma separated list of path=cost with paths starting with /
+// and positive costs.
+func (c Config) ParsedRouteCosts() (map[string]int64, error) {
+	costs := make(map[string]int64)
+	for _, routeCost := range strings.Split(c.RouteCosts, ",") {
+		routeCost = strings.TrimSpace(routeCost)
+		if routeCost == "" {
+			continue
+		}
+		i := strings.LastIndex(routeCost, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not path=cost", routeCost)
+		}
+		path := strings.TrimSpace(routeCost[:i])
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q must start with /", path)
+		}
+		cost, err := strconv.ParseInt(strings.TrimSpace(routeCost[i+1:]), 10, 64)
+		if err != nil || cost < 1 {
+			return nil, fmt.Errorf("cost of %s must be a positive integer, got %q", path, routeCost[i+1:])
+		}
+		if _, ok := costs[path]; ok {
+			return nil, fmt.Errorf("path %s has more than one cost", path)
+		}
+		costs[path] = cost
+	}
+	return costs, nil
+}
+
+// ParsedWindows returns the parsed Windows.
+func (c Config) ParsedWindows() ([]limiter.Window, error) {
+	return limiter.ParseWindows(c.Windows)
+}
+
+// ParsedShadowWindows returns the parsed ShadowWindows.
+func (c Config) ParsedShadowWindows() ([]limiter.Window, error) {
+	return limiter.ParseWindows(c.ShadowWindows)
+}
+
+// QuotaLocation returns the location of QuotaTimezone.
+func (c Config) QuotaLocation() (*time.Location, error) {
+	return time.LoadLocation(c.QuotaTimezone)
+}
+
+// Penalty returns the penalty box settings.
+func (c Config) Penalty() limiter.Penalty {
+	return limiter.Penalty{
+		Violations:     c.PenaltyViolations,
+		Within:         time.Duration(c.PenaltyWindow),
+		BanDuration:    time.Duration(c.PenaltyBan),
+		MaxBanDuration: time.Duration(c.PenaltyMaxBan),
+	}
+}
+
+// Changed returns the YAML names of the settings of other which differ from c, in the order of Config.
+func (c Config) Changed(other Config) []string {
+	var changed []string
+	value, otherValue := reflect.ValueOf(c), reflect.ValueOf(other)
+	for i := 0; i < value.NumField(); i++ {
+		if value.Field(i).Interface() != otherValue.Field(i).Interface() {
+			changed = append(changed, value.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+	return changed
+}
+
+// String returns the configuration as YAML with the admin token redacted.
+func (c Config) String() string {
+	if c.AdminToken != "" {
+		c.AdminToken = "<redacted>"
+	}
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/pkg/limiter"
+	"github.com/stretchr/testify/assert"
+)
+
+// env returns a getenv of vars
+func env(vars map[string]string) func(string) string {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+// writeFile writes content to a YAML file in a temporary directory and returns its path
+func writeFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0644))
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("should return the defaults when nothing is configured", func(t *testing.T) {
+		config, err := Load(nil, env(nil))
+		assert.NoError(t, err)
+		assert.Equal(t, Default(), config)
+	})
+	t.Run("should override the file by the environment and the environment by the flags", func(t *testing.T) {
+		file := writeFile(t, "limit: 100\nwindow: 1m\nglobal_limit: 1000\nwindows: 10/1s\n")
+		config, err := Load([]string{"-limit", "300", "-global-window", "2m"}, env(map[string]string{
+			FileEnv:               file,
+			"IP_ALLOWED_RATE":     "200",
+			"GLOBAL_ALLOWED_RATE": "2000",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(300), config.Limit)
+		assert.Equal(t, Duration(time.Minute), config.Window)
+		assert.Equal(t, int64(2000), config.GlobalLimit)
+		assert.Equal(t, Duration(2*time.Minute), config.GlobalWindow)
+		assert.Equal(t, "10/1s", config.Windows)
+		assert.Equal(t, ":8000", config.Port)
+	})
+	t.Run("should read the file of the config flag over the one of the environment", func(t *testing.T) {
+		config, err := Load([]string{"-config", writeFile(t, "limit: 7\n")}, env(map[string]string{FileEnv: writeFile(t, "limit: 8\n")}))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(7), config.Limit)
+	})
+	t.Run("should accept an empty file", func(t *testing.T) {
+		config, err := Load([]string{"-config", writeFile(t, "")}, env(nil))
+		assert.NoError(t, err)
+		assert.Equal(t, Default(), config)
+	})
+	t.Run("should return error on unknown settings and unparsable values", func(t *testing.T) {
+		for _, tt := range []struct {
+			name string
+			args []string
+			env  map[string]string
+			err  string
+		}{
+			{"unknown setting in file", []string{"-config", writeFile(t, "limt: 7\n")}, nil, "field limt not found"},
+			{"bad duration in file", []string{"-config", writeFile(t, "window: soon\n")}, nil, "line 1"},
+			{"missing file", []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, nil, "reading config file"},
+			{"bad environment variable", nil, map[string]string{"IP_WINDOW": "20"}, "invalid IP_WINDOW"},
+			{"bad flag", []string{"-max-keys", "many"}, nil, "invalid -max-keys"},
+			{"bad boolean", nil, map[string]string{"TRUST_COST_HEADER": "maybe"}, "invalid TRUST_COST_HEADER"},
+		} {
+			_, err := Load(tt.args, env(tt.env))
+			if assert.Error(t, err, tt.name) {
+				assert.Contains(t, err.Error(), tt.err, tt.name)
+			}
+		}
+	})
+}
+
+func TestConfig_Validate(t *testing.T) {
+	t.Run("should list every invalid setting", func(t *testing.T) {
+		config := Default()
+		config.Limit = 0
+		config.Window = 0
+		config.Algorithm = "leaky_bucket"
+		config.Windows = "10/0s,0/month"
+		config.QuotaTimezone = "Mars/Olympus_Mons"
+		config.PenaltyViolations = 3
+		config.SnapshotInterval = Duration(-time.Second)
+		config.GlobalMaxInFlight = 10
+		config.RouteCosts = "/export=10,search=5"
+		err := config.Validate()
+		if assert.Error(t, err) {
+			for _, problem := range []string{
+				"limit must be positive, got 0",
+				"window must be positive, got 0s",
+				`algorithm must be sliding_window, token_bucket or gcra, got "leaky_bucket"`,
+				"windows: window size must be positive, got 0s",
+				"windows: rate must be positive, got 0",
+				"quota_timezone: ",
+				"penalty_window must be positive",
+				"penalty_ban must be positive",
+				"snapshot_interval must not be negative, got -1s",
+				"global_max_in_flight requires max_in_flight",
+				`route_costs: path "search" must start with /`,
+			} {
+				assert.Contains(t, err.Error(), problem)
+			}
+		}
+	})
+	t.Run("should only allow the write-ahead log with the sliding window", func(t *testing.T) {
+		config := Default()
+		config.Persistence = PersistenceWAL
+		assert.NoError(t, config.Validate())
+		config.Algorithm = "gcra"
+		config.WALCompactionThreshold = 0
+		err := config.Validate()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), `persistence wal is only supported by algorithm sliding_window, got "gcra"`)
+			assert.Contains(t, err.Error(), "wal_compaction_threshold must be positive, got 0")
+		}
+		config.Persistence = "sqlite"
+		assert.EqualError(t, config.Validate(), "invalid config:\n\tpersistence must be json or wal, got \"sqlite\"")
+	})
+	t.Run("should only allow the approximate counter and max keys with the sliding window", func(t *testing.T) {
+		config := Default()
+		config.CounterMode = string(limiter.ApproximateCounter)
+		config.MaxKeys = 100
+		assert.NoError(t, config.Validate())
+		config.Algorithm = string(limiter.TokenBucket)
+		err := config.Validate()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), `counter_mode approximate is only supported by algorithm sliding_window, got "token_bucket"`)
+			assert.Contains(t, err.Error(), `max_keys is only supported by algorithm sliding_window, got "token_bucket"`)
+		}
+	})
+	t.Run("should not require a global window when the global limit is disabled", func(t *testing.T) {
+		config := Default()
+		config.GlobalWindow = 0
+		assert.NoError(t, config.Validate())
+		config.GlobalLimit = 10
+		assert.Error(t, config.Validate())
+	})
+}
+
+func TestConfig_ParsedRouteCosts(t *testing.T) {
+	t.Run("should parse the cost of each path", func(t *testing.T) {
+		config := Default()
+		config.RouteCosts = "/export=10, /search = 5"
+		costs, err := config.ParsedRouteCosts()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"/export": 10, "/search": 5}, costs)
+	})
+	t.Run("should return error on invalid route costs", func(t *testing.T) {
+		for _, routeCosts := range []string{"/export", "/export=0", "/export=many", "export=10", "/export=10,/export=5"} {
+			config := Default()
+			config.RouteCosts = routeCosts
+			_, err := config.ParsedRouteCosts()
+			assert.Error(t, err, routeCosts)
+		}
+	})
+}
+
+func TestConfig_Changed(t *testing.T) {
+	t.Run("should return the names of the settings which differ", func(t *testing.T) {
+		config := Default()
+		assert.Empty(t, config.Changed(Default()))
+		other := Default()
+		other.Limit = 100
+		other.Resolution = Duration(time.Millisecond)
+		other.AdminToken = "secret"
+		assert.Equal(t, []string{"limit", "resolution", "admin_token"}, config.Changed(other))
+	})
+}
+
+func TestConfig_String(t *testing.T) {
+	t.Run("should print the config as YAML with the admin token redacted", func(t *testing.T) {
+		config := Default()
+		config.AdminToken = "secret"
+		out := config.String()
+		assert.Contains(t, out, "window: 20s\n")
+		assert.Contains(t, out, "admin_token: <redacted>\n")
+		assert.NotContains(t, out, "secret")
+		assert.Equal(t, "secret", config.AdminToken)
+	})
+}
@@ -0,0 +1,56 @@
+// Package ipkey normalizes IP address keys so that a network can be rate limited as a single key.
+package ipkey
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Normalizer turns IP addresses into the key of the network they are in.
+// The zero Normalizer keeps each address as its own key, in canonical form.
+type Normalizer struct {
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+	// ipv4Suffix and ipv6Suffix are the prefix lengths appended to keys of networks, empty for full length prefixes
+	ipv4Suffix string
+	ipv6Suffix string
+}
+
+// NewNormalizer returns a Normalizer keying IPv4 addresses by their ipv4Prefix bits long network and IPv6 addresses
+// by their ipv6Prefix bits long network, like 24 and 64. A prefix of 0 keeps each address as its own key.
+func NewNormalizer(ipv4Prefix, ipv6Prefix int) (Normalizer, error) {
+	if ipv4Prefix < 0 || ipv4Prefix > 8*net.IPv4len {
+		return Normalizer{}, fmt.Errorf("IPv4 prefix length %d out of range", ipv4Prefix)
+	}
+	if ipv6Prefix < 0 || ipv6Prefix > 8*net.IPv6len {
+		return Normalizer{}, fmt.Errorf("IPv6 prefix length %d out of range", ipv6Prefix)
+	}
+	var n Normalizer
+	if ipv4Prefix > 0 && ipv4Prefix < 8*net.IPv4len {
+		n.ipv4Mask, n.ipv4Suffix = net.CIDRMask(ipv4Prefix, 8*net.IPv4len), "/"+strconv.Itoa(ipv4Prefix)
+	}
+	if ipv6Prefix > 0 && ipv6Prefix < 8*net.IPv6len {
+		n.ipv6Mask, n.ipv6Suffix = net.CIDRMask(ipv6Prefix, 8*net.IPv6len), "/"+strconv.Itoa(ipv6Prefix)
+	}
+	return n, nil
+}
+
+// Key returns the key of the network of ipAddr, like 203.0.113.0/24 or 2001:db8:1:2::/64,
+// or the address itself in canonical form when its prefix is full length. Keys which are not IP addresses are returned as is.
+func (n Normalizer) Key(ipAddr string) string {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return ipAddr
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		if n.ipv4Mask == nil {
+			return ipv4.String()
+		}
+		return ipv4.Mask(n.ipv4Mask).String() + n.ipv4Suffix
+	}
+	if n.ipv6Mask == nil {
+		return ip.String()
+	}
+	return ip.Mask(n.ipv6Mask).String() + n.ipv6Suffix
+}
@@ -0,0 +1,43 @@
+package ipkey
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNormalizer(t *testing.T) {
+	t.Run("should return error on out of range prefix lengths", func(t *testing.T) {
+		_, err := NewNormalizer(33, 64)
+		assert.Error(t, err)
+		_, err = NewNormalizer(24, 129)
+		assert.Error(t, err)
+		_, err = NewNormalizer(-1, 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestNormalizer_Key(t *testing.T) {
+	networks, err := NewNormalizer(24, 64)
+	assert.NoError(t, err)
+	full, err := NewNormalizer(32, 128)
+	assert.NoError(t, err)
+	tests := []struct {
+		name       string
+		normalizer Normalizer
+		ipAddr     string
+		expected   string
+	}{
+		{name: "should key IPv4 addresses by network", normalizer: networks, ipAddr: "203.0.113.77", expected: "203.0.113.0/24"},
+		{name: "should key IPv4 mapped IPv6 addresses as IPv4", normalizer: networks, ipAddr: "::ffff:203.0.113.77", expected: "203.0.113.0/24"},
+		{name: "should key IPv6 addresses by network", normalizer: networks, ipAddr: "2001:DB8:1:2:aaaa:bbbb:cccc:dddd", expected: "2001:db8:1:2::/64"},
+		{name: "should keep keys which are not IP addresses", normalizer: networks, ipAddr: "client-42", expected: "client-42"},
+		{name: "should keep full length prefixes as canonical addresses", normalizer: full, ipAddr: "2001:DB8:0:0::1", expected: "2001:db8::1"},
+		{name: "should keep addresses with the zero normalizer", normalizer: Normalizer{}, ipAddr: "10.0.0.1", expected: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.normalizer.Key(tt.ipAddr))
+		})
+	}
+}
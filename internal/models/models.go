@@ -1,8 +1,87 @@
 package models
 
+import "time"
+
 // Entry is each entry in the window
-// Entry represents epoch timestamp and number of hits received in that second
+// Entry represents the start of a bucket and number of hits received in that bucket
+// EpochTimestamp is the second the bucket starts in, Nanos is the offset of the bucket start within that second,
+// so buckets of a second or more have no Nanos and entries persisted before sub-second buckets load unchanged.
 type Entry struct {
 	EpochTimestamp int64 `json:"epoch_timestamp"`
+	Nanos          int64 `json:"nanos,omitempty"`
 	Hits           int64 `json:"hits"`
 }
+
+// NewEntry returns an entry for the bucket starting at bucketStart with hits.
+func NewEntry(bucketStart time.Time, hits int64) Entry {
+	return Entry{
+		EpochTimestamp: bucketStart.Unix(),
+		Nanos:          int64(bucketStart.Nanosecond()),
+		Hits:           hits,
+	}
+}
+
+// UnixNano returns the bucket start of the entry as nanoseconds since epoch.
+func (e Entry) UnixNano() int64 {
+	return e.EpochTimestamp*int64(time.Second) + e.Nanos
+}
+
+// RejectReason tells which limit caused a request to be rate limited.
+type RejectReason string
+
+const (
+	// RejectReasonNone is the reason for requests which are not rate limited.
+	RejectReasonNone RejectReason = ""
+	// RejectReasonGlobal is the reason for requests rate limited by the global limit.
+	RejectReasonGlobal RejectReason = "global"
+	// RejectReasonIP is the reason for requests rate limited by the per IP limit.
+	RejectReasonIP RejectReason = "ip"
+	// RejectReasonDenied is the reason for requests from keys which are always rejected.
+	RejectReasonDenied RejectReason = "denied"
+	// RejectReasonBanned is the reason for requests from keys banned after repeated rejections.
+	RejectReasonBanned RejectReason = "banned"
+	// RejectReasonConcurrency is the reason for requests rejected by the in-flight limit of their key.
+	RejectReasonConcurrency RejectReason = "concurrency"
+	// RejectReasonGlobalConcurrency is the reason for requests rejected by the global in-flight limit.
+	RejectReasonGlobalConcurrency RejectReason = "global_concurrency"
+)
+
+// Decision is the outcome of a rate limiter check for a request.
+// Limit, Remaining, ResetAt and RetryAfter describe the limit the request is rejected by,
+// or the most restrictive limit for allowed requests.
+type Decision struct {
+	// Allowed is true when the request is not rate limited.
+	Allowed bool
+	// Reason is the limit the request is rate limited by.
+	Reason RejectReason
+	// Rule is the override matching the key of the request, like 10.0.0.0/8, empty when the default limit applies.
+	Rule string
+	// GlobalHits is the number of hits counted against the global limit.
+	GlobalHits int64
+	// IPHits is the number of hits counted against the IP limit.
+	IPHits int64
+	// InFlight and GlobalInFlight are the requests of the key and of all keys in flight, for concurrency limiters.
+	InFlight       int64
+	GlobalInFlight int64
+	// Limit is the number of hits allowed by the limit.
+	Limit int64
+	// Window is the size of the sliding window of the limit, 0 for limiters without windows and for calendar quotas.
+	Window time.Duration
+	// Remaining is the number of hits left before the limit is reached.
+	Remaining int64
+	// ResetAt is the time the limit frees up, for sliding windows it is the time the oldest hit slides out of the window,
+	// for token buckets and GCRA it is the time the limit is fully replenished.
+	ResetAt time.Time
+	// RetryAfter is how long to wait before the request would be allowed, 0 for allowed requests.
+	RetryAfter time.Duration
+}
+
+// Ban is a key banned after repeated rejections.
+type Ban struct {
+	// Key is the banned key, an IP address or the network it is keyed by.
+	Key string `json:"key"`
+	// Until is the time the ban ends.
+	Until time.Time `json:"until"`
+	// Offences is the number of times the key was banned, each ban is twice as long as the one before.
+	Offences int64 `json:"offences"`
+}
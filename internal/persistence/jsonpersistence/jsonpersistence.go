@@ -1,10 +1,11 @@
 package jsonpersistence
 
 import (
-	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
 )
@@ -12,11 +13,16 @@ import (
 const (
 	DumpFileEnv             = "DUMP_FILE"
 	DefaultDumpFileLocation = "./dump.json"
+	// PreviousSuffix is appended to the dump file location for the previous dump, which is loaded when the dump file is corrupt
+	// or missing.
+	PreviousSuffix = ".prev"
 )
 
-// JSONPersistence persists the entries to a json file, mentioned in DumpFileEnv location
+// JSONPersistence persists the entries to a json file, mentioned in DumpFileEnv location.
+// A dump is written to a temporary file next to it and renamed over it once synced, so the file always holds a complete dump,
+// and the dump it replaces is kept as the previous dump.
 type JSONPersistence struct {
-	file *os.File
+	path string
 }
 
 // NewPersistence creates and returns a new JSONPersistence store.
@@ -25,41 +31,131 @@ func NewPersistence() (*JSONPersistence, error) {
 	if dumpFile == "" {
 		dumpFile = DefaultDumpFileLocation
 	}
-	file, err := os.OpenFile(dumpFile, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	return NewFilePersistence(dumpFile)
+}
+
+// NewFilePersistence creates and returns a new JSONPersistence store of dumpFile, which is created if it does not exist
+// so that a location which cannot be written fails at startup rather than on the first dump.
+// It is left missing when a dump was interrupted between its renames, so that Load loads the previous dump.
+func NewFilePersistence(dumpFile string) (*JSONPersistence, error) {
+	if _, err := os.Stat(dumpFile); os.IsNotExist(err) && interrupted(dumpFile) {
+		return &JSONPersistence{
+			path: dumpFile,
+		}, nil
+	}
+	file, err := os.OpenFile(dumpFile, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
 	return &JSONPersistence{
-		file: file,
+		path: dumpFile,
 	}, nil
 }
 
-// Dump dumps the counters to json file
+// Dump dumps the counters to json file.
+// The dump is written to a temporary file in the directory of the dump file, synced and renamed over the dump file,
+// the dump it replaces is renamed to the previous dump first. The dump file is left untouched when writing fails.
 func (p *JSONPersistence) Dump(counters map[string][]models.Entry) error {
-	defer p.file.Close()
-	err := p.file.Truncate(0)
+	countersJSON, err := json.Marshal(&counters)
 	if err != nil {
-		log.Println("error while truncating file", err)
+		return err
 	}
-	countersJSON, err := json.Marshal(&counters)
+	dir := filepath.Dir(p.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(p.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := writeSynced(tmp, countersJSON); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if info, err := os.Stat(p.path); err == nil && info.Size() > 0 {
+		if err := os.Rename(p.path, p.path+PreviousSuffix); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeSynced writes data to file, syncs it to disk and closes it
+func writeSynced(file *os.File, data []byte) error {
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir syncs the directory dir so that the renames in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
-	_, err = p.file.Write(countersJSON)
-	return err
+	defer d.Close()
+	return d.Sync()
 }
 
-// Load loads the entries from persisted file
+// Load loads the entries from persisted file.
+// An empty dump file loads no entries. When the dump file is corrupt, or missing because a dump was interrupted
+// between its renames, the previous dump is loaded instead if it can be, otherwise a missing dump file loads no entries
+// and a corrupt one returns its error.
 func (p *JSONPersistence) Load() (map[string][]models.Entry, error) {
-	buf := new(bytes.Buffer)
-	n, err := buf.ReadFrom(p.file)
+	counters, err := load(p.path)
+	if err == nil && counters != nil {
+		return counters, nil
+	}
+	if err == nil && !interrupted(p.path) {
+		return map[string][]models.Entry{}, nil
+	}
+	previous, previousErr := load(p.path + PreviousSuffix)
+	if previousErr == nil && previous != nil {
+		log.Printf("loading dump file %s failed, loaded previous dump %s", p.path, p.path+PreviousSuffix)
+		return previous, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if n == 0 {
+	return map[string][]models.Entry{}, nil
+}
+
+// interrupted reports whether a dump of the dump file at path was interrupted between renaming the dump file
+// to the previous dump and renaming the new dump over it, which leaves the new dump in its temporary file
+func interrupted(path string) bool {
+	temporary, err := filepath.Glob(path + ".tmp-*")
+	return err == nil && len(temporary) > 0
+}
+
+// load returns the entries of the dump file at path, nil when it is missing
+func load(path string) (map[string][]models.Entry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
 		return map[string][]models.Entry{}, nil
 	}
 	var counters map[string][]models.Entry
-	err = json.Unmarshal(buf.Bytes(), &counters)
-	return counters, err
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return nil, fmt.Errorf("dump file %s: %s", path, err.Error())
+	}
+	if counters == nil {
+		counters = map[string][]models.Entry{}
+	}
+	return counters, nil
 }
@@ -3,6 +3,7 @@ package jsonpersistence
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
@@ -14,18 +15,20 @@ func TestNewPersistence(t *testing.T) {
 		os.Setenv(DumpFileEnv, "./../../../testdata/dump-0.json")
 		jsonPersistence, err := NewPersistence()
 		assert.NoError(t, err)
-		assert.NotNil(t, jsonPersistence.file)
-		jsonPersistence.file.Close()
+		assert.Equal(t, "./../../../testdata/dump-0.json", jsonPersistence.path)
 	})
 	t.Run("should return persistence with opened file from default dump file file location", func(t *testing.T) {
 		os.Setenv(DumpFileEnv, "")
 		jsonPersistence, err := NewPersistence()
 		assert.NoError(t, err)
-		fileInfo, err := jsonPersistence.file.Stat()
+		assert.Equal(t, DefaultDumpFileLocation, jsonPersistence.path)
+		_, err = os.Stat(DefaultDumpFileLocation)
 		assert.NoError(t, err)
-		assert.Equal(t, DefaultDumpFileLocation, "./"+fileInfo.Name())
-		jsonPersistence.file.Close()
-		os.Remove(fileInfo.Name())
+		os.Remove(DefaultDumpFileLocation)
+	})
+	t.Run("should return error when the dump file cannot be created", func(t *testing.T) {
+		_, err := NewFilePersistence(filepath.Join(t.TempDir(), "missing", "dump.json"))
+		assert.Error(t, err)
 	})
 }
 
@@ -60,20 +63,70 @@ func TestJSONPersistence_Load(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Empty(t, entries)
 	})
-	t.Run("should return error if file is closed", func(t *testing.T) {
-		os.Setenv(DumpFileEnv, "./../../../testdata/dump-2.json")
-		jsonPersistence, err := NewPersistence()
-		assert.NoError(t, err)
-		jsonPersistence.file.Close()
+	t.Run("should return error if file cannot be read", func(t *testing.T) {
+		jsonPersistence := &JSONPersistence{path: t.TempDir()}
 		entries, err := jsonPersistence.Load()
 		assert.Error(t, err)
 		assert.Empty(t, entries)
 	})
+	t.Run("should load the previous dump when the dump file is corrupt or missing", func(t *testing.T) {
+		previous := `{"10.0.0.1":[{"epoch_timestamp":1623591925,"hits":3}]}`
+		for name, dump := range map[string]*string{"corrupt": stringPtr(`{"10.0.0.1":[{"epoch_ti`), "missing": nil} {
+			dumpFileLocation := filepath.Join(t.TempDir(), "dump.json")
+			if dump != nil {
+				assert.NoError(t, ioutil.WriteFile(dumpFileLocation, []byte(*dump), 0644), name)
+			} else {
+				// a dump interrupted between its renames
+				assert.NoError(t, ioutil.WriteFile(dumpFileLocation+".tmp-1", []byte(`{}`), 0644), name)
+			}
+			assert.NoError(t, ioutil.WriteFile(dumpFileLocation+PreviousSuffix, []byte(previous), 0644), name)
+			entries, err := (&JSONPersistence{path: dumpFileLocation}).Load()
+			assert.NoError(t, err, name)
+			assert.Equal(t, map[string][]models.Entry{"10.0.0.1": {{EpochTimestamp: 1623591925, Hits: 3}}}, entries, name)
+		}
+	})
+	t.Run("should load no entries when the dump file was deleted", func(t *testing.T) {
+		dumpFileLocation := filepath.Join(t.TempDir(), "dump.json")
+		assert.NoError(t, ioutil.WriteFile(dumpFileLocation+PreviousSuffix, []byte(`{"10.0.0.1":[{"epoch_timestamp":1623591925,"hits":3}]}`), 0644))
+		jsonPersistence, err := NewFilePersistence(dumpFileLocation)
+		assert.NoError(t, err)
+		info, err := os.Stat(dumpFileLocation)
+		if assert.NoError(t, err) {
+			assert.Zero(t, info.Size())
+		}
+		entries, err := jsonPersistence.Load()
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+	t.Run("should load the previous dump when a dump was interrupted between its renames", func(t *testing.T) {
+		dumpFileLocation := filepath.Join(t.TempDir(), "dump.json")
+		assert.NoError(t, ioutil.WriteFile(dumpFileLocation+PreviousSuffix, []byte(`{"10.0.0.1":[{"epoch_timestamp":1623591925,"hits":3}]}`), 0644))
+		assert.NoError(t, ioutil.WriteFile(dumpFileLocation+".tmp-1", []byte(`{"10.0.0.1":[{"epoch_timestamp":1623591926,"hits":4}]}`), 0644))
+		jsonPersistence, err := NewFilePersistence(dumpFileLocation)
+		assert.NoError(t, err)
+		entries, err := jsonPersistence.Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{"10.0.0.1": {{EpochTimestamp: 1623591925, Hits: 3}}}, entries)
+	})
+	t.Run("should return the error of the dump file when the previous dump is corrupt too", func(t *testing.T) {
+		dumpFileLocation := filepath.Join(t.TempDir(), "dump.json")
+		assert.NoError(t, ioutil.WriteFile(dumpFileLocation, []byte(`{"GLOBAL":`), 0644))
+		assert.NoError(t, ioutil.WriteFile(dumpFileLocation+PreviousSuffix, []byte(`[`), 0644))
+		entries, err := (&JSONPersistence{path: dumpFileLocation}).Load()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), dumpFileLocation+":")
+		}
+		assert.Empty(t, entries)
+	})
+}
+
+func stringPtr(s string) *string {
+	return &s
 }
 
 func TestJSONPersistence_Dump(t *testing.T) {
 	t.Run("should dump entries successfully", func(t *testing.T) {
-		dumpFileLocation := "./../../../testdata/dump-3.json"
+		dumpFileLocation := filepath.Join(t.TempDir(), "dump-3.json")
 		os.Setenv(DumpFileEnv, dumpFileLocation)
 		jsonPersistence, err := NewPersistence()
 		assert.NoError(t, err)
@@ -102,28 +155,51 @@ func TestJSONPersistence_Dump(t *testing.T) {
 		expectedFileOut := `{"GLOBAL":[{"epoch_timestamp":1623591925,"hits":1},{"epoch_timestamp":1623591927,"hits":1},{"epoch_timestamp":1623591928,"hits":1},{"epoch_timestamp":1623591946,"hits":1},{"epoch_timestamp":1623591947,"hits":1},{"epoch_timestamp":1623591948,"hits":2},{"epoch_timestamp":1623591949,"hits":1},{"epoch_timestamp":1623591950,"hits":2},{"epoch_timestamp":1623591951,"hits":1},{"epoch_timestamp":1623591952,"hits":2},{"epoch_timestamp":1623591953,"hits":1},{"epoch_timestamp":1623591954,"hits":1},{"epoch_timestamp":1623591969,"hits":1}]}`
 		assert.Equal(t, expectedFileOut, string(data))
 	})
-	t.Run("should return error when truncate file fails", func(t *testing.T) {
-		dumpFileLocation := "./../../../testdata/dump-3.json"
+	t.Run("should dump sub-second entries with nanos and load them back", func(t *testing.T) {
+		dumpFileLocation := filepath.Join(t.TempDir(), "dump-3.json")
 		os.Setenv(DumpFileEnv, dumpFileLocation)
 		jsonPersistence, err := NewPersistence()
 		assert.NoError(t, err)
 		entries := map[string][]models.Entry{"GLOBAL": {
 			{EpochTimestamp: 1623591925, Hits: 1},
-			{EpochTimestamp: 1623591927, Hits: 1},
-			{EpochTimestamp: 1623591928, Hits: 1},
-			{EpochTimestamp: 1623591946, Hits: 1},
-			{EpochTimestamp: 1623591947, Hits: 1},
-			{EpochTimestamp: 1623591948, Hits: 2},
-			{EpochTimestamp: 1623591949, Hits: 1},
-			{EpochTimestamp: 1623591950, Hits: 2},
-			{EpochTimestamp: 1623591951, Hits: 1},
-			{EpochTimestamp: 1623591952, Hits: 2},
-			{EpochTimestamp: 1623591953, Hits: 1},
-			{EpochTimestamp: 1623591954, Hits: 1},
-			{EpochTimestamp: 1623591969, Hits: 1},
+			{EpochTimestamp: 1623591925, Nanos: 500000000, Hits: 2},
 		}}
-		jsonPersistence.file.Close()
 		err = jsonPersistence.Dump(entries)
+		assert.NoError(t, err)
+		dumpedFile, err := os.Open(dumpFileLocation)
+		assert.NoError(t, err)
+		defer dumpedFile.Close()
+		data, err := ioutil.ReadAll(dumpedFile)
+		assert.NoError(t, err)
+		expectedFileOut := `{"GLOBAL":[{"epoch_timestamp":1623591925,"hits":1},{"epoch_timestamp":1623591925,"nanos":500000000,"hits":2}]}`
+		assert.Equal(t, expectedFileOut, string(data))
+		jsonPersistence, err = NewPersistence()
+		assert.NoError(t, err)
+		loadedEntries, err := jsonPersistence.Load()
+		assert.NoError(t, err)
+		assert.Equal(t, entries, loadedEntries)
+	})
+	t.Run("should keep the previous dump and leave no temporary file", func(t *testing.T) {
+		dir := t.TempDir()
+		jsonPersistence, err := NewFilePersistence(filepath.Join(dir, "dump.json"))
+		assert.NoError(t, err)
+		first := map[string][]models.Entry{"10.0.0.1": {{EpochTimestamp: 1623591925, Hits: 1}}}
+		second := map[string][]models.Entry{"10.0.0.2": {{EpochTimestamp: 1623591926, Hits: 2}}}
+		assert.NoError(t, jsonPersistence.Dump(first))
+		assert.NoError(t, jsonPersistence.Dump(second))
+		loaded, err := jsonPersistence.Load()
+		assert.NoError(t, err)
+		assert.Equal(t, second, loaded)
+		previous, err := ioutil.ReadFile(filepath.Join(dir, "dump.json"+PreviousSuffix))
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"10.0.0.1":[{"epoch_timestamp":1623591925,"hits":1}]}`, string(previous))
+		files, err := ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, files, 2)
+	})
+	t.Run("should return error when the temporary file cannot be created", func(t *testing.T) {
+		jsonPersistence := &JSONPersistence{path: filepath.Join(t.TempDir(), "missing", "dump.json")}
+		err := jsonPersistence.Dump(map[string][]models.Entry{"GLOBAL": {{EpochTimestamp: 1623591925, Hits: 1}}})
 		assert.Error(t, err)
 	})
 }
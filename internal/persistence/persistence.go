@@ -1,10 +1,27 @@
 package persistence
 
 //go:generate mockgen -source=persistence.go -destination=./persistence_mock/persistence_mock.go -package=persistence_mock Persistence
-import "github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+import (
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+)
 
 // Persistence persists the entries, it also can load entries from persistence
 type Persistence interface {
 	Dump(counters map[string][]models.Entry) error
 	Load() (map[string][]models.Entry, error)
 }
+
+// Journal is a Persistence which also records the hits as they are counted, so that Load returns the hits since the last Dump too.
+// Append records an entry of hits of key, it is called with the lock of a shard held and should not wait for the disk. Rotate is called with the hits blocked right before the state passed to the next Dump
+// is copied, the entries appended after it are not part of that state. Forget records that the entries of key recorded so far
+// are dropped, like when the key is evicted. SetRetention sets how long an entry is needed after its time, older entries
+// may be dropped, 0 keeps every entry.
+type Journal interface {
+	Persistence
+	Append(key string, entry models.Entry) error
+	Rotate() error
+	Forget(key string) error
+	SetRetention(retention time.Duration)
+}
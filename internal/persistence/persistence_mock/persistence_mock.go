@@ -6,6 +6,8 @@ package persistence_mock
 
 import (
 	reflect "reflect"
+	time "time"
+
 	models "github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
 
 	gomock "github.com/golang/mock/gomock"
@@ -62,3 +64,109 @@ func (mr *MockPersistenceMockRecorder) Load() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Load", reflect.TypeOf((*MockPersistence)(nil).Load))
 }
+
+// MockJournal is a mock of Journal interface.
+type MockJournal struct {
+	ctrl     *gomock.Controller
+	recorder *MockJournalMockRecorder
+}
+
+// MockJournalMockRecorder is the mock recorder for MockJournal.
+type MockJournalMockRecorder struct {
+	mock *MockJournal
+}
+
+// NewMockJournal creates a new mock instance.
+func NewMockJournal(ctrl *gomock.Controller) *MockJournal {
+	mock := &MockJournal{ctrl: ctrl}
+	mock.recorder = &MockJournalMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockJournal) EXPECT() *MockJournalMockRecorder {
+	return m.recorder
+}
+
+// Append mocks base method.
+func (m *MockJournal) Append(key string, entry models.Entry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Append", key, entry)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Append indicates an expected call of Append.
+func (mr *MockJournalMockRecorder) Append(key, entry interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Append", reflect.TypeOf((*MockJournal)(nil).Append), key, entry)
+}
+
+// Dump mocks base method.
+func (m *MockJournal) Dump(counters map[string][]models.Entry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Dump", counters)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Dump indicates an expected call of Dump.
+func (mr *MockJournalMockRecorder) Dump(counters interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dump", reflect.TypeOf((*MockJournal)(nil).Dump), counters)
+}
+
+// Forget mocks base method.
+func (m *MockJournal) Forget(key string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Forget", key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Forget indicates an expected call of Forget.
+func (mr *MockJournalMockRecorder) Forget(key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Forget", reflect.TypeOf((*MockJournal)(nil).Forget), key)
+}
+
+// Load mocks base method.
+func (m *MockJournal) Load() (map[string][]models.Entry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Load")
+	ret0, _ := ret[0].(map[string][]models.Entry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Load indicates an expected call of Load.
+func (mr *MockJournalMockRecorder) Load() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Load", reflect.TypeOf((*MockJournal)(nil).Load))
+}
+
+// Rotate mocks base method.
+func (m *MockJournal) Rotate() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rotate")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Rotate indicates an expected call of Rotate.
+func (mr *MockJournalMockRecorder) Rotate() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rotate", reflect.TypeOf((*MockJournal)(nil).Rotate))
+}
+
+// SetRetention mocks base method.
+func (m *MockJournal) SetRetention(retention time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetRetention", retention)
+}
+
+// SetRetention indicates an expected call of SetRetention.
+func (mr *MockJournalMockRecorder) SetRetention(retention interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRetention", reflect.TypeOf((*MockJournal)(nil).SetRetention), retention)
+}
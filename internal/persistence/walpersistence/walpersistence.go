@@ -0,0 +1,592 @@
+// Package walpersistence persists the entries as a snapshot and a write-ahead log of the hits recorded since,
+// so that a crash loses no more than the hits which were not yet written to the log, those appended in the last FlushInterval.
+package walpersistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/jsonpersistence"
+)
+
+const (
+	// FlushInterval is how often the records appended are written to the log by the background writer,
+	// a crash loses the records appended since the last write.
+	FlushInterval = 10 * time.Millisecond
+	// DefaultCompactionThreshold is the size of a log segment after which the log is compacted into the snapshot.
+	DefaultCompactionThreshold = 16 << 20
+	// SegmentKey is the key of the snapshot holding the last log segment the snapshot includes, in the hits of its entry.
+	SegmentKey = "WAL_SEGMENT"
+	// SegmentSuffix is appended to the snapshot location, followed by the sequence number, for the log segments.
+	SegmentSuffix = ".wal."
+
+	// headerSize is the size of the length and the checksum preceding the payload of a record
+	headerSize = 8
+	// maxRecordSize bounds the payload of a record, a longer length is a corrupt header
+	maxRecordSize = 1 << 16
+	// flushSize is the size of the buffered records which wakes the writer before FlushInterval
+	flushSize = 64 << 10
+)
+
+// ErrClosed is returned when appending to a closed WALPersistence.
+var ErrClosed = errors.New("write-ahead log is closed")
+
+// WALPersistence persists the entries to a json snapshot and appends every entry recorded after it to a log of segments.
+// Load returns the snapshot with the entries of the segments it does not include.
+// A record of the log is the length and the CRC-32 of its payload, followed by the payload: the varint encoded
+// bucket start in nanoseconds and hits of the entry, then its key. Replaying a segment stops at its first incomplete
+// or corrupt record, which is what a crash while appending leaves behind. A record without hits, appended by Forget,
+// drops the entries of its key before it.
+// Once a segment grows beyond the compaction threshold, the log is rotated and compacted into a new snapshot in the background,
+// dropping the entries older than the retention.
+// Rotating only opens the next segment, the segments rotated out are synced and closed by Dump and the compaction.
+// Append only buffers the record, a writer in the background writes the buffer to the segment every FlushInterval,
+// or sooner once it grows beyond flushSize, so appending never waits for the disk. Rotate, Dump, Load and Close
+// write the buffer first.
+type WALPersistence struct {
+	snapshot  *jsonpersistence.JSONPersistence
+	path      string
+	threshold int64
+	clock     clock.Clock
+	// retention is the time.Duration set by SetRetention, accessed atomically
+	retention int64
+
+	// bufferMu guards the records appended and not yet written, the error of the last failed write
+	// not yet returned by Append and closed. It is only held to copy a record or swap the buffer.
+	bufferMu sync.Mutex
+	buffer   []byte
+	err      error
+	closed   bool
+	// wake wakes the writer once the buffer grows beyond flushSize, done stops it
+	wake   chan struct{}
+	done   chan struct{}
+	writer sync.WaitGroup
+
+	// mu guards the segment being appended to and its sequence number and size, spare,
+	// closing, covered and compacting
+	mu      sync.Mutex
+	segment *os.File
+	seq     uint64
+	size    int64
+	// spare is the buffer written last, reused for the next records
+	spare []byte
+	// closing holds the segments rotated out which are not yet synced and closed
+	closing []*os.File
+	// covered is the last segment included in the state passed to the next Dump, set by Rotate
+	covered    uint64
+	compacting bool
+	compaction sync.WaitGroup
+
+	// writeMu orders the writes of the snapshot and guards watermark,
+	// the last segment included in the snapshot
+	writeMu   sync.Mutex
+	watermark uint64
+}
+
+// NewWALPersistence returns a WALPersistence with its snapshot at path and its log segments next to it,
+// compacting the log once a segment grows beyond compactionThreshold bytes, DefaultCompactionThreshold when it is not positive.
+// Appends go to a new segment, the segments left by a previous process are replayed by Load until they are compacted.
+func NewWALPersistence(path string, compactionThreshold int64) (*WALPersistence, error) {
+	if compactionThreshold <= 0 {
+		compactionThreshold = DefaultCompactionThreshold
+	}
+	snapshot, err := jsonpersistence.NewFilePersistence(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &WALPersistence{
+		snapshot:  snapshot,
+		path:      path,
+		threshold: compactionThreshold,
+		clock:     clock.RealClock{},
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if _, p.watermark, err = p.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	segments, err := p.segments()
+	if err != nil {
+		return nil, err
+	}
+	p.seq = p.watermark
+	if len(segments) > 0 && segments[len(segments)-1] > p.seq {
+		p.seq = segments[len(segments)-1]
+	}
+	if err := p.open(p.seq + 1); err != nil {
+		return nil, err
+	}
+	p.writer.Add(1)
+	go p.run()
+	return p, nil
+}
+
+// Append buffers entry of key to be written to the log by the background writer.
+// It returns the error of a write of the log which failed since the previous Append, the entry is buffered anyway.
+func (p *WALPersistence) Append(key string, entry models.Entry) error {
+	record := encode(key, entry)
+	p.bufferMu.Lock()
+	if p.closed {
+		p.bufferMu.Unlock()
+		return ErrClosed
+	}
+	p.buffer = append(p.buffer, record...)
+	full := len(p.buffer) >= flushSize
+	err := p.err
+	p.err = nil
+	p.bufferMu.Unlock()
+	if full {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// Forget appends a record dropping the entries of key appended before it.
+func (p *WALPersistence) Forget(key string) error {
+	return p.Append(key, models.Entry{})
+}
+
+// SetRetention sets how long an entry is kept after its bucket start, the compaction drops older entries.
+// A retention of 0 keeps every entry.
+func (p *WALPersistence) SetRetention(retention time.Duration) {
+	atomic.StoreInt64(&p.retention, int64(retention))
+}
+
+// Rotate starts a new segment, the state passed to the next Dump includes every segment before it.
+func (p *WALPersistence) Rotate() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.segment == nil {
+		return ErrClosed
+	}
+	if err := p.rotate(); err != nil {
+		return err
+	}
+	p.covered = p.seq - 1
+	return nil
+}
+
+// Dump writes counters as the snapshot, the segments it includes are deleted once no snapshot on disk needs them.
+// counters should be copied right after Rotate with the hits blocked, otherwise the log is rotated now
+// and the hits appended between copying counters and Dump are lost.
+func (p *WALPersistence) Dump(counters map[string][]models.Entry) error {
+	p.mu.Lock()
+	covered := p.covered
+	p.covered = 0
+	switch {
+	case covered > 0:
+	case p.segment == nil:
+		// closed, the last segment is complete
+		covered = p.seq
+	default:
+		if err := p.rotate(); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		covered = p.seq - 1
+	}
+	p.mu.Unlock()
+	if err := p.release(); err != nil {
+		return err
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.write(counters, covered)
+}
+
+// Load returns the entries of the snapshot with the entries of the segments it does not include,
+// the entries appended before it included.
+func (p *WALPersistence) Load() (map[string][]models.Entry, error) {
+	p.flush()
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	counters, watermark, err := p.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	segments, err := p.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range segments {
+		if seq <= watermark {
+			continue
+		}
+		if err := p.replay(seq, counters); err != nil {
+			return nil, err
+		}
+	}
+	return merge(counters), nil
+}
+
+// Close stops the writer, writes the buffered entries, waits for a running compaction and syncs and closes the segments,
+// appends fail afterwards.
+func (p *WALPersistence) Close() error {
+	p.bufferMu.Lock()
+	closed := p.closed
+	p.closed = true
+	err := p.err
+	p.err = nil
+	p.bufferMu.Unlock()
+	if !closed {
+		close(p.done)
+		p.writer.Wait()
+	}
+	p.mu.Lock()
+	segment := p.segment
+	if segment != nil {
+		if writeErr := p.writeBuffer(); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	p.segment = nil
+	p.mu.Unlock()
+	p.compaction.Wait()
+	if releaseErr := p.release(); releaseErr != nil && err == nil {
+		err = releaseErr
+	}
+	if segment == nil {
+		return err
+	}
+	if syncErr := segment.Sync(); syncErr != nil && err == nil {
+		err = syncErr
+	}
+	if closeErr := segment.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// run writes the buffer every FlushInterval, or when woken by Append, until Close
+func (p *WALPersistence) run() {
+	defer p.writer.Done()
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+		p.flush()
+	}
+}
+
+// flush writes the buffer to the segment, then rotates the log and compacts it in the background
+// once the segment grows beyond the compaction threshold, when no compaction is running.
+// A failed write is returned by the next Append.
+func (p *WALPersistence) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.segment == nil {
+		return
+	}
+	err := p.writeBuffer()
+	if err == nil && p.size > p.threshold && !p.compacting {
+		if err = p.rotate(); err == nil {
+			p.compacting = true
+			p.compaction.Add(1)
+			go p.compact(p.seq - 1)
+		}
+	}
+	if err != nil {
+		p.bufferMu.Lock()
+		p.err = err
+		p.bufferMu.Unlock()
+	}
+}
+
+// writeBuffer writes the records appended so far to the segment. The caller holds mu.
+func (p *WALPersistence) writeBuffer() error {
+	p.bufferMu.Lock()
+	buffer := p.buffer
+	p.buffer = p.spare[:0]
+	p.bufferMu.Unlock()
+	p.spare = buffer
+	if len(buffer) == 0 {
+		return nil
+	}
+	n, err := p.segment.Write(buffer)
+	p.size += int64(n)
+	return err
+}
+
+// compact writes the snapshot with the segments up to upTo replayed on it and the entries older than the retention dropped,
+// it is a no-op when the snapshot already includes them.
+func (p *WALPersistence) compact(upTo uint64) {
+	defer p.compaction.Done()
+	defer func() {
+		p.mu.Lock()
+		p.compacting = false
+		p.mu.Unlock()
+	}()
+	if err := p.release(); err != nil {
+		log.Printf("wal compaction failed %s", err.Error())
+		return
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	start := time.Now()
+	counters, watermark, err := p.loadSnapshot()
+	if err != nil {
+		log.Printf("wal compaction failed %s", err.Error())
+		return
+	}
+	if upTo <= watermark {
+		return
+	}
+	segments, err := p.segments()
+	if err != nil {
+		log.Printf("wal compaction failed %s", err.Error())
+		return
+	}
+	for _, seq := range segments {
+		if seq <= watermark || seq > upTo {
+			continue
+		}
+		if err := p.replay(seq, counters); err != nil {
+			log.Printf("wal compaction failed %s", err.Error())
+			return
+		}
+	}
+	counters = merge(counters)
+	if retention := time.Duration(atomic.LoadInt64(&p.retention)); retention > 0 {
+		prune(counters, p.clock.Now().Add(-retention).UnixNano())
+	}
+	if err := p.write(counters, upTo); err != nil {
+		log.Printf("wal compaction failed %s", err.Error())
+		return
+	}
+	log.Printf("wal compacted segments up to %d in %s", upTo, time.Since(start))
+}
+
+// write writes counters as the snapshot including the segments up to watermark
+// and deletes the segments included in both it and the snapshot it replaces, which is kept as the previous snapshot.
+// The caller holds writeMu.
+func (p *WALPersistence) write(counters map[string][]models.Entry, watermark uint64) error {
+	snapshot := make(map[string][]models.Entry, len(counters)+1)
+	for key, entries := range counters {
+		snapshot[key] = entries
+	}
+	snapshot[SegmentKey] = []models.Entry{{Hits: int64(watermark)}}
+	if err := p.snapshot.Dump(snapshot); err != nil {
+		return err
+	}
+	obsolete := p.watermark
+	if watermark < obsolete {
+		obsolete = watermark
+	}
+	p.watermark = watermark
+	segments, err := p.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq > obsolete {
+			break
+		}
+		if err := os.Remove(p.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSnapshot returns the entries of the snapshot without SegmentKey and the last segment it includes
+func (p *WALPersistence) loadSnapshot() (map[string][]models.Entry, uint64, error) {
+	counters, err := p.snapshot.Load()
+	if err != nil {
+		return nil, 0, err
+	}
+	var watermark uint64
+	if entries := counters[SegmentKey]; len(entries) > 0 && entries[0].Hits > 0 {
+		watermark = uint64(entries[0].Hits)
+	}
+	delete(counters, SegmentKey)
+	return counters, watermark, nil
+}
+
+// rotate writes the buffer to the current segment, opens the next one and leaves the current one to release.
+// The caller holds mu.
+func (p *WALPersistence) rotate() error {
+	if err := p.writeBuffer(); err != nil {
+		return err
+	}
+	current := p.segment
+	if err := p.open(p.seq + 1); err != nil {
+		return err
+	}
+	p.closing = append(p.closing, current)
+	return nil
+}
+
+// release syncs and closes the segments rotated out, the caller does not hold mu
+// so that appends do not wait for the disk.
+func (p *WALPersistence) release() error {
+	p.mu.Lock()
+	closing := p.closing
+	p.closing = nil
+	p.mu.Unlock()
+	var err error
+	for _, segment := range closing {
+		if syncErr := segment.Sync(); syncErr != nil && err == nil {
+			err = syncErr
+		}
+		if closeErr := segment.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// open creates segment seq and appends to it from now on. The caller holds mu.
+func (p *WALPersistence) open(seq uint64) error {
+	segment, err := os.OpenFile(p.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.segment, p.seq, p.size = segment, seq, 0
+	return nil
+}
+
+// segmentPath returns the location of segment seq
+func (p *WALPersistence) segmentPath(seq uint64) string {
+	return p.path + SegmentSuffix + strconv.FormatUint(seq, 10)
+}
+
+// segments returns the sequence numbers of the segments on disk in ascending order
+func (p *WALPersistence) segments() ([]uint64, error) {
+	files, err := os.ReadDir(filepath.Dir(p.path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(p.path) + SegmentSuffix
+	var segments []uint64
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), prefix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimPrefix(file.Name(), prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// replay adds the entries of the complete records of segment seq to counters and drops the entries of the keys forgotten,
+// the records from the first incomplete or corrupt one on are dropped
+func (p *WALPersistence) replay(seq uint64, counters map[string][]models.Entry) error {
+	path := p.segmentPath(seq)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		key, entry, n, ok := decode(data)
+		if !ok {
+			log.Printf("wal segment %s: dropped %d bytes after the last complete record", path, len(data))
+			return nil
+		}
+		if entry.Hits == 0 {
+			delete(counters, key)
+		} else {
+			counters[key] = append(counters[key], entry)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// encode returns the record of entry of key
+func encode(key string, entry models.Entry) []byte {
+	record := make([]byte, headerSize+2*binary.MaxVarintLen64+len(key))
+	n := headerSize
+	n += binary.PutVarint(record[n:], entry.UnixNano())
+	n += binary.PutVarint(record[n:], entry.Hits)
+	n += copy(record[n:], key)
+	payload := record[headerSize:n]
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return record[:n]
+}
+
+// decode returns the key and entry of the record at the start of data and its size,
+// false when the record is incomplete or corrupt
+func decode(data []byte) (string, models.Entry, int, bool) {
+	if len(data) < headerSize {
+		return "", models.Entry{}, 0, false
+	}
+	length := binary.LittleEndian.Uint32(data[0:4])
+	if length > maxRecordSize || int(length) > len(data)-headerSize {
+		return "", models.Entry{}, 0, false
+	}
+	payload := data[headerSize : headerSize+int(length)]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[4:8]) {
+		return "", models.Entry{}, 0, false
+	}
+	unixNano, n := binary.Varint(payload)
+	if n <= 0 {
+		return "", models.Entry{}, 0, false
+	}
+	hits, m := binary.Varint(payload[n:])
+	if m <= 0 {
+		return "", models.Entry{}, 0, false
+	}
+	return string(payload[n+m:]), models.NewEntry(time.Unix(0, unixNano), hits), headerSize + int(length), true
+}
+
+// merge sorts the entries of every key in counters by their bucket start and merges the entries of the same bucket
+func merge(counters map[string][]models.Entry) map[string][]models.Entry {
+	for key, entries := range counters {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].UnixNano() < entries[j].UnixNano() })
+		merged := entries[:0]
+		for _, entry := range entries {
+			if last := len(merged) - 1; last >= 0 && merged[last].UnixNano() == entry.UnixNano() {
+				merged[last].Hits += entry.Hits
+				continue
+			}
+			merged = append(merged, entry)
+		}
+		counters[key] = merged
+	}
+	return counters
+}
+
+// prune drops the entries of counters starting before oldest, in nanoseconds since epoch, and the keys left without entries
+func prune(counters map[string][]models.Entry, oldest int64) {
+	for key, entries := range counters {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if entry.UnixNano() >= oldest {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == 0 {
+			delete(counters, key)
+			continue
+		}
+		counters[key] = kept
+	}
+}
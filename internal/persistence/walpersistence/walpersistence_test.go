@@ -0,0 +1,332 @@
+package walpersistence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/ratelimiter"
+	"github.com/stretchr/testify/assert"
+)
+
+func entryAt(second int64, hits int64) models.Entry {
+	return models.NewEntry(time.Unix(1624974458+second, 0), hits)
+}
+
+func newTestPersistence(t *testing.T, path string, threshold int64) *WALPersistence {
+	walPersistence, err := NewWALPersistence(path, threshold)
+	assert.NoError(t, err)
+	t.Cleanup(func() { walPersistence.Close() })
+	return walPersistence
+}
+
+func TestNewWALPersistence(t *testing.T) {
+	t.Run("should start a new segment after the segments on disk", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.Equal(t, uint64(1), walPersistence.seq)
+		assert.Equal(t, int64(DefaultCompactionThreshold), walPersistence.threshold)
+		assert.NoError(t, walPersistence.Close())
+
+		walPersistence = newTestPersistence(t, path, 0)
+		assert.Equal(t, uint64(2), walPersistence.seq)
+		_, err := os.Stat(path + SegmentSuffix + "2")
+		assert.NoError(t, err)
+	})
+	t.Run("should return error when the snapshot cannot be created", func(t *testing.T) {
+		_, err := NewWALPersistence(filepath.Join(t.TempDir(), "missing", "dump.json"), 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestWALPersistence_Load(t *testing.T) {
+	t.Run("should replay the appended entries", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+		assert.NoError(t, walPersistence.Append("GLOBAL", entryAt(1, 1)))
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 2)))
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		assert.NoError(t, walPersistence.Close())
+
+		entries, err := newTestPersistence(t, path, 0).Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{
+			"10.0.0.1": {entryAt(0, 1), entryAt(1, 3)},
+			"GLOBAL":   {entryAt(1, 1)},
+		}, entries)
+	})
+	t.Run("should replay the entries appended after the snapshot on top of it", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		assert.NoError(t, walPersistence.Rotate())
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1)}}))
+		assert.NoError(t, walPersistence.Append("10.0.0.2", entryAt(2, 1)))
+		assert.NoError(t, walPersistence.Close())
+
+		_, err := os.Stat(path + SegmentSuffix + "1")
+		assert.NoError(t, err, "the segment is kept until the previous snapshot includes it")
+		entries, err := newTestPersistence(t, path, 0).Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{
+			"10.0.0.1": {entryAt(0, 1), entryAt(1, 1)},
+			"10.0.0.2": {entryAt(2, 1)},
+		}, entries)
+	})
+	t.Run("should delete the segments included in the snapshot and the previous snapshot", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		assert.NoError(t, walPersistence.Rotate())
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1)}}))
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+		assert.NoError(t, walPersistence.Rotate())
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1), entryAt(1, 1)}}))
+
+		segments, err := walPersistence.segments()
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{2, 3}, segments)
+		entries, err := walPersistence.Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1), entryAt(1, 1)}}, entries)
+	})
+	t.Run("should replay the segments the previous snapshot does not include when the snapshot is corrupt", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		assert.NoError(t, walPersistence.Rotate())
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1)}}))
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+		assert.NoError(t, walPersistence.Rotate())
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1), entryAt(1, 1)}}))
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(2, 1)))
+		assert.NoError(t, walPersistence.Close())
+		assert.NoError(t, os.WriteFile(path, []byte(`{"10.0.0.1": [`), 0644))
+
+		entries, err := newTestPersistence(t, path, 0).Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1), entryAt(1, 1), entryAt(2, 1)}}, entries)
+	})
+	t.Run("should keep the segments a compaction included when a dump includes fewer", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.NoError(t, walPersistence.Rotate())
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+		walPersistence.mu.Lock()
+		assert.NoError(t, walPersistence.rotate())
+		walPersistence.compacting = true
+		walPersistence.compaction.Add(1)
+		walPersistence.mu.Unlock()
+		walPersistence.compact(2)
+		assert.Equal(t, uint64(2), walPersistence.watermark)
+
+		// the dump holds the state copied when segment 1 was rotated, before the compaction
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{}))
+		assert.Equal(t, uint64(1), walPersistence.watermark)
+		entries, err := walPersistence.Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{"10.0.0.1": {entryAt(1, 1)}}, entries)
+	})
+	t.Run("should rotate on a dump without rotate", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1)}}))
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+
+		entries, err := walPersistence.Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1), entryAt(1, 1)}}, entries)
+	})
+}
+
+func TestWALPersistence_Load_TruncatedRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		truncate func(data []byte) []byte
+	}{
+		{name: "should drop a record with a truncated header", truncate: func(data []byte) []byte {
+			return data[:len(data)-len(encode("10.0.0.2", entryAt(2, 1)))+headerSize-3]
+		}},
+		{name: "should drop a record with a truncated payload", truncate: func(data []byte) []byte {
+			return data[:len(data)-2]
+		}},
+		{name: "should drop a record with a corrupt payload", truncate: func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}},
+		{name: "should drop a record with a corrupt length", truncate: func(data []byte) []byte {
+			last := len(data) - len(encode("10.0.0.2", entryAt(2, 1)))
+			data[last+3] = 0xff
+			return data
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dump.json")
+			walPersistence := newTestPersistence(t, path, 0)
+			assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+			assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+			assert.NoError(t, walPersistence.Append("10.0.0.2", entryAt(2, 1)))
+			assert.NoError(t, walPersistence.Close())
+			segment := path + SegmentSuffix + "1"
+			data, err := os.ReadFile(segment)
+			assert.NoError(t, err)
+			assert.NoError(t, os.WriteFile(segment, test.truncate(data), 0644))
+
+			walPersistence = newTestPersistence(t, path, 0)
+			entries, err := walPersistence.Load()
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1), entryAt(1, 1)}}, entries)
+
+			// appends after a restart go to a new segment and are not lost behind the truncated record
+			assert.NoError(t, walPersistence.Append("10.0.0.2", entryAt(3, 1)))
+			entries, err = walPersistence.Load()
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]models.Entry{
+				"10.0.0.1": {entryAt(0, 1), entryAt(1, 1)},
+				"10.0.0.2": {entryAt(3, 1)},
+			}, entries)
+		})
+	}
+}
+
+func TestWALPersistence_Compaction(t *testing.T) {
+	t.Run("should compact the log into the snapshot once a segment grows beyond the threshold", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		recordSize := int64(len(encode("10.0.0.1", entryAt(0, 1))))
+		walPersistence := newTestPersistence(t, path, 3*recordSize)
+		for i := int64(0); i < 4; i++ {
+			assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(i, 1)))
+		}
+		walPersistence.flush()
+		walPersistence.compaction.Wait()
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(4, 1)))
+
+		assert.Equal(t, uint64(1), walPersistence.watermark)
+		snapshot, err := walPersistence.snapshot.Load()
+		assert.NoError(t, err)
+		assert.Len(t, snapshot["10.0.0.1"], 4)
+		entries, err := walPersistence.Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{
+			"10.0.0.1": {entryAt(0, 1), entryAt(1, 1), entryAt(2, 1), entryAt(3, 1), entryAt(4, 1)},
+		}, entries)
+	})
+	t.Run("should drop the entries older than the retention and the forgotten keys", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		walPersistence.clock = clock.NewFakeClock(time.Unix(1624974458+60, 0))
+		walPersistence.SetRetention(30 * time.Second)
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{
+			"10.0.0.1": {entryAt(0, 1), entryAt(40, 1)},
+			"10.0.0.2": {entryAt(10, 2)},
+			"10.0.0.3": {entryAt(50, 1)},
+		}))
+		assert.NoError(t, walPersistence.Append("10.0.0.4", entryAt(20, 1)))
+		assert.NoError(t, walPersistence.Forget("10.0.0.3"))
+		assert.NoError(t, walPersistence.Append("10.0.0.5", entryAt(55, 1)))
+		walPersistence.mu.Lock()
+		assert.NoError(t, walPersistence.rotate())
+		walPersistence.compacting = true
+		walPersistence.compaction.Add(1)
+		walPersistence.mu.Unlock()
+		walPersistence.compact(walPersistence.seq - 1)
+
+		snapshot, _, err := walPersistence.loadSnapshot()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{
+			"10.0.0.1": {entryAt(40, 1)},
+			"10.0.0.5": {entryAt(55, 1)},
+		}, snapshot)
+	})
+}
+
+func TestWALPersistence_Forget(t *testing.T) {
+	t.Run("should drop the entries of the key appended before it", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1)}, "10.0.0.2": {entryAt(0, 1)}}))
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+		assert.NoError(t, walPersistence.Forget("10.0.0.1"))
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(2, 1)))
+		assert.NoError(t, walPersistence.Close())
+
+		entries, err := newTestPersistence(t, path, 0).Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]models.Entry{
+			"10.0.0.1": {entryAt(2, 1)},
+			"10.0.0.2": {entryAt(0, 1)},
+		}, entries)
+	})
+}
+
+func TestWALPersistence_Rotate(t *testing.T) {
+	t.Run("should leave the rotated segments open until the dump", func(t *testing.T) {
+		walPersistence := newTestPersistence(t, filepath.Join(t.TempDir(), "dump.json"), 0)
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		assert.NoError(t, walPersistence.Rotate())
+		assert.Len(t, walPersistence.closing, 1)
+		assert.NoError(t, walPersistence.Dump(map[string][]models.Entry{"10.0.0.1": {entryAt(0, 1)}}))
+		assert.Empty(t, walPersistence.closing)
+	})
+}
+
+func TestWALPersistence_Append(t *testing.T) {
+	t.Run("should return error when closed", func(t *testing.T) {
+		walPersistence := newTestPersistence(t, filepath.Join(t.TempDir(), "dump.json"), 0)
+		assert.NoError(t, walPersistence.Close())
+		assert.Equal(t, ErrClosed, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		assert.Equal(t, ErrClosed, walPersistence.Rotate())
+	})
+	t.Run("should write the appended entries in the background", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		walPersistence := newTestPersistence(t, path, 0)
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		assert.Eventually(t, func() bool {
+			info, err := os.Stat(walPersistence.segmentPath(1))
+			return err == nil && info.Size() == int64(len(encode("10.0.0.1", entryAt(0, 1))))
+		}, time.Second, FlushInterval)
+	})
+	t.Run("should return the error of a failed write on the next append", func(t *testing.T) {
+		walPersistence := newTestPersistence(t, filepath.Join(t.TempDir(), "dump.json"), 0)
+		walPersistence.mu.Lock()
+		assert.NoError(t, walPersistence.segment.Close())
+		walPersistence.mu.Unlock()
+		assert.NoError(t, walPersistence.Append("10.0.0.1", entryAt(0, 1)))
+		walPersistence.flush()
+		assert.Error(t, walPersistence.Append("10.0.0.1", entryAt(1, 1)))
+	})
+}
+
+func TestWALPersistence_RateLimiter(t *testing.T) {
+	t.Run("should restore the hits recorded after the last dump", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dump.json")
+		config := ratelimiter.Config{GlobalWindowSize: time.Minute, GlobalAllowedRate: 100, IPWindowSize: time.Minute, AllowedRate: 10}
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		walPersistence := newTestPersistence(t, path, 0)
+		rateLimiterService, err := ratelimiter.NewRateLimiter(config, walPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			rateLimiterService.Hit("10.0.0.1")
+		}
+		assert.NoError(t, rateLimiterService.Dump())
+		fakeClock.Advance(time.Second)
+		for i := 0; i < 2; i++ {
+			rateLimiterService.Hit("10.0.0.1")
+		}
+		// crash without dumping
+		assert.NoError(t, walPersistence.Close())
+
+		rateLimiterService, err = ratelimiter.NewRateLimiter(config, newTestPersistence(t, path, 0), fakeClock)
+		assert.NoError(t, err)
+		decision := rateLimiterService.Peek("10.0.0.1")
+		assert.Equal(t, int64(5), decision.IPHits)
+		assert.Equal(t, int64(5), decision.GlobalHits)
+	})
+}
@@ -0,0 +1,121 @@
+package concurrency
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/ipkey"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+)
+
+// ErrInvalidMaxInFlight is returned when the in-flight limit of a key is not positive or the global one is negative.
+var ErrInvalidMaxInFlight = errors.New("max in-flight requests must be positive")
+
+// Config is the configuration of a ConcurrencyLimiter.
+type Config struct {
+	// MaxInFlight is the number of requests of a key allowed in flight at once.
+	MaxInFlight int64
+	// GlobalMaxInFlight is the number of requests across all keys allowed in flight at once, 0 disables it.
+	GlobalMaxInFlight int64
+	// IPv4Prefix and IPv6Prefix are the prefix lengths IP addresses are keyed by, like 24 and 64,
+	// so that every address of a network shares its limit. 0 keeps each address as its own key.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// ConcurrencyLimiter caps the requests in flight per key and globally, unlike the rate limiters it counts requests
+// from the time they are acquired until they are released instead of their arrival in a window.
+// Only keys with requests in flight are tracked, so it keeps no state to persist or evict.
+type ConcurrencyLimiter struct {
+	mu             sync.Mutex
+	inFlight       map[string]int64
+	globalInFlight int64
+	config         Config
+	normalizer     ipkey.Normalizer
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter with the provided configuration.
+func NewConcurrencyLimiter(config Config) (*ConcurrencyLimiter, error) {
+	if config.MaxInFlight <= 0 || config.GlobalMaxInFlight < 0 {
+		return nil, ErrInvalidMaxInFlight
+	}
+	normalizer, err := ipkey.NewNormalizer(config.IPv4Prefix, config.IPv6Prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &ConcurrencyLimiter{
+		mu:         sync.Mutex{},
+		inFlight:   make(map[string]int64),
+		config:     config,
+		normalizer: normalizer,
+	}, nil
+}
+
+// Acquire takes an in-flight slot for a request from ipAddr if both the key and the global limit have one left,
+// and returns the decision with the release func of the slot. The release func must be called once the request is done,
+// calling it more than once releases the slot only once. Rejected requests take no slot and get a release func doing nothing.
+// The decision reports the requests in flight, including this one when it is allowed, and the slots left
+// of the most restrictive limit. Slots free up as requests finish, so ResetAt and RetryAfter are not set.
+func (c *ConcurrencyLimiter) Acquire(ipAddr string) (models.Decision, func()) {
+	key := c.normalizer.Key(ipAddr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	decision := c.decide(key)
+	if !decision.Allowed {
+		return decision, func() {}
+	}
+	c.inFlight[key]++
+	c.globalInFlight++
+	decision.InFlight++
+	decision.GlobalInFlight++
+	decision.Remaining--
+	var once sync.Once
+	return decision, func() {
+		once.Do(func() {
+			c.release(key)
+		})
+	}
+}
+
+// InFlight returns the number of requests of ipAddr and of all keys in flight.
+func (c *ConcurrencyLimiter) InFlight(ipAddr string) (int64, int64) {
+	key := c.normalizer.Key(ipAddr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inFlight[key], c.globalInFlight
+}
+
+// decide returns the decision for a request of key before its slot is taken, the caller holds the lock
+func (c *ConcurrencyLimiter) decide(key string) models.Decision {
+	decision := models.Decision{
+		Allowed:        true,
+		InFlight:       c.inFlight[key],
+		GlobalInFlight: c.globalInFlight,
+		Limit:          c.config.MaxInFlight,
+	}
+	decision.Remaining = decision.Limit - decision.InFlight
+	globalRemaining := c.config.GlobalMaxInFlight - c.globalInFlight
+	switch {
+	case decision.InFlight >= c.config.MaxInFlight:
+		decision.Allowed, decision.Reason = false, models.RejectReasonConcurrency
+	case c.config.GlobalMaxInFlight > 0 && globalRemaining <= 0:
+		decision.Allowed, decision.Reason = false, models.RejectReasonGlobalConcurrency
+		decision.Limit, decision.Remaining = c.config.GlobalMaxInFlight, 0
+	case c.config.GlobalMaxInFlight > 0 && globalRemaining < decision.Remaining:
+		decision.Limit, decision.Remaining = c.config.GlobalMaxInFlight, globalRemaining
+	}
+	if decision.Remaining < 0 {
+		decision.Remaining = 0
+	}
+	return decision
+}
+
+// release frees the slot of a request of key, keys without requests in flight are no longer tracked
+func (c *ConcurrencyLimiter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.globalInFlight--
+	if c.inFlight[key]--; c.inFlight[key] <= 0 {
+		delete(c.inFlight, key)
+	}
+}
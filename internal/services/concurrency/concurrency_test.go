@@ -0,0 +1,85 @@
+package concurrency
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConcurrencyLimiter(t *testing.T) {
+	t.Run("should return error on invalid limits", func(t *testing.T) {
+		for _, config := range []Config{{}, {MaxInFlight: -1}, {MaxInFlight: 1, GlobalMaxInFlight: -1}} {
+			_, err := NewConcurrencyLimiter(config)
+			assert.Equal(t, ErrInvalidMaxInFlight, err)
+		}
+	})
+	t.Run("should return error on invalid prefixes", func(t *testing.T) {
+		_, err := NewConcurrencyLimiter(Config{MaxInFlight: 1, IPv4Prefix: 33})
+		assert.Error(t, err)
+	})
+}
+
+func TestConcurrencyLimiter_Acquire(t *testing.T) {
+	t.Run("should reject once the key has no slot left and allow again after release", func(t *testing.T) {
+		concurrencyLimiter, err := NewConcurrencyLimiter(Config{MaxInFlight: 2})
+		assert.NoError(t, err)
+		decision, release := concurrencyLimiter.Acquire("10.0.0.1")
+		assert.Equal(t, models.Decision{Allowed: true, InFlight: 1, GlobalInFlight: 1, Limit: 2, Remaining: 1}, decision)
+		_, secondRelease := concurrencyLimiter.Acquire("10.0.0.1")
+		defer secondRelease()
+		decision, rejectedRelease := concurrencyLimiter.Acquire("10.0.0.1")
+		assert.Equal(t, models.Decision{Reason: models.RejectReasonConcurrency, InFlight: 2, GlobalInFlight: 2, Limit: 2}, decision)
+		rejectedRelease()
+		release()
+		release()
+		inFlight, globalInFlight := concurrencyLimiter.InFlight("10.0.0.1")
+		assert.Equal(t, int64(1), inFlight)
+		assert.Equal(t, int64(1), globalInFlight)
+		decision, _ = concurrencyLimiter.Acquire("10.0.0.1")
+		assert.True(t, decision.Allowed)
+	})
+	t.Run("should reject on the global limit and report it when it is the most restrictive", func(t *testing.T) {
+		concurrencyLimiter, err := NewConcurrencyLimiter(Config{MaxInFlight: 5, GlobalMaxInFlight: 2})
+		assert.NoError(t, err)
+		decision, _ := concurrencyLimiter.Acquire("10.0.0.1")
+		assert.Equal(t, models.Decision{Allowed: true, InFlight: 1, GlobalInFlight: 1, Limit: 2, Remaining: 1}, decision)
+		concurrencyLimiter.Acquire("10.0.0.2")
+		decision, _ = concurrencyLimiter.Acquire("10.0.0.3")
+		assert.Equal(t, models.Decision{Reason: models.RejectReasonGlobalConcurrency, GlobalInFlight: 2, Limit: 2}, decision)
+	})
+	t.Run("should share the slots of a network when keyed by prefix", func(t *testing.T) {
+		concurrencyLimiter, err := NewConcurrencyLimiter(Config{MaxInFlight: 1, IPv4Prefix: 24})
+		assert.NoError(t, err)
+		decision, _ := concurrencyLimiter.Acquire("203.0.113.7")
+		assert.True(t, decision.Allowed)
+		decision, _ = concurrencyLimiter.Acquire("203.0.113.8")
+		assert.False(t, decision.Allowed)
+	})
+	t.Run("should allow no more than the limit under concurrent acquires", func(t *testing.T) {
+		concurrencyLimiter, err := NewConcurrencyLimiter(Config{MaxInFlight: 3})
+		assert.NoError(t, err)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var releases []func()
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if decision, release := concurrencyLimiter.Acquire("10.0.0.1"); decision.Allowed {
+					mu.Lock()
+					releases = append(releases, release)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Len(t, releases, 3)
+		for _, release := range releases {
+			release()
+		}
+		assert.Empty(t, concurrencyLimiter.inFlight)
+		assert.Zero(t, concurrencyLimiter.globalInFlight)
+	})
+}
@@ -0,0 +1,152 @@
+package counter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+)
+
+// Mode selects how a counter keeps track of the hits in its window.
+type Mode string
+
+const (
+	// ModeExact keeps every bucket in the window, see Counter.
+	ModeExact Mode = "exact"
+	// ModeApproximate keeps two fixed windows and weights the previous one, see ApproximateCounter.
+	ModeApproximate Mode = "approximate"
+)
+
+// New returns a counter of mode, an empty mode is ModeExact.
+// resolution is used only by ModeExact.
+func New(mode Mode, windowSize, resolution time.Duration, entries []models.Entry, clk clock.Clock) services.CounterServiceInterface {
+	if mode == ModeApproximate {
+		return NewApproximateCounterService(windowSize, entries, clk)
+	}
+	return NewCounterService(windowSize, resolution, entries, clk)
+}
+
+// ApproximateCounter approximates the hits in a sliding window with two fixed windows of windowSize.
+// The count is the hits in the current fixed window plus the hits in the previous fixed window
+// weighted by how much of it the sliding window still overlaps, so it keeps constant state regardless of traffic.
+// The count is exact when hits are spread evenly, it is off by at most the hits of the previous fixed window.
+type ApproximateCounter struct {
+	windowSize time.Duration
+	mu         *sync.Mutex
+	// currentStart is the start of the current fixed window in nanoseconds since epoch
+	currentStart int64
+	current      int64
+	previous     int64
+	clock        clock.Clock
+}
+
+// NewApproximateCounterService returns a new approximate counter service, loaded entries are summed into the fixed windows they fall in
+// so entries persisted by either counter can be loaded.
+func NewApproximateCounterService(windowSize time.Duration, entries []models.Entry, clk clock.Clock) *ApproximateCounter {
+	if windowSize <= 0 {
+		windowSize = DefaultWindowSize
+	}
+	c := &ApproximateCounter{
+		windowSize: windowSize,
+		mu:         &sync.Mutex{},
+		clock:      clk,
+	}
+	now := clk.Now().UnixNano()
+	c.currentStart = truncate(now, windowSize)
+	for _, entry := range entries {
+		switch truncate(entry.UnixNano(), windowSize) {
+		case c.currentStart:
+			c.current += entry.Hits
+		case c.currentStart - int64(windowSize):
+			c.previous += entry.Hits
+		}
+	}
+	return c
+}
+
+// Hit handles the counter and returns the approximate number of hits received in the past windowSize
+func (c *ApproximateCounter) Hit() int64 {
+	return c.HitN(1)
+}
+
+// HitN records n hits and returns the approximate number of hits received in the past windowSize
+func (c *ApproximateCounter) HitN(n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now().UnixNano()
+	c.slide(now)
+	c.current += n
+	return c.count(now)
+}
+
+func (c *ApproximateCounter) Count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now().UnixNano()
+	c.slide(now)
+	return c.count(now)
+}
+
+// Window returns the previous and the current fixed windows as entries, windows without hits are left out
+func (c *ApproximateCounter) Window() []models.Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slide(c.clock.Now().UnixNano())
+	entries := make([]models.Entry, 0, 2)
+	if c.previous > 0 {
+		entries = append(entries, models.NewEntry(time.Unix(0, c.currentStart-int64(c.windowSize)), c.previous))
+	}
+	if c.current > 0 {
+		entries = append(entries, models.NewEntry(time.Unix(0, c.currentStart), c.current))
+	}
+	return entries
+}
+
+// ExpiresAt returns the time at which the approximate count will have dropped by at least n without new hits.
+// The previous window weight drops until the current window ends, after which the current window becomes the previous one.
+// It returns the current time when n is not positive or nothing is counted,
+// and the time the count drops to 0 when fewer than n hits are counted.
+func (c *ApproximateCounter) ExpiresAt(n int64) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now().UnixNano()
+	c.slide(now)
+	count := c.count(now)
+	if n <= 0 || count == 0 {
+		return time.Unix(0, now)
+	}
+	target := float64(count - n)
+	windowSize := float64(c.windowSize)
+	currentEnd := c.currentStart + int64(c.windowSize)
+	// the count drops linearly to c.current at currentEnd and then to 0 one window later
+	if target >= float64(c.current) && c.previous > 0 {
+		return time.Unix(0, currentEnd-int64((target-float64(c.current))*windowSize/float64(c.previous)))
+	}
+	if target <= 0 || c.current == 0 {
+		return time.Unix(0, currentEnd+int64(c.windowSize))
+	}
+	return time.Unix(0, currentEnd+int64((float64(c.current)-target)*windowSize/float64(c.current)))
+}
+
+// slide moves the fixed windows forward to the one now falls in
+func (c *ApproximateCounter) slide(now int64) {
+	start := truncate(now, c.windowSize)
+	switch {
+	case start == c.currentStart:
+		return
+	case start == c.currentStart+int64(c.windowSize):
+		c.previous = c.current
+	default:
+		c.previous = 0
+	}
+	c.current = 0
+	c.currentStart = start
+}
+
+// count returns the current window hits plus the previous window hits weighted by the overlap with the sliding window
+func (c *ApproximateCounter) count(now int64) int64 {
+	overlap := float64(int64(c.windowSize)-(now-c.currentStart)) / float64(c.windowSize)
+	return c.current + int64(float64(c.previous)*overlap)
+}
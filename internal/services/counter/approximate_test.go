@@ -0,0 +1,172 @@
+package counter
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("should return exact counter by default and approximate counter on approximate mode", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		assert.IsType(t, &Counter{}, New("", time.Minute, 0, []models.Entry{}, fakeClock))
+		assert.IsType(t, &Counter{}, New(ModeExact, time.Minute, 0, []models.Entry{}, fakeClock))
+		assert.IsType(t, &ApproximateCounter{}, New(ModeApproximate, time.Minute, 0, []models.Entry{}, fakeClock))
+	})
+}
+
+func TestNewApproximateCounterService(t *testing.T) {
+	t.Run("should return counter service with default window size 60", func(t *testing.T) {
+		counterService := NewApproximateCounterService(0, []models.Entry{}, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.Equal(t, 60*time.Second, counterService.windowSize)
+	})
+	t.Run("should sum loaded entries into the current and previous fixed windows and drop older ones", func(t *testing.T) {
+		// 1624974450 is the start of a 10 second fixed window
+		fakeClock := clock.NewFakeClock(time.Unix(1624974455, 0))
+		entries := []models.Entry{
+			{EpochTimestamp: 1624974435, Hits: 100},
+			{EpochTimestamp: 1624974441, Hits: 3},
+			{EpochTimestamp: 1624974449, Nanos: 500000000, Hits: 7},
+			{EpochTimestamp: 1624974450, Hits: 2},
+			{EpochTimestamp: 1624974454, Hits: 4},
+		}
+		counterService := NewApproximateCounterService(10*time.Second, entries, fakeClock)
+		assert.Equal(t, int64(10), counterService.previous)
+		assert.Equal(t, int64(6), counterService.current)
+	})
+}
+
+func TestApproximateCounter_Hit(t *testing.T) {
+	t.Run("should weight the previous window by the overlap with the sliding window", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974450, 0))
+		counterService := NewApproximateCounterService(10*time.Second, []models.Entry{}, fakeClock)
+		for i := 0; i < 20; i++ {
+			counterService.Hit()
+		}
+		fakeClock.Advance(12500 * time.Millisecond)
+		assert.Equal(t, int64(15), counterService.Count())
+		assert.Equal(t, int64(16), counterService.Hit())
+		fakeClock.Advance(5 * time.Second)
+		assert.Equal(t, int64(6), counterService.Count())
+	})
+	t.Run("should record n hits at once", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974450, 0))
+		counterService := NewApproximateCounterService(10*time.Second, []models.Entry{}, fakeClock)
+		assert.Equal(t, int64(5), counterService.HitN(5))
+		assert.Equal(t, int64(6), counterService.Hit())
+	})
+	t.Run("should forget the previous window when a whole window passes without hits", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974450, 0))
+		counterService := NewApproximateCounterService(10*time.Second, []models.Entry{}, fakeClock)
+		counterService.Hit()
+		fakeClock.Advance(20 * time.Second)
+		assert.Equal(t, int64(0), counterService.Count())
+		assert.Equal(t, int64(0), counterService.previous)
+	})
+	t.Run("do concurrent requests and ensure the count is valid", func(t *testing.T) {
+		counterService := NewApproximateCounterService(60*time.Second, []models.Entry{}, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		wg := sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				counterService.Hit()
+				counterService.Hit()
+				counterService.Hit()
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int64(60), counterService.Count())
+	})
+}
+
+func TestApproximateCounter_ExpiresAt(t *testing.T) {
+	t.Run("should return the time the weighted count drops by n", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974450, 0))
+		counterService := NewApproximateCounterService(10*time.Second, []models.Entry{}, fakeClock)
+		counterService.HitN(20)
+		fakeClock.Advance(10 * time.Second)
+		counterService.HitN(4)
+		// the count is 24 and drops by 2 hits a second until 1624974470, then by 0.4 hits a second
+		assert.Equal(t, time.Unix(1624974465, 0), counterService.ExpiresAt(10))
+		assert.Equal(t, time.Unix(1624974470, 0), counterService.ExpiresAt(20))
+		assert.Equal(t, time.Unix(1624974475, 0), counterService.ExpiresAt(22))
+		assert.Equal(t, time.Unix(1624974480, 0), counterService.ExpiresAt(30))
+		assert.Equal(t, time.Unix(1624974460, 0), counterService.ExpiresAt(0))
+	})
+}
+
+func TestApproximateCounter_Window(t *testing.T) {
+	t.Run("should return the fixed windows as entries which load back to the same count", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974450, 0))
+		counterService := NewApproximateCounterService(10*time.Second, []models.Entry{}, fakeClock)
+		counterService.Hit()
+		counterService.Hit()
+		fakeClock.Advance(13 * time.Second)
+		counterService.Hit()
+		entries := counterService.Window()
+		assert.Equal(t, []models.Entry{{EpochTimestamp: 1624974450, Hits: 2}, {EpochTimestamp: 1624974460, Hits: 1}}, entries)
+		loaded := NewApproximateCounterService(10*time.Second, entries, fakeClock)
+		assert.Equal(t, counterService.Count(), loaded.Count())
+	})
+}
+
+// compareWithExact replays hits on an exact and an approximate counter, hits[i] hits are made at the i-th step,
+// and returns the largest difference between the counts along with the previous fixed window hits at that point.
+func compareWithExact(windowSize, step time.Duration, hits []int) (int64, int64) {
+	fakeClock := clock.NewFakeClock(time.Unix(1624974450, 0))
+	exact := NewCounterService(windowSize, time.Millisecond, []models.Entry{}, fakeClock)
+	approximate := NewApproximateCounterService(windowSize, []models.Entry{}, fakeClock)
+	var maxError, previousAtMax int64
+	for _, n := range hits {
+		for i := 0; i < n; i++ {
+			exact.Hit()
+			approximate.Hit()
+		}
+		diff := approximate.Count() - exact.Count()
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > maxError {
+			maxError, previousAtMax = diff, approximate.previous
+		}
+		fakeClock.Advance(step)
+	}
+	return maxError, previousAtMax
+}
+
+func TestApproximateCounter_ErrorBound(t *testing.T) {
+	t.Run("should stay within a step of hits of the exact count on evenly spread hits", func(t *testing.T) {
+		hits := make([]int, 600)
+		for i := range hits {
+			hits[i] = 5
+		}
+		maxError, _ := compareWithExact(10*time.Second, 100*time.Millisecond, hits)
+		t.Logf("even traffic: max error %d hits on %d hits per window", maxError, 500)
+		assert.LessOrEqual(t, maxError, int64(5))
+	})
+	t.Run("should stay within the previous window hits of the exact count on bursty hits", func(t *testing.T) {
+		random := rand.New(rand.NewSource(1))
+		hits := make([]int, 600)
+		for i := range hits {
+			if random.Intn(10) == 0 {
+				hits[i] = random.Intn(50)
+			}
+		}
+		maxError, previous := compareWithExact(10*time.Second, 100*time.Millisecond, hits)
+		t.Logf("bursty traffic: max error %d hits with %d hits in the previous window", maxError, previous)
+		assert.LessOrEqual(t, maxError, previous)
+	})
+	t.Run("should be off by the whole previous window when it is a single burst at its start", func(t *testing.T) {
+		hits := make([]int, 150)
+		hits[0] = 100
+		maxError, previous := compareWithExact(10*time.Second, 100*time.Millisecond, hits)
+		assert.Equal(t, int64(100), previous)
+		assert.InDelta(t, 100, maxError, 1)
+	})
+}
@@ -4,84 +4,146 @@ import (
 	"sync"
 	"time"
 
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
 )
 
+const (
+	// DefaultWindowSize is the window size used when none is configured.
+	DefaultWindowSize = 60 * time.Second
+	// DefaultResolution is the bucket width used when none is configured.
+	DefaultResolution = time.Second
+)
+
 // Counter service handles the hit counter
 type Counter struct {
-	windowSize int64
+	windowSize time.Duration
+	// resolution is the width of the buckets hits are grouped in
+	resolution time.Duration
 	mu         *sync.Mutex
-	// store the request window in the past windowSize seconds
+	// store the request window in the past windowSize
 	window     []models.Entry
 	hitCounter int64
+	clock      clock.Clock
 }
 
 // NewCounterService load data from csv file to window and returns a new counter service
-func NewCounterService(windowSize int, entries []models.Entry) *Counter {
-	// discard entries if last entry is before windowSize seconds
-	now := time.Now().Unix()
-	var totalHits int64 = 0
-	entriesLength := len(entries)
-	if entriesLength > 0 && entries[entriesLength-1].EpochTimestamp < now-int64(windowSize) {
-		entries = []models.Entry{}
-	} else {
-		for _, entry := range entries {
-			totalHits += entry.Hits
-		}
+// windowSize is the length of the sliding window and resolution is the width of the buckets in it,
+// loaded entries are regrouped to resolution so entries persisted with another resolution are counted correctly.
+// clk is the time source used to slide the window.
+func NewCounterService(windowSize, resolution time.Duration, entries []models.Entry, clk clock.Clock) *Counter {
+	// default value setting
+	if windowSize <= 0 {
+		windowSize = DefaultWindowSize
+	}
+	if resolution <= 0 {
+		resolution = DefaultResolution
+	}
+	if resolution > windowSize {
+		resolution = windowSize
 	}
 
-	// default value setting
-	if windowSize == 0 {
-		windowSize = 60
+	var totalHits int64 = 0
+	window := make([]models.Entry, 0, len(entries))
+	for _, entry := range entries {
+		totalHits += entry.Hits
+		bucket := truncate(entry.UnixNano(), resolution)
+		if windowLength := len(window); windowLength > 0 && window[windowLength-1].UnixNano() == bucket {
+			window[windowLength-1].Hits += entry.Hits
+			continue
+		}
+		window = append(window, models.NewEntry(time.Unix(0, bucket), entry.Hits))
 	}
 
-	return &Counter{
-		windowSize: int64(windowSize),
+	c := &Counter{
+		windowSize: windowSize,
+		resolution: resolution,
 		mu:         &sync.Mutex{},
-		window:     entries,
+		window:     window,
 		hitCounter: totalHits,
+		clock:      clk,
 	}
+	// discard loaded entries which are before windowSize
+	c.discard(c.now())
+	return c
 }
 
-// Hit handles the counter and returns the total number of hits received in the past windowSize seconds
+// Hit handles the counter and returns the total number of hits received in the past windowSize
 func (c *Counter) Hit() int64 {
+	return c.HitN(1)
+}
+
+// HitN records n hits and returns the total number of hits received in the past windowSize
+func (c *Counter) HitN(n int64) int64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	now := time.Now().Unix()
+	now := c.now()
 	c.discard(now)
 	windowLength := len(c.window)
-	if windowLength > 0 && c.window[windowLength-1].EpochTimestamp == now {
-		c.window[windowLength-1].Hits += 1
+	if windowLength > 0 && c.window[windowLength-1].UnixNano() == now {
+		c.window[windowLength-1].Hits += n
 	} else {
-		c.window = append(c.window, models.Entry{EpochTimestamp: now, Hits: 1})
+		c.window = append(c.window, models.NewEntry(time.Unix(0, now), n))
 	}
-	c.hitCounter = c.hitCounter + 1
+	c.hitCounter = c.hitCounter + n
 	return c.hitCounter
 }
 
 func (c *Counter) Count() int64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	now := time.Now().Unix()
-	c.discard(now)
+	c.discard(c.now())
 	return c.hitCounter
 }
 
+// Window returns a copy of the buckets in the window, so it can be serialized while hits are recorded
 func (c *Counter) Window() []models.Entry {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	now := time.Now().Unix()
-	c.discard(now)
-	return c.window
+	c.discard(c.now())
+	window := make([]models.Entry, len(c.window))
+	copy(window, c.window)
+	return window
+}
+
+// ExpiresAt returns the time at which at least n of the hits in the window will have slid out of it, hits expire with their bucket.
+// It returns the current time when n is not positive or the window is empty,
+// and the time the newest bucket expires when the window holds fewer than n hits.
+func (c *Counter) ExpiresAt(n int64) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.discard(c.now())
+	windowLength := len(c.window)
+	if n <= 0 || windowLength == 0 {
+		return c.clock.Now()
+	}
+	var expired int64
+	for _, entry := range c.window {
+		expired += entry.Hits
+		if expired >= n {
+			return c.expiry(entry)
+		}
+	}
+	return c.expiry(c.window[windowLength-1])
+}
+
+// expiry returns the time entry slides out of the window
+func (c *Counter) expiry(entry models.Entry) time.Time {
+	return time.Unix(0, entry.UnixNano()+int64(c.windowSize)+int64(c.resolution))
+}
+
+// now returns the start of the current bucket in nanoseconds since epoch
+func (c *Counter) now() int64 {
+	return truncate(c.clock.Now().UnixNano(), c.resolution)
 }
 
 func (c *Counter) discard(now int64) {
 	windowLength := len(c.window)
-	windowStart := now - c.windowSize
+	windowStart := now - int64(c.windowSize)
 	var diff int64
 	discardCount := 0
 	for i := 0; i < windowLength; i++ {
-		if c.window[i].EpochTimestamp < windowStart {
+		if c.window[i].UnixNano() < windowStart {
 			discardCount++
 			diff += c.window[i].Hits
 		}
@@ -89,3 +151,8 @@ func (c *Counter) discard(now int64) {
 	c.window = c.window[discardCount:windowLength]
 	c.hitCounter = c.hitCounter - diff
 }
+
+// truncate returns the start of the bucket of width resolution that unixNano falls in
+func truncate(unixNano int64, resolution time.Duration) int64 {
+	return unixNano - unixNano%int64(resolution)
+}
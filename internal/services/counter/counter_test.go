@@ -5,45 +5,131 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewCounterService(t *testing.T) {
 	t.Run("should return counter service successfully", func(t *testing.T) {
-		counterService := NewCounterService(60, []models.Entry{})
+		counterService := NewCounterService(60*time.Second, 0, []models.Entry{}, clock.NewFakeClock(time.Unix(1624974458, 0)))
 		assert.NotEmpty(t, counterService)
 	})
-	t.Run("should return counter service with default window size 60", func(t *testing.T) {
-		counterService := NewCounterService(0, []models.Entry{})
-		assert.Equal(t, counterService.windowSize, int64(60))
+	t.Run("should return counter service with default window size 60 and resolution of a second", func(t *testing.T) {
+		counterService := NewCounterService(0, 0, []models.Entry{}, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.Equal(t, counterService.windowSize, 60*time.Second)
+		assert.Equal(t, counterService.resolution, time.Second)
+	})
+	t.Run("should load second resolution entries into a sub-second resolution counter", func(t *testing.T) {
+		epochNow := int64(1624974458)
+		entries := []models.Entry{{EpochTimestamp: epochNow - 2, Hits: 3}, {EpochTimestamp: epochNow - 1, Hits: 4}}
+		counterService := NewCounterService(1500*time.Millisecond, 100*time.Millisecond, entries, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.Equal(t, []models.Entry{{EpochTimestamp: epochNow - 1, Hits: 4}}, counterService.window)
+		assert.Equal(t, int64(4), counterService.hitCounter)
+	})
+	t.Run("should regroup sub-second entries into the counter resolution", func(t *testing.T) {
+		epochNow := int64(1624974458)
+		entries := []models.Entry{
+			{EpochTimestamp: epochNow - 1, Nanos: int64(100 * time.Millisecond), Hits: 3},
+			{EpochTimestamp: epochNow - 1, Nanos: int64(900 * time.Millisecond), Hits: 4},
+			{EpochTimestamp: epochNow, Nanos: int64(10 * time.Millisecond), Hits: 5},
+		}
+		counterService := NewCounterService(60*time.Second, time.Second, entries, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.Equal(t, []models.Entry{{EpochTimestamp: epochNow - 1, Hits: 7}, {EpochTimestamp: epochNow, Hits: 5}}, counterService.window)
+		assert.Equal(t, int64(12), counterService.hitCounter)
 	})
 	t.Run("should set window to be empty slice when the latest entry from loaded entry is more than 60s ago -when windowsize is 60", func(t *testing.T) {
-		epochNow := time.Now().Unix()
-		counterService := NewCounterService(60, []models.Entry{{EpochTimestamp: epochNow - 70, Hits: int64(50)}})
+		epochNow := int64(1624974458)
+		counterService := NewCounterService(60*time.Second, 0, []models.Entry{{EpochTimestamp: epochNow - 70, Hits: int64(50)}}, clock.NewFakeClock(time.Unix(epochNow, 0)))
 		assert.Empty(t, counterService.window)
 		assert.Zero(t, counterService.hitCounter)
 	})
+	t.Run("should keep loaded entries when the latest entry is exactly windowSize seconds ago", func(t *testing.T) {
+		epochNow := int64(1624974458)
+		counterService := NewCounterService(60*time.Second, 0, []models.Entry{{EpochTimestamp: epochNow - 60, Hits: int64(50)}}, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.Len(t, counterService.window, 1)
+		assert.Equal(t, int64(50), counterService.hitCounter)
+	})
 }
 
 func TestCounter_Hit(t *testing.T) {
 	t.Run("should include loaded count 50 seconds ago with latest hit", func(t *testing.T) {
-		epochNow := time.Now().Unix()
-		counterService := NewCounterService(60, []models.Entry{{EpochTimestamp: epochNow - 50, Hits: int64(50)}})
+		epochNow := int64(1624974458)
+		counterService := NewCounterService(60*time.Second, 0, []models.Entry{{EpochTimestamp: epochNow - 50, Hits: int64(50)}}, clock.NewFakeClock(time.Unix(epochNow, 0)))
 		newHit := counterService.Hit()
 		var expectedHits int64 = 51
 		assert.Equal(t, expectedHits, newHit)
 	})
 	t.Run("should discard loaded count 60 seconds ago", func(t *testing.T) {
-		epochNow := time.Now().Unix()
-		counterService := NewCounterService(60, []models.Entry{{EpochTimestamp: epochNow - 70, Hits: int64(50)}})
+		epochNow := int64(1624974458)
+		counterService := NewCounterService(60*time.Second, 0, []models.Entry{{EpochTimestamp: epochNow - 70, Hits: int64(50)}}, clock.NewFakeClock(time.Unix(epochNow, 0)))
 		newHit := counterService.Hit()
 		var expectedHits int64 = 1
 		assert.Equal(t, expectedHits, newHit)
 	})
+	t.Run("should group hits in the same second into one entry", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		counterService := NewCounterService(60*time.Second, 0, []models.Entry{}, fakeClock)
+		counterService.Hit()
+		fakeClock.Advance(999 * time.Millisecond)
+		counterService.Hit()
+		fakeClock.Advance(time.Millisecond)
+		counterService.Hit()
+		expectedEntries := []models.Entry{
+			{EpochTimestamp: 1624974458, Hits: 2},
+			{EpochTimestamp: 1624974459, Hits: 1},
+		}
+		assert.Equal(t, expectedEntries, counterService.Window())
+	})
+	t.Run("should group hits in sub-second buckets", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		counterService := NewCounterService(time.Second, 100*time.Millisecond, []models.Entry{}, fakeClock)
+		counterService.Hit()
+		fakeClock.Advance(50 * time.Millisecond)
+		counterService.Hit()
+		fakeClock.Advance(250 * time.Millisecond)
+		counterService.Hit()
+		expectedEntries := []models.Entry{
+			{EpochTimestamp: 1624974458, Hits: 2},
+			{EpochTimestamp: 1624974458, Nanos: int64(300 * time.Millisecond), Hits: 1},
+		}
+		assert.Equal(t, expectedEntries, counterService.Window())
+	})
+	t.Run("should expire sub-second buckets once the clock moves past the window", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		counterService := NewCounterService(1500*time.Millisecond, 100*time.Millisecond, []models.Entry{}, fakeClock)
+		counterService.Hit()
+		fakeClock.Advance(time.Second)
+		counterService.Hit()
+		fakeClock.Advance(500 * time.Millisecond)
+		assert.Equal(t, int64(2), counterService.Count())
+		fakeClock.Advance(100 * time.Millisecond)
+		assert.Equal(t, int64(1), counterService.Count())
+	})
+	t.Run("should expire hits once the clock moves past the window", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		counterService := NewCounterService(20*time.Second, 0, []models.Entry{}, fakeClock)
+		counterService.Hit()
+		counterService.Hit()
+		fakeClock.Advance(10 * time.Second)
+		assert.Equal(t, int64(3), counterService.Hit())
+		fakeClock.Advance(10 * time.Second)
+		assert.Equal(t, int64(3), counterService.Count())
+		fakeClock.Advance(time.Second)
+		assert.Equal(t, int64(1), counterService.Count())
+		fakeClock.Advance(10 * time.Second)
+		assert.Equal(t, int64(0), counterService.Count())
+	})
+	t.Run("should record n hits at once in the current bucket", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		counterService := NewCounterService(60*time.Second, 0, []models.Entry{}, fakeClock)
+		assert.Equal(t, int64(5), counterService.HitN(5))
+		assert.Equal(t, int64(6), counterService.Hit())
+		assert.Equal(t, []models.Entry{{EpochTimestamp: 1624974458, Hits: 6}}, counterService.Window())
+	})
 	t.Run("do concurrent requests and ensure the count is valid", func(t *testing.T) {
-		epochNow := time.Now().Unix()
-		counterService := NewCounterService(60, []models.Entry{{EpochTimestamp: epochNow - 30, Hits: int64(50)}})
+		epochNow := int64(1624974458)
+		counterService := NewCounterService(60*time.Second, 0, []models.Entry{{EpochTimestamp: epochNow - 30, Hits: int64(50)}}, clock.NewFakeClock(time.Unix(epochNow, 0)))
 		wg := sync.WaitGroup{}
 		for i := 0; i < 20; i++ {
 			wg.Add(1)
@@ -61,11 +147,31 @@ func TestCounter_Hit(t *testing.T) {
 	})
 }
 
+func TestCounter_ExpiresAt(t *testing.T) {
+	t.Run("should return the time enough hits slide out of the window", func(t *testing.T) {
+		epochNow := int64(1624974458)
+		entries := []models.Entry{{EpochTimestamp: epochNow - 15, Hits: 3}, {EpochTimestamp: epochNow - 5, Hits: 4}}
+		counterService := NewCounterService(20*time.Second, 0, entries, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.Equal(t, time.Unix(epochNow+6, 0), counterService.ExpiresAt(1))
+		assert.Equal(t, time.Unix(epochNow+6, 0), counterService.ExpiresAt(3))
+		assert.Equal(t, time.Unix(epochNow+16, 0), counterService.ExpiresAt(4))
+		assert.Equal(t, time.Unix(epochNow+16, 0), counterService.ExpiresAt(10))
+	})
+	t.Run("should return now for an empty window or no hits", func(t *testing.T) {
+		now := time.Unix(1624974458, 300)
+		counterService := NewCounterService(20*time.Second, 0, []models.Entry{}, clock.NewFakeClock(now))
+		assert.Equal(t, now, counterService.ExpiresAt(1))
+		counterService.Hit()
+		assert.Equal(t, now, counterService.ExpiresAt(0))
+	})
+}
+
 func TestCounter_Window(t *testing.T) {
 	t.Run("should discard old entries and return newer entries, reducing hit count", func(t *testing.T) {
-		now := time.Now().Unix()
+		now := int64(1624974458)
 		counterService := Counter{
-			windowSize: 20,
+			windowSize: 20 * time.Second,
+			resolution: time.Second,
 			mu:         &sync.Mutex{},
 			window: []models.Entry{
 				{EpochTimestamp: now - 40, Hits: 20},
@@ -75,6 +181,7 @@ func TestCounter_Window(t *testing.T) {
 				{EpochTimestamp: now - 10, Hits: 20},
 			},
 			hitCounter: 100,
+			clock:      clock.NewFakeClock(time.Unix(now, 0)),
 		}
 		entries := counterService.Window()
 		expectedEntries := []models.Entry{
@@ -0,0 +1,153 @@
+package counter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+)
+
+// Period is a calendar period a QuotaCounter resets at the start of.
+type Period string
+
+const (
+	// PeriodDay starts at midnight.
+	PeriodDay Period = "day"
+	// PeriodWeek starts at midnight on Monday.
+	PeriodWeek Period = "week"
+	// PeriodMonth starts at midnight on the first day of the month.
+	PeriodMonth Period = "month"
+)
+
+// ParsePeriod returns the Period named s, an error for unknown periods.
+func ParsePeriod(s string) (Period, error) {
+	switch period := Period(s); period {
+	case PeriodDay, PeriodWeek, PeriodMonth:
+		return period, nil
+	}
+	return "", fmt.Errorf("unknown period %q, expected day, week or month", s)
+}
+
+// Start returns the start of the period t falls in, in the location of t.
+func (p Period) Start(t time.Time) time.Time {
+	year, month, day := t.Date()
+	switch p {
+	case PeriodWeek:
+		// Monday is the first day of the week
+		return time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	case PeriodMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// next returns the start of the period following the one starting at start
+func (p Period) next(start time.Time) time.Time {
+	switch p {
+	case PeriodWeek:
+		return start.AddDate(0, 0, 7)
+	case PeriodMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// QuotaCounter counts the hits in the current calendar period, like a month, and resets when the next period starts.
+// Periods follow the calendar of its location, so a day starts at local midnight and lasts 23 or 25 hours across DST changes.
+// It keeps a single count regardless of the length of the period.
+type QuotaCounter struct {
+	period   Period
+	location *time.Location
+	mu       *sync.Mutex
+	// start and end bound the current period
+	start time.Time
+	end   time.Time
+	hits  int64
+	clock clock.Clock
+}
+
+// NewQuotaCounterService returns a new quota counter of period in location, a nil location is UTC.
+// Loaded entries are counted when they fall in the current period, entries of earlier periods are discarded.
+func NewQuotaCounterService(period Period, location *time.Location, entries []models.Entry, clk clock.Clock) *QuotaCounter {
+	if location == nil {
+		location = time.UTC
+	}
+	c := &QuotaCounter{
+		period:   period,
+		location: location,
+		mu:       &sync.Mutex{},
+		clock:    clk,
+	}
+	c.reset(clk.Now())
+	for _, entry := range entries {
+		at := time.Unix(0, entry.UnixNano())
+		if !at.Before(c.start) && at.Before(c.end) {
+			c.hits += entry.Hits
+		}
+	}
+	return c
+}
+
+// Hit handles the counter and returns the number of hits received in the current period
+func (c *QuotaCounter) Hit() int64 {
+	return c.HitN(1)
+}
+
+// HitN records n hits and returns the number of hits received in the current period
+func (c *QuotaCounter) HitN(n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roll(c.clock.Now())
+	c.hits += n
+	return c.hits
+}
+
+func (c *QuotaCounter) Count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roll(c.clock.Now())
+	return c.hits
+}
+
+// Window returns the hits of the current period as a single entry at its start, nothing when there are none
+func (c *QuotaCounter) Window() []models.Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roll(c.clock.Now())
+	if c.hits == 0 {
+		return []models.Entry{}
+	}
+	return []models.Entry{models.NewEntry(c.start, c.hits)}
+}
+
+// ExpiresAt returns the start of the next period, when every hit expires at once.
+// It returns the current time when n is not positive or nothing is counted.
+func (c *QuotaCounter) ExpiresAt(n int64) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	c.roll(now)
+	if n <= 0 || c.hits == 0 {
+		return now
+	}
+	return c.end
+}
+
+// roll starts the period now falls in once the current one has ended
+func (c *QuotaCounter) roll(now time.Time) {
+	if now.Before(c.end) {
+		return
+	}
+	c.reset(now)
+	c.hits = 0
+}
+
+// reset sets the bounds of the period now falls in
+func (c *QuotaCounter) reset(now time.Time) {
+	c.start = c.period.Start(now.In(c.location))
+	c.end = c.period.next(c.start)
+}
@@ -0,0 +1,104 @@
+package counter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeriod_Start(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+	// Wednesday
+	now := time.Date(2021, time.June, 30, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		period   Period
+		now      time.Time
+		expected time.Time
+	}{
+		{name: "should start a day at midnight", period: PeriodDay, now: now, expected: time.Date(2021, time.June, 30, 0, 0, 0, 0, time.UTC)},
+		{name: "should start a week on Monday", period: PeriodWeek, now: now, expected: time.Date(2021, time.June, 28, 0, 0, 0, 0, time.UTC)},
+		{name: "should start a week on the Monday before Sunday", period: PeriodWeek, now: time.Date(2021, time.July, 4, 23, 0, 0, 0, time.UTC), expected: time.Date(2021, time.June, 28, 0, 0, 0, 0, time.UTC)},
+		{name: "should start a month on its first day", period: PeriodMonth, now: now, expected: time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "should start a day at midnight of the location", period: PeriodDay, now: time.Date(2021, time.June, 30, 23, 0, 0, 0, time.UTC).In(berlin), expected: time.Date(2021, time.July, 1, 0, 0, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.True(t, tt.expected.Equal(tt.period.Start(tt.now)), tt.period.Start(tt.now).String())
+		})
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	t.Run("should parse known periods and return error for others", func(t *testing.T) {
+		period, err := ParsePeriod("month")
+		assert.NoError(t, err)
+		assert.Equal(t, PeriodMonth, period)
+		_, err = ParsePeriod("year")
+		assert.EqualError(t, err, `unknown period "year", expected day, week or month`)
+	})
+}
+
+func TestNewQuotaCounterService(t *testing.T) {
+	t.Run("should count loaded entries of the current period and discard earlier ones", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Date(2021, time.June, 30, 15, 0, 0, 0, time.UTC))
+		entries := []models.Entry{
+			models.NewEntry(time.Date(2021, time.May, 31, 0, 0, 0, 0, time.UTC), 100),
+			models.NewEntry(time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC), 7),
+			models.NewEntry(time.Date(2021, time.June, 20, 12, 0, 0, 0, time.UTC), 3),
+		}
+		counterService := NewQuotaCounterService(PeriodMonth, nil, entries, fakeClock)
+		assert.Equal(t, int64(10), counterService.Count())
+		assert.Equal(t, time.UTC, counterService.location)
+	})
+}
+
+func TestQuotaCounter_Hit(t *testing.T) {
+	t.Run("should reset at the start of the next period", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Date(2021, time.June, 30, 23, 59, 59, 0, time.UTC))
+		counterService := NewQuotaCounterService(PeriodMonth, time.UTC, []models.Entry{}, fakeClock)
+		assert.Equal(t, int64(1), counterService.Hit())
+		assert.Equal(t, int64(5), counterService.HitN(4))
+		fakeClock.Advance(time.Second)
+		assert.Equal(t, int64(0), counterService.Count())
+		assert.Equal(t, int64(1), counterService.Hit())
+	})
+	t.Run("should reset at midnight of the location", func(t *testing.T) {
+		newYork, err := time.LoadLocation("America/New_York")
+		assert.NoError(t, err)
+		// 03:30 UTC is still the previous day in New York
+		fakeClock := clock.NewFakeClock(time.Date(2021, time.June, 30, 3, 30, 0, 0, time.UTC))
+		counterService := NewQuotaCounterService(PeriodDay, newYork, []models.Entry{}, fakeClock)
+		counterService.HitN(3)
+		fakeClock.Advance(time.Hour)
+		assert.Equal(t, int64(0), counterService.Count())
+	})
+}
+
+func TestQuotaCounter_ExpiresAt(t *testing.T) {
+	t.Run("should expire every hit at the start of the next period", func(t *testing.T) {
+		now := time.Date(2021, time.June, 30, 15, 0, 0, 0, time.UTC)
+		fakeClock := clock.NewFakeClock(now)
+		counterService := NewQuotaCounterService(PeriodWeek, time.UTC, []models.Entry{}, fakeClock)
+		assert.Equal(t, now, counterService.ExpiresAt(1))
+		counterService.HitN(5)
+		assert.True(t, time.Date(2021, time.July, 5, 0, 0, 0, 0, time.UTC).Equal(counterService.ExpiresAt(1)))
+		assert.True(t, time.Date(2021, time.July, 5, 0, 0, 0, 0, time.UTC).Equal(counterService.ExpiresAt(5)))
+	})
+}
+
+func TestQuotaCounter_Window(t *testing.T) {
+	t.Run("should return the hits of the current period as an entry at its start", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Date(2021, time.June, 30, 15, 0, 0, 0, time.UTC))
+		counterService := NewQuotaCounterService(PeriodDay, time.UTC, []models.Entry{}, fakeClock)
+		assert.Empty(t, counterService.Window())
+		counterService.HitN(2)
+		fakeClock.Advance(time.Hour)
+		counterService.Hit()
+		assert.Equal(t, []models.Entry{models.NewEntry(time.Date(2021, time.June, 30, 0, 0, 0, 0, time.UTC), 3)}, counterService.Window())
+	})
+}
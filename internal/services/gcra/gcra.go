@@ -0,0 +1,256 @@
+package gcra
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/ipkey"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence"
+)
+
+// GlobalKey is the key to store the global theoretical arrival time, an IP keyed GlobalKey is limited but not persisted.
+const GlobalKey = "GLOBAL"
+
+var (
+	// ErrInvalidRate is returned when the rate of an enabled limit is not positive.
+	ErrInvalidRate = errors.New("gcra rate must be positive")
+	// ErrInvalidPeriod is returned when the period of an enabled limit is not positive.
+	ErrInvalidPeriod = errors.New("gcra period must be positive")
+)
+
+// Config is the configuration of a GCRA limiter.
+type Config struct {
+	// Rate is the number of requests allowed for an IP in Period.
+	Rate int64
+	// Period is the time Rate requests are spread over.
+	Period time.Duration
+	// Burst is the number of requests an IP can make at once, defaults to Rate.
+	Burst int64
+	// GlobalRate is the number of requests allowed across all IPs in GlobalPeriod, 0 disables global limiting.
+	GlobalRate int64
+	// GlobalPeriod is the time GlobalRate requests are spread over.
+	GlobalPeriod time.Duration
+	// GlobalBurst is the number of requests allowed across all IPs at once, defaults to GlobalRate.
+	GlobalBurst int64
+	// IPv4Prefix and IPv6Prefix are the prefix lengths IP addresses are keyed by, like 24 and 64,
+	// so that every address of a network shares its limit. 0 keeps each address as its own key.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// limit is a rate limit expressed as the emission interval between requests and the burst tolerance
+type limit struct {
+	emissionInterval int64
+	burst            int64
+}
+
+func newLimit(rate int64, period time.Duration, burst int64) limit {
+	if burst <= 0 {
+		burst = rate
+	}
+	emissionInterval := int64(period) / rate
+	if emissionInterval == 0 {
+		emissionInterval = 1
+	}
+	return limit{emissionInterval: emissionInterval, burst: burst}
+}
+
+// allowAt returns the earliest time in nanoseconds a request costing cost can be made on a key with tat and the tat after that request
+func (l limit) allowAt(tat, now, cost int64) (int64, int64) {
+	if tat < now {
+		tat = now
+	}
+	newTat := tat + cost*l.emissionInterval
+	return newTat - l.burst*l.emissionInterval, newTat
+}
+
+// used returns the number of requests counted against a key with tat at now
+func (l limit) used(tat, now int64) int64 {
+	if tat <= now {
+		return 0
+	}
+	return (tat - now + l.emissionInterval - 1) / l.emissionInterval
+}
+
+// GCRA is a rate limiter implementing the generic cell rate algorithm.
+// For each key it stores only the theoretical arrival time, the time at which the key would be idle again.
+type GCRA struct {
+	mu sync.Mutex
+	// tats holds the theoretical arrival time of each key in nanoseconds since epoch, the keys whose time has passed
+	// are deleted by a sweep at most once per burst of the IP limit
+	tats map[string]int64
+	// globalTat is the global theoretical arrival time, it is kept apart from tats so that no IP key can share it
+	globalTat int64
+	// nextSweep is the time in nanoseconds since epoch of the next sweep of tats
+	nextSweep   int64
+	ipLimit     limit
+	globalLimit *limit
+	normalizer  ipkey.Normalizer
+	// persistence is to load and dump the theoretical arrival times
+	persistence persistence.Persistence
+	clock       clock.Clock
+	// dumpMu orders the dumps, which are written without holding mu
+	dumpMu sync.Mutex
+}
+
+// NewGCRA returns a GCRA limiter with the provided configuration.
+// Theoretical arrival times are loaded from dataPersistence, each key is persisted as a single entry
+// with the theoretical arrival time as timestamp and the number of requests counted against it as hits.
+// clk is the time source of the limiter.
+func NewGCRA(config Config, dataPersistence persistence.Persistence, clk clock.Clock) (*GCRA, error) {
+	if config.Rate <= 0 || config.GlobalRate < 0 {
+		return nil, ErrInvalidRate
+	}
+	if config.Period <= 0 || (config.GlobalRate > 0 && config.GlobalPeriod <= 0) {
+		return nil, ErrInvalidPeriod
+	}
+	normalizer, err := ipkey.NewNormalizer(config.IPv4Prefix, config.IPv6Prefix)
+	if err != nil {
+		return nil, err
+	}
+	loadedEntries, err := dataPersistence.Load()
+	if err != nil {
+		return nil, err
+	}
+	g := &GCRA{
+		mu:          sync.Mutex{},
+		tats:        make(map[string]int64),
+		ipLimit:     newLimit(config.Rate, config.Period, config.Burst),
+		normalizer:  normalizer,
+		persistence: dataPersistence,
+		clock:       clk,
+	}
+	if config.GlobalRate > 0 {
+		globalLimit := newLimit(config.GlobalRate, config.GlobalPeriod, config.GlobalBurst)
+		g.globalLimit = &globalLimit
+	}
+	now := clk.Now().UnixNano()
+	for key, entries := range loadedEntries {
+		if len(entries) == 0 || (key == GlobalKey && g.globalLimit == nil) {
+			continue
+		}
+		// a theoretical arrival time in the past is the same as no state at all
+		tat := entries[len(entries)-1].UnixNano()
+		switch {
+		case tat <= now:
+		case key == GlobalKey:
+			g.globalTat = tat
+		default:
+			g.tats[key] = tat
+		}
+	}
+	return g, nil
+}
+
+// Hit records a request for ipAddr if neither the IP limit nor the global limit is reached.
+// The hits of the decision are the requests counted against each limit.
+func (g *GCRA) Hit(ipAddr string) models.Decision {
+	return g.HitN(ipAddr, 1)
+}
+
+// HitN records a request for ipAddr costing cost requests, it is rate limited when either limit has less than cost requests left.
+// Costs below 1 are counted as 1.
+func (g *GCRA) HitN(ipAddr string, cost int64) models.Decision {
+	if cost < 1 {
+		cost = 1
+	}
+	key := g.normalizer.Key(ipAddr)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(g.clock.Now().UnixNano())
+	return g.decide(key, cost, true)
+}
+
+// sweep deletes the keys whose theoretical arrival time is not after now, which is the same as no state at all.
+// A tat is at most a burst of the IP limit ahead of the last request of its key, so sweeping once per burst keeps
+// only the keys hit in the last two bursts while costing a walk of tats per burst. The caller holds mu.
+func (g *GCRA) sweep(now int64) {
+	if now < g.nextSweep {
+		return
+	}
+	for key, tat := range g.tats {
+		if tat <= now {
+			delete(g.tats, key)
+		}
+	}
+	g.nextSweep = now + g.ipLimit.burst*g.ipLimit.emissionInterval
+}
+
+// Peek returns the decision for a request from ipAddr without recording it.
+func (g *GCRA) Peek(ipAddr string) models.Decision {
+	key := g.normalizer.Key(ipAddr)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.decide(key, 1, false)
+}
+
+// decide returns the decision for a request costing cost and records it when record is set and it is allowed
+func (g *GCRA) decide(ipAddr string, cost int64, record bool) models.Decision {
+	now := g.clock.Now().UnixNano()
+	ipAllowAt, ipTat := g.ipLimit.allowAt(g.tats[ipAddr], now, cost)
+	var globalAllowAt, globalTat int64
+	if g.globalLimit != nil {
+		globalAllowAt, globalTat = g.globalLimit.allowAt(g.globalTat, now, cost)
+	}
+
+	decision := models.Decision{Allowed: true}
+	switch {
+	case now < ipAllowAt:
+		decision.Allowed, decision.Reason = false, models.RejectReasonIP
+	case g.globalLimit != nil && now < globalAllowAt:
+		decision.Allowed, decision.Reason = false, models.RejectReasonGlobal
+	case record:
+		g.tats[ipAddr] = ipTat
+		if g.globalLimit != nil {
+			g.globalTat = globalTat
+		}
+	}
+
+	decision.IPHits = g.ipLimit.used(g.tats[ipAddr], now)
+	if g.globalLimit != nil {
+		decision.GlobalHits = g.globalLimit.used(g.globalTat, now)
+	}
+	// report the limit the request is rejected by, or the one with fewer requests left
+	l, resetAt, hits, allowAt := g.ipLimit, g.tats[ipAddr], decision.IPHits, ipAllowAt
+	if g.globalLimit != nil && (decision.Reason == models.RejectReasonGlobal ||
+		(decision.Allowed && g.globalLimit.burst-decision.GlobalHits < g.ipLimit.burst-decision.IPHits)) {
+		l, resetAt, hits, allowAt = *g.globalLimit, g.globalTat, decision.GlobalHits, globalAllowAt
+	}
+	decision.Limit = l.burst
+	decision.Remaining = l.burst - hits
+	if decision.Remaining < 0 {
+		decision.Remaining = 0
+	}
+	if resetAt < now {
+		resetAt = now
+	}
+	decision.ResetAt = time.Unix(0, resetAt)
+	if !decision.Allowed {
+		decision.RetryAfter = time.Duration(allowAt - now)
+	}
+	return decision
+}
+
+// Dump dumps the theoretical arrival times which are still in the future to the underlying persistence storage.
+// The theoretical arrival times are locked only while they are copied, dumps run one at a time.
+func (g *GCRA) Dump() error {
+	g.dumpMu.Lock()
+	defer g.dumpMu.Unlock()
+	g.mu.Lock()
+	now := g.clock.Now().UnixNano()
+	var tatEntries = make(map[string][]models.Entry)
+	for key, tat := range g.tats {
+		if tat > now && key != GlobalKey {
+			tatEntries[key] = []models.Entry{models.NewEntry(time.Unix(0, tat), g.ipLimit.used(tat, now))}
+		}
+	}
+	if g.globalLimit != nil && g.globalTat > now {
+		tatEntries[GlobalKey] = []models.Entry{models.NewEntry(time.Unix(0, g.globalTat), g.globalLimit.used(g.globalTat, now))}
+	}
+	g.mu.Unlock()
+
+	return g.persistence.Dump(tatEntries)
+}
@@ -0,0 +1,330 @@
+package gcra
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/persistence_mock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = Config{Rate: 5, Period: 5 * time.Second}
+
+func TestNewGCRA(t *testing.T) {
+	t.Run("should return error when persistence load fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(nil, errors.New("something failed while loading persisted file"))
+		limiter, err := NewGCRA(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.Error(t, err)
+		assert.Nil(t, limiter)
+	})
+
+	t.Run("should return error on invalid configuration", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		_, err := NewGCRA(Config{Period: time.Second}, mockPersistence, fakeClock)
+		assert.Equal(t, ErrInvalidRate, err)
+		_, err = NewGCRA(Config{Rate: 5}, mockPersistence, fakeClock)
+		assert.Equal(t, ErrInvalidPeriod, err)
+		_, err = NewGCRA(Config{Rate: 5, Period: time.Second, GlobalRate: 10}, mockPersistence, fakeClock)
+		assert.Equal(t, ErrInvalidPeriod, err)
+	})
+
+	t.Run("should keep loaded theoretical arrival times in the future only", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{
+			"10.0.0.1": {{EpochTimestamp: epochNow + 5, Hits: 5}},
+			"10.0.0.2": {{EpochTimestamp: epochNow - 5, Hits: 5}},
+		}, nil)
+		limiter, err := NewGCRA(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"10.0.0.1": (epochNow + 5) * int64(time.Second)}, limiter.tats)
+		decision := limiter.Hit("10.0.0.1")
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, time.Second, limiter.Peek("10.0.0.1").RetryAfter)
+	})
+}
+
+func TestGCRA_Hit(t *testing.T) {
+	t.Run("should allow a burst and report the exact retry after", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		limiter, err := NewGCRA(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 1; i <= 5; i++ {
+			assert.Zero(t, limiter.Peek(ipAddr).RetryAfter)
+			decision := limiter.Hit(ipAddr)
+			assert.Equal(t, int64(i), decision.IPHits)
+			assert.True(t, decision.Allowed)
+		}
+		decision := limiter.Hit(ipAddr)
+		assert.Equal(t, int64(5), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, time.Second, limiter.Peek(ipAddr).RetryAfter)
+		fakeClock.Advance(300 * time.Millisecond)
+		assert.Equal(t, 700*time.Millisecond, limiter.Peek(ipAddr).RetryAfter)
+		decision = limiter.Hit(ipAddr)
+		assert.False(t, decision.Allowed)
+		fakeClock.Advance(700 * time.Millisecond)
+		decision = limiter.Hit(ipAddr)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("should allow a steady rate of one request per emission interval with a smaller burst", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		limiter, err := NewGCRA(Config{Rate: 10, Period: time.Second, Burst: 1}, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 0; i < 20; i++ {
+			decision := limiter.Hit(ipAddr)
+			assert.True(t, decision.Allowed)
+			decision = limiter.Hit(ipAddr)
+			assert.False(t, decision.Allowed)
+			assert.Equal(t, 100*time.Millisecond, limiter.Peek(ipAddr).RetryAfter)
+			fakeClock.Advance(100 * time.Millisecond)
+		}
+	})
+
+	t.Run("should rate limit with global reason and report the global retry after", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := Config{Rate: 5, Period: 5 * time.Second, GlobalRate: 3, GlobalPeriod: 6 * time.Second}
+		limiter, err := NewGCRA(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		limiter.Hit("10.0.0.1")
+		limiter.Hit("10.0.0.2")
+		decision := limiter.Hit("10.0.0.3")
+		assert.Equal(t, int64(3), decision.GlobalHits)
+		assert.True(t, decision.Allowed)
+		decision = limiter.Hit("10.0.0.4")
+		assert.Equal(t, int64(3), decision.GlobalHits)
+		assert.Equal(t, int64(0), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonGlobal, decision.Reason)
+		assert.Equal(t, 2*time.Second, limiter.Peek("10.0.0.4").RetryAfter)
+	})
+
+	t.Run("should rate limit a weighted request until enough of the burst is free", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		limiter, err := NewGCRA(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		decision := limiter.HitN(ipAddr, 4)
+		assert.Equal(t, int64(4), decision.IPHits)
+		assert.True(t, decision.Allowed)
+		decision = limiter.HitN(ipAddr, 3)
+		assert.Equal(t, int64(4), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, 2*time.Second, decision.RetryAfter)
+		fakeClock.Advance(2 * time.Second)
+		decision = limiter.HitN(ipAddr, 3)
+		assert.Equal(t, int64(5), decision.IPHits)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("do concurrent requests and ensure only the burst is allowed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		limiter, err := NewGCRA(Config{Rate: 15, Period: 20 * time.Second}, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				limiter.Hit(ipAddr)
+				limiter.Hit(ipAddr)
+				limiter.Hit(ipAddr)
+			}()
+		}
+		wg.Wait()
+		decision := limiter.Hit(ipAddr)
+		assert.Equal(t, int64(15), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Len(t, limiter.tats, 1)
+	})
+}
+
+func TestGCRA_Sweep(t *testing.T) {
+	t.Run("should delete the keys whose theoretical arrival time has passed once per burst", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		limiter, err := NewGCRA(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			limiter.Hit(fmt.Sprintf("10.0.0.%d", i))
+		}
+		limiter.HitN("10.0.1.1", 5)
+		assert.Len(t, limiter.tats, 101)
+		// the burst of 5 seconds has not passed since the last sweep, the keys idle again are kept
+		fakeClock.Advance(2 * time.Second)
+		limiter.Hit("10.0.1.2")
+		assert.Len(t, limiter.tats, 102)
+		fakeClock.Advance(3 * time.Second)
+		limiter.Hit("10.0.1.3")
+		assert.Equal(t, []string{"10.0.1.3"}, keys(limiter.tats))
+		assert.True(t, limiter.Hit("10.0.0.1").Allowed)
+	})
+}
+
+// keys returns the keys of tats sorted
+func keys(tats map[string]int64) []string {
+	sorted := make([]string, 0, len(tats))
+	for key := range tats {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func TestGCRA_Decision(t *testing.T) {
+	t.Run("should report requests left and the time the key is idle again", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		limiter, err := NewGCRA(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		decision := limiter.HitN("10.0.0.1", 2)
+		assert.Equal(t, models.Decision{Allowed: true, IPHits: 2, Limit: 5, Remaining: 3, ResetAt: time.Unix(epochNow+2, 0)}, decision)
+	})
+
+	t.Run("should peek without recording the request", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		limiter, err := NewGCRA(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			assert.True(t, limiter.Peek("10.0.0.1").Allowed)
+		}
+		assert.Empty(t, limiter.tats)
+	})
+}
+
+func TestGCRA_Dump(t *testing.T) {
+	t.Run("should dump theoretical arrival times in the future", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(epochNow, 0))
+		limiter, err := NewGCRA(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		limiter.Hit("10.0.0.1")
+		limiter.Hit("10.0.0.1")
+		limiter.Hit("10.0.0.1")
+		limiter.Hit("10.0.0.2")
+		fakeClock.Advance(1500 * time.Millisecond)
+		mockPersistence.EXPECT().Dump(map[string][]models.Entry{
+			"10.0.0.1": {{EpochTimestamp: epochNow + 3, Hits: 2}},
+		}).Return(nil)
+		err = limiter.Dump()
+		assert.NoError(t, err)
+	})
+
+	t.Run("should keep an IP keyed GLOBAL apart from the global limit", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil).Times(2)
+		limiter, err := NewGCRA(Config{Rate: 5, Period: time.Second}, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		assert.True(t, limiter.Hit(GlobalKey).Allowed)
+		mockPersistence.EXPECT().Dump(map[string][]models.Entry{}).Return(nil)
+		assert.NoError(t, limiter.Dump())
+
+		limiter, err = NewGCRA(Config{Rate: 5, Period: 5 * time.Second, GlobalRate: 10, GlobalPeriod: 10 * time.Second},
+			mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			assert.True(t, limiter.Hit(GlobalKey).Allowed)
+		}
+		decision := limiter.Hit(GlobalKey)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, int64(5), decision.GlobalHits)
+		mockPersistence.EXPECT().Dump(map[string][]models.Entry{
+			GlobalKey: {{EpochTimestamp: epochNow + 5, Hits: 5}},
+		}).Return(nil)
+		assert.NoError(t, limiter.Dump())
+	})
+
+	t.Run("should return error when persistence returns error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		limiter, err := NewGCRA(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		limiter.Hit("10.0.0.1")
+		mockPersistence.EXPECT().Dump(gomock.Any()).Return(errors.New("some error occurred while dumping"))
+		err = limiter.Dump()
+		assert.EqualError(t, err, "some error occurred while dumping")
+	})
+}
+
+func TestGCRA_Prefix(t *testing.T) {
+	t.Run("should share the limit between the addresses of a network", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := testConfig
+		config.IPv4Prefix, config.IPv6Prefix = 24, 64
+		limiter, err := NewGCRA(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			assert.True(t, limiter.Hit(fmt.Sprintf("2001:db8::%d", i)).Allowed)
+		}
+		assert.False(t, limiter.Hit("2001:db8::ffff").Allowed)
+		assert.True(t, limiter.Peek("2001:db8:0:1::1").Allowed)
+		assert.Equal(t, int64(5), limiter.Peek("2001:db8::1234").IPHits)
+		_, ok := limiter.tats["2001:db8::/64"]
+		assert.True(t, ok)
+	})
+	t.Run("should return error on invalid prefix lengths", func(t *testing.T) {
+		config := testConfig
+		config.IPv6Prefix = 129
+		_, err := NewGCRA(config, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.Error(t, err)
+	})
+}
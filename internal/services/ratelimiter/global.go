@@ -0,0 +1,253 @@
+package ratelimiter
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/counter"
+)
+
+// maxGlobalBuckets bounds the buckets of a stripe of the global counter, long windows get buckets wider than the resolution
+const maxGlobalBuckets = 4096
+
+// globalCounter counts the hits of every key in the global window without a lock shared by the shards.
+// It has a stripe per shard, written only under the lock of its shard, and the count sums the stripes atomically
+// with a few loads per stripe, so checking the global limit costs the same whatever the resolution.
+// Buckets are numbered by their start divided by width.
+type globalCounter struct {
+	windowSize int64
+	// width is the width of the buckets in nanoseconds, the resolution unless the window would need more than maxGlobalBuckets
+	width int64
+	// mask maps the number of a bucket to its index in the ring of a stripe, the rings have a power of two buckets
+	mask    int64
+	stripes []*globalStripe
+	clock   clock.Clock
+	// oldest holds the globalOldest of the last window ExpiresAt(1) was bisected in
+	oldest atomic.Value
+}
+
+// globalOldest is the number of the oldest bucket with hits in the window ending at bucket now. It stays the same while now does,
+// hits are only added to the newest bucket, and it is only read while the window has hits.
+type globalOldest struct {
+	now    int64
+	number int64
+}
+
+// globalStripe is the part of the global window recorded by the requests of one shard, in a ring of buckets.
+// head is the number of the newest bucket, every bucket from the one before the window ending at head up to head is in the ring.
+// Every field is accessed atomically.
+type globalStripe struct {
+	buckets []globalBucket
+	head    int64
+}
+
+// globalBucket is a bucket of a stripe with its number and hits. sum is the running total of the hits of the stripe
+// up to the end of the bucket, so the hits of the stripe between two buckets are the difference of their sums.
+type globalBucket struct {
+	number int64
+	hits   int64
+	sum    int64
+}
+
+// newGlobalCounter returns a globalCounter of windowSize split in stripes, resolution is the width of its buckets.
+// entries are loaded on the first stripe.
+func newGlobalCounter(windowSize, resolution time.Duration, stripes int, entries []models.Entry, clk clock.Clock) *globalCounter {
+	if windowSize <= 0 {
+		windowSize = counter.DefaultWindowSize
+	}
+	if resolution <= 0 {
+		resolution = counter.DefaultResolution
+	}
+	if resolution > windowSize {
+		resolution = windowSize
+	}
+	width := int64(resolution)
+	if int64(windowSize)/width > maxGlobalBuckets/2-2 {
+		width = int64(windowSize)/(maxGlobalBuckets/2-2) + 1
+	}
+	// every bucket from the one before the window ending at the newest bucket up to it has its own bucket
+	size := int64(1)
+	for size < int64(windowSize)/width+2 {
+		size *= 2
+	}
+	g := &globalCounter{
+		windowSize: int64(windowSize),
+		width:      width,
+		mask:       size - 1,
+		stripes:    make([]*globalStripe, stripes),
+		clock:      clk,
+	}
+	for i := range g.stripes {
+		g.stripes[i] = &globalStripe{buckets: make([]globalBucket, size)}
+	}
+	now := g.now()
+	for _, entry := range entries {
+		if start := entry.UnixNano() - entry.UnixNano()%width; start >= now-g.windowSize && start <= now {
+			g.add(0, start, entry.Hits)
+		}
+	}
+	return g
+}
+
+// now returns the start of the current bucket in nanoseconds since epoch
+func (g *globalCounter) now() int64 {
+	now := g.clock.Now().UnixNano()
+	return now - now%g.width
+}
+
+// bucket returns the bucket of stripe s numbered number
+func (g *globalCounter) bucket(s *globalStripe, number int64) *globalBucket {
+	return &s.buckets[number&g.mask]
+}
+
+// add records hits in the bucket starting at start of stripe, or in its newest bucket when start is before it.
+// Negative hits take back hits added to the same bucket. The caller holds the lock of the shard of stripe.
+func (g *globalCounter) add(stripe int, start, hits int64) {
+	s := g.stripes[stripe]
+	number := start / g.width
+	head := atomic.LoadInt64(&s.head)
+	if number < head {
+		number = head
+	}
+	if number > head {
+		// the buckets between head and number got no hits, they carry the sum of head on,
+		// only the buckets the ring holds up to number are written
+		sum := atomic.LoadInt64(&g.bucket(s, head).sum)
+		from := head + 1
+		if oldest := number - g.mask; from < oldest {
+			from = oldest
+		}
+		for n := from; n <= number; n++ {
+			bucket := g.bucket(s, n)
+			atomic.StoreInt64(&bucket.hits, 0)
+			atomic.StoreInt64(&bucket.sum, sum)
+			atomic.StoreInt64(&bucket.number, n)
+		}
+		atomic.StoreInt64(&s.head, number)
+	}
+	bucket := g.bucket(s, number)
+	atomic.AddInt64(&bucket.hits, hits)
+	atomic.AddInt64(&bucket.sum, hits)
+}
+
+// before returns the number of the bucket before the oldest bucket in the window ending at now
+func (g *globalCounter) before(now int64) int64 {
+	first := now - g.windowSize
+	if rem := first % g.width; rem != 0 {
+		first += g.width - rem
+	}
+	return first/g.width - 1
+}
+
+// sumAt returns the running total of the hits of stripe s with newest bucket head up to the end of bucket number.
+// Buckets before the ring of s are not read, the hits of s between two of them are 0 either way.
+func (g *globalCounter) sumAt(s *globalStripe, head, number int64) int64 {
+	if number >= head {
+		return atomic.LoadInt64(&g.bucket(s, head).sum)
+	}
+	if bucket := g.bucket(s, number); atomic.LoadInt64(&bucket.number) == number {
+		return atomic.LoadInt64(&bucket.sum)
+	}
+	// the stripe got its first hits after bucket number
+	return 0
+}
+
+// hits returns the hits of every stripe after bucket before up to the end of bucket number
+func (g *globalCounter) hits(before, number int64) int64 {
+	var hits int64
+	for _, s := range g.stripes {
+		if head := atomic.LoadInt64(&s.head); head > before {
+			hits += g.sumAt(s, head, number) - g.sumAt(s, head, before)
+		}
+	}
+	return hits
+}
+
+// any reports whether a stripe has hits after bucket before up to the end of bucket number
+func (g *globalCounter) any(before, number int64) bool {
+	for _, s := range g.stripes {
+		if head := atomic.LoadInt64(&s.head); head > before && g.sumAt(s, head, number) > g.sumAt(s, head, before) {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns the hits of every stripe in the window ending at now
+func (g *globalCounter) count(now int64) int64 {
+	return g.hits(g.before(now), now/g.width)
+}
+
+// Count returns the hits in the window.
+func (g *globalCounter) Count() int64 {
+	return g.count(g.now())
+}
+
+// Window returns the buckets in the window with the hits of every stripe, oldest first.
+func (g *globalCounter) Window() []models.Entry {
+	now := g.now()
+	before, newest := g.before(now), now/g.width
+	hits := make(map[int64]int64)
+	for _, s := range g.stripes {
+		for i := range s.buckets {
+			bucket := &s.buckets[i]
+			if number := atomic.LoadInt64(&bucket.number); number > before && number <= newest {
+				hits[number] += atomic.LoadInt64(&bucket.hits)
+			}
+		}
+	}
+	window := make([]models.Entry, 0, len(hits))
+	for number, bucketHits := range hits {
+		if bucketHits > 0 {
+			window = append(window, models.NewEntry(time.Unix(0, number*g.width), bucketHits))
+		}
+	}
+	sort.Slice(window, func(i, j int) bool { return window[i].UnixNano() < window[j].UnixNano() })
+	return window
+}
+
+// ExpiresAt returns the time at which at least n of the hits in the window will have slid out of it, like Counter.ExpiresAt.
+// The hits up to a bucket grow with its number, so the bucket they reach n in is found by bisecting the window.
+func (g *globalCounter) ExpiresAt(n int64) time.Time {
+	if n <= 0 {
+		return g.clock.Now()
+	}
+	now := g.now() / g.width
+	before := g.before(now * g.width)
+	// ExpiresAt(1) reports the reset of every decision limited by the global limit, it is bisected once per bucket
+	if oldest, ok := g.oldest.Load().(globalOldest); ok && n == 1 && oldest.now == now {
+		if !g.any(before, now) {
+			return g.clock.Now()
+		}
+		return g.expiry(oldest.number)
+	}
+	total := g.hits(before, now)
+	if total <= 0 {
+		return g.clock.Now()
+	}
+	if n > total {
+		// every hit expires once the newest bucket with hits does
+		n = total
+	}
+	lo, hi := before+1, now
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if g.hits(before, mid) >= n {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if n == 1 {
+		g.oldest.Store(globalOldest{now: now, number: lo})
+	}
+	return g.expiry(lo)
+}
+
+// expiry returns the time bucket number slides out of the window
+func (g *globalCounter) expiry(number int64) time.Time {
+	return time.Unix(0, number*g.width+g.windowSize+g.width)
+}
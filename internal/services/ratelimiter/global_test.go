@@ -0,0 +1,164 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/persistence_mock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/counter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobalCounter(t *testing.T) {
+	t.Run("should sum the stripes and slide the hits of idle stripes out of the window", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		global := newGlobalCounter(10*time.Second, time.Second, 4, nil, fakeClock)
+		global.add(0, global.now(), 2)
+		fakeClock.Advance(5 * time.Second)
+		global.add(1, global.now(), 3)
+		global.add(2, global.now(), 1)
+		assert.Equal(t, int64(6), global.Count())
+		fakeClock.Advance(6 * time.Second)
+		// the hits of stripe 0 slid out of the window without stripe 0 being hit again
+		assert.Equal(t, int64(4), global.Count())
+		global.add(1, global.now(), 1)
+		assert.Equal(t, int64(5), global.Count())
+		fakeClock.Advance(20 * time.Second)
+		assert.Zero(t, global.Count())
+		// the ring of stripe 0 wrapped around since its last hit
+		global.add(0, global.now(), 1)
+		assert.Equal(t, int64(1), global.Count())
+		fakeClock.Advance(time.Second)
+		global.add(3, global.now(), 2)
+		assert.Equal(t, int64(3), global.Count())
+		fakeClock.Advance(10 * time.Second)
+		assert.Equal(t, int64(2), global.Count())
+	})
+	t.Run("should count and expire the same as a counter of the window", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		global := newGlobalCounter(10*time.Second, 500*time.Millisecond, 3, nil, fakeClock)
+		reference := counter.NewCounterService(10*time.Second, 500*time.Millisecond, nil, fakeClock)
+		for i := 0; i < 200; i++ {
+			hits := int64(i%4 + 1)
+			global.add(i%3, global.now(), hits)
+			reference.HitN(hits)
+			assert.Equal(t, reference.Count(), global.Count(), "hit %d", i)
+			for _, n := range []int64{1, 7, 1000} {
+				assert.Equal(t, reference.ExpiresAt(n), global.ExpiresAt(n), "hit %d, n %d", i, n)
+			}
+			fakeClock.Advance(time.Duration(i%7) * 300 * time.Millisecond)
+		}
+	})
+	t.Run("should take back hits", func(t *testing.T) {
+		global := newGlobalCounter(10*time.Second, time.Second, 2, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		start := global.now()
+		global.add(1, start, 3)
+		global.add(1, start, -3)
+		assert.Zero(t, global.Count())
+		assert.Empty(t, global.Window())
+	})
+	t.Run("should load entries and merge the stripes in the window", func(t *testing.T) {
+		now := int64(1624974458)
+		fakeClock := clock.NewFakeClock(time.Unix(now, 0))
+		global := newGlobalCounter(10*time.Second, time.Second, 2, []models.Entry{{EpochTimestamp: now - 20, Hits: 7}, {EpochTimestamp: now - 5, Hits: 2}}, fakeClock)
+		global.add(1, global.now(), 1)
+		global.add(1, global.now()-int64(5*time.Second), 1)
+		assert.Equal(t, []models.Entry{{EpochTimestamp: now - 5, Hits: 2}, {EpochTimestamp: now, Hits: 2}}, global.Window(),
+			"hits added before the newest bucket of a stripe are added to it")
+		assert.Equal(t, time.Unix(now+6, 0), global.ExpiresAt(1))
+		assert.Equal(t, time.Unix(now+11, 0), global.ExpiresAt(3))
+		assert.Equal(t, time.Unix(now+11, 0), global.ExpiresAt(10))
+	})
+	t.Run("should widen the buckets of long windows", func(t *testing.T) {
+		global := newGlobalCounter(24*time.Hour, time.Second, 1, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.LessOrEqual(t, len(global.stripes[0].buckets), maxGlobalBuckets)
+		assert.GreaterOrEqual(t, global.width*int64(len(global.stripes[0].buckets)), int64(24*time.Hour))
+	})
+}
+
+func TestRateLimiter_GlobalLimit(t *testing.T) {
+	t.Run("should not count the global window when the global limit is disabled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := testConfig
+		config.GlobalAllowedRate = 0
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.True(t, decision.Allowed)
+		assert.Zero(t, decision.GlobalHits)
+		assert.Zero(t, rateLimiterService.global.Count())
+	})
+	t.Run("do concurrent requests from IPs on every shard and ensure the global limit holds", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		rateLimiterService, err := NewRateLimiter(globalLimitConfig(100), mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		var allowed int64
+		var mu sync.Mutex
+		wg := sync.WaitGroup{}
+		for i := 0; i < 64; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					if rateLimiterService.Hit(fmt.Sprintf("10.0.%d.%d", i, j)).Allowed {
+						mu.Lock()
+						allowed++
+						mu.Unlock()
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.LessOrEqual(t, allowed, int64(100))
+		assert.Equal(t, allowed, rateLimiterService.global.Count())
+		decision := rateLimiterService.Peek("10.1.0.1")
+		assert.Equal(t, allowed, decision.GlobalHits)
+	})
+}
+
+// BenchmarkGlobalCounter compares recording and checking a hit on the striped global counter from every shard
+// with a single counter behind a lock shared by the shards. Run with -cpu 1,2,4,8 to see the scaling.
+func BenchmarkGlobalCounter(b *testing.B) {
+	b.Run("striped", func(b *testing.B) {
+		global := newGlobalCounter(time.Minute, time.Second, DefaultShards, nil, clock.RealClock{})
+		shards := make([]sync.Mutex, DefaultShards)
+		var next int64
+		var nextMu sync.Mutex
+		b.RunParallel(func(pb *testing.PB) {
+			nextMu.Lock()
+			stripe := int(next % DefaultShards)
+			next++
+			nextMu.Unlock()
+			for pb.Next() {
+				shards[stripe].Lock()
+				start := global.now()
+				global.add(stripe, start, 1)
+				global.count(start)
+				shards[stripe].Unlock()
+			}
+		})
+	})
+	b.Run("locked", func(b *testing.B) {
+		global := counter.NewCounterService(time.Minute, time.Second, nil, clock.RealClock{})
+		var mu sync.Mutex
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mu.Lock()
+				global.Count()
+				global.HitN(1)
+				mu.Unlock()
+			}
+		})
+	})
+}
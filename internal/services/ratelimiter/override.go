@@ -0,0 +1,174 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverrideAction is what an override does with the requests of the keys it matches.
+type OverrideAction string
+
+const (
+	// OverrideLimit limits each matched key to the AllowedRate and WindowSize of the override.
+	OverrideLimit OverrideAction = "limit"
+	// OverrideUnlimited allows every request of the matched keys without counting it.
+	OverrideUnlimited OverrideAction = "unlimited"
+	// OverrideDeny rejects every request of the matched keys.
+	OverrideDeny OverrideAction = "deny"
+)
+
+// Override replaces the IP limit for a key or for every IP in a CIDR.
+// An exact key takes precedence over CIDRs and a longer prefix over a shorter one.
+type Override struct {
+	// Key is an exact key, like 203.0.113.7, or a CIDR, like 10.0.0.0/8.
+	Key string
+	// Action is what the override does, defaults to OverrideLimit.
+	Action OverrideAction
+	// AllowedRate is the number of requests allowed for each matched key in WindowSize with OverrideLimit.
+	AllowedRate int64
+	// WindowSize is the window of OverrideLimit, defaults to the IP window size of the RateLimiter.
+	WindowSize time.Duration
+}
+
+// overrides looks up the override of a key
+type overrides struct {
+	exact map[string]Override
+	// networks are sorted from the longest prefix to the shortest
+	networks []network
+}
+
+// network is an override of a CIDR
+type network struct {
+	ipNet    *net.IPNet
+	prefix   int
+	override Override
+}
+
+// newOverrides validates list and returns the overrides lookup, window sizes of OverrideLimit default to windowSize
+func newOverrides(list []Override, windowSize time.Duration) (*overrides, error) {
+	o := &overrides{exact: make(map[string]Override)}
+	for _, override := range list {
+		if override.Action == "" {
+			override.Action = OverrideLimit
+		}
+		switch override.Action {
+		case OverrideLimit:
+			if override.AllowedRate <= 0 {
+				return nil, fmt.Errorf("override %s: allowed rate must be positive", override.Key)
+			}
+			if override.WindowSize < 0 {
+				return nil, fmt.Errorf("override %s: window size must not be negative", override.Key)
+			}
+			if override.WindowSize == 0 {
+				override.WindowSize = windowSize
+			}
+		case OverrideUnlimited, OverrideDeny:
+		default:
+			return nil, fmt.Errorf("override %s: unknown action %s", override.Key, override.Action)
+		}
+		if !strings.Contains(override.Key, "/") {
+			if override.Key == "" {
+				return nil, fmt.Errorf("override key must not be empty")
+			}
+			o.exact[override.Key] = override
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(override.Key)
+		if err != nil {
+			return nil, fmt.Errorf("override %s: %s", override.Key, err.Error())
+		}
+		prefix, _ := ipNet.Mask.Size()
+		o.networks = append(o.networks, network{ipNet: ipNet, prefix: prefix, override: override})
+	}
+	sort.SliceStable(o.networks, func(i, j int) bool {
+		return o.networks[i].prefix > o.networks[j].prefix
+	})
+	return o, nil
+}
+
+// match returns the override of key, the exact override or the one of the most specific CIDR holding it.
+// The key of a network, like 203.0.113.0/24, matches the CIDRs holding the whole network.
+func (o *overrides) match(key string) (Override, bool) {
+	if o == nil {
+		return Override{}, false
+	}
+	if override, ok := o.exact[key]; ok {
+		return override, true
+	}
+	if len(o.networks) == 0 {
+		return Override{}, false
+	}
+	ip, prefix := net.ParseIP(key), -1
+	if ip == nil {
+		_, keyNet, err := net.ParseCIDR(key)
+		if err != nil {
+			return Override{}, false
+		}
+		ip = keyNet.IP
+		prefix, _ = keyNet.Mask.Size()
+	}
+	for _, n := range o.networks {
+		if (prefix < 0 || n.prefix <= prefix) && n.ipNet.Contains(ip) {
+			return n.override, true
+		}
+	}
+	return Override{}, false
+}
+
+// longestWindow returns the longest window of the OverrideLimit overrides, 0 without any
+func (o *overrides) longestWindow() time.Duration {
+	var longest time.Duration
+	if o == nil {
+		return longest
+	}
+	for _, override := range o.exact {
+		if override.Action == OverrideLimit && override.WindowSize > longest {
+			longest = override.WindowSize
+		}
+	}
+	for _, n := range o.networks {
+		if n.override.Action == OverrideLimit && n.override.WindowSize > longest {
+			longest = n.override.WindowSize
+		}
+	}
+	return longest
+}
+
+// ParseOverrides parses comma separated overrides of the form key=action, the action being deny, unlimited
+// or a limit of rate/window, like 10.0.0.0/8=unlimited,203.0.113.7=500/1m,198.51.100.0/24=deny.
+func ParseOverrides(s string) ([]Override, error) {
+	var list []Override
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("override %q: expected key=action", field)
+		}
+		override := Override{Key: strings.TrimSpace(parts[0])}
+		switch action := strings.TrimSpace(parts[1]); action {
+		case string(OverrideDeny), string(OverrideUnlimited):
+			override.Action = OverrideAction(action)
+		default:
+			limit := strings.SplitN(action, "/", 2)
+			rate, err := strconv.ParseInt(limit[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("override %q: invalid rate %s", field, limit[0])
+			}
+			override.Action, override.AllowedRate = OverrideLimit, rate
+			if len(limit) == 2 {
+				if override.WindowSize, err = time.ParseDuration(limit[1]); err != nil {
+					return nil, fmt.Errorf("override %q: invalid window %s", field, limit[1])
+				}
+			}
+		}
+		list = append(list, override)
+	}
+	return list, nil
+}
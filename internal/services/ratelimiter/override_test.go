@@ -0,0 +1,64 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOverrides(t *testing.T) {
+	t.Run("should parse deny, unlimited and rate overrides", func(t *testing.T) {
+		overrides, err := ParseOverrides("10.0.0.0/8=unlimited, 203.0.113.7=500/1m,198.51.100.0/24=deny,192.0.2.1=5")
+		assert.NoError(t, err)
+		assert.Equal(t, []Override{
+			{Key: "10.0.0.0/8", Action: OverrideUnlimited},
+			{Key: "203.0.113.7", Action: OverrideLimit, AllowedRate: 500, WindowSize: time.Minute},
+			{Key: "198.51.100.0/24", Action: OverrideDeny},
+			{Key: "192.0.2.1", Action: OverrideLimit, AllowedRate: 5},
+		}, overrides)
+	})
+	t.Run("should return error on malformed overrides", func(t *testing.T) {
+		for _, s := range []string{"10.0.0.1", "10.0.0.1=fast", "10.0.0.1=5/soon"} {
+			_, err := ParseOverrides(s)
+			assert.Error(t, err, s)
+		}
+	})
+}
+
+func TestOverrides_Match(t *testing.T) {
+	o, err := newOverrides([]Override{
+		{Key: "10.0.0.0/8", Action: OverrideUnlimited},
+		{Key: "10.1.0.0/16", AllowedRate: 100},
+		{Key: "10.1.2.3", Action: OverrideDeny},
+		{Key: "2001:db8::/32", AllowedRate: 50, WindowSize: time.Second},
+	}, 20*time.Second)
+	assert.NoError(t, err)
+	tests := []struct {
+		key      string
+		expected Override
+		matched  bool
+	}{
+		{key: "10.1.2.3", expected: Override{Key: "10.1.2.3", Action: OverrideDeny}, matched: true},
+		{key: "10.1.2.4", expected: Override{Key: "10.1.0.0/16", Action: OverrideLimit, AllowedRate: 100, WindowSize: 20 * time.Second}, matched: true},
+		{key: "10.2.0.1", expected: Override{Key: "10.0.0.0/8", Action: OverrideUnlimited}, matched: true},
+		{key: "2001:db8::1", expected: Override{Key: "2001:db8::/32", Action: OverrideLimit, AllowedRate: 50, WindowSize: time.Second}, matched: true},
+		{key: "10.1.2.0/24", expected: Override{Key: "10.1.0.0/16", Action: OverrideLimit, AllowedRate: 100, WindowSize: 20 * time.Second}, matched: true},
+		{key: "10.0.0.0/4"},
+		{key: "192.0.2.1"},
+		{key: "not-an-ip"},
+	}
+	for _, tt := range tests {
+		t.Run("should match the most specific override of "+tt.key, func(t *testing.T) {
+			override, ok := o.match(tt.key)
+			assert.Equal(t, tt.matched, ok)
+			assert.Equal(t, tt.expected, override)
+		})
+	}
+	t.Run("should return error on invalid overrides", func(t *testing.T) {
+		for _, override := range []Override{{Key: "10.0.0.0/33", Action: OverrideDeny}, {Key: "10.0.0.1"}, {Key: "10.0.0.1", Action: "throttle"}, {Action: OverrideDeny}} {
+			_, err := newOverrides([]Override{override}, time.Second)
+			assert.Error(t, err, override.Key)
+		}
+	})
+}
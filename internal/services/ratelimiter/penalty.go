@@ -0,0 +1,171 @@
+package ratelimiter
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/counter"
+)
+
+// PenaltyKeyPrefix prefixes the persisted keys of penalties, like PENALTY:10.0.0.1.
+// A penalty is persisted as a single entry holding the end of the last ban and the number of offences as hits.
+const PenaltyKeyPrefix = "PENALTY:"
+
+// DefaultMaxBanDuration caps the bans when Penalty.MaxBanDuration is not set.
+const DefaultMaxBanDuration = 24 * time.Hour
+
+// Penalty configures the penalty box, a key rejected by its IP limit Violations times within Within
+// is banned for BanDuration, each further offence doubles the ban up to MaxBanDuration.
+type Penalty struct {
+	// Violations is the number of rejections within Within which ban a key, 0 disables the penalty box.
+	Violations int64
+	Within     time.Duration
+	// BanDuration is the length of the first ban of a key.
+	BanDuration time.Duration
+	// MaxBanDuration caps the doubled bans, defaults to DefaultMaxBanDuration or BanDuration when it is longer.
+	MaxBanDuration time.Duration
+	// ForgetAfter is the time after the end of a ban when the offences of a key are forgotten, defaults to MaxBanDuration.
+	ForgetAfter time.Duration
+}
+
+// withDefaults returns the penalty with MaxBanDuration and ForgetAfter set
+func (p Penalty) withDefaults() Penalty {
+	if p.MaxBanDuration <= 0 {
+		p.MaxBanDuration = DefaultMaxBanDuration
+		if p.BanDuration > p.MaxBanDuration {
+			p.MaxBanDuration = p.BanDuration
+		}
+	}
+	if p.ForgetAfter <= 0 {
+		p.ForgetAfter = p.MaxBanDuration
+	}
+	return p
+}
+
+// validate returns an error when an enabled penalty has no window or no ban, or bans are capped below BanDuration
+func (p Penalty) validate() error {
+	switch {
+	case p.Violations < 0:
+		return errors.New("penalty violations must not be negative")
+	case p.Violations == 0:
+		return nil
+	case p.Within <= 0:
+		return errors.New("penalty window must be positive")
+	case p.BanDuration <= 0:
+		return errors.New("penalty ban duration must be positive")
+	case p.MaxBanDuration > 0 && p.MaxBanDuration < p.BanDuration:
+		return errors.New("penalty max ban duration must not be shorter than the ban duration")
+	}
+	return nil
+}
+
+// banDuration returns the length of the ban for the offences-th offence
+func (p Penalty) banDuration(offences int64) time.Duration {
+	duration := p.BanDuration
+	for i := int64(1); i < offences && duration < p.MaxBanDuration; i++ {
+		duration *= 2
+	}
+	if duration > p.MaxBanDuration {
+		duration = p.MaxBanDuration
+	}
+	return duration
+}
+
+// penalty holds the recent rejections of a key and its bans
+type penalty struct {
+	// violations counts the rejections of the key within Penalty.Within, nil until the key is first rejected
+	violations  services.CounterServiceInterface
+	offences    int64
+	bannedUntil time.Time
+}
+
+// banned returns the decision for a request of key if it is banned, the caller holds the lock of ipShard
+func (r *RateLimiter) banned(ipShard *shard, key string, windows []Window, now time.Time) (models.Decision, bool) {
+	keyPenalty, ok := ipShard.penalties[key]
+	if !ok || !now.Before(keyPenalty.bannedUntil) {
+		return models.Decision{}, false
+	}
+	return models.Decision{
+		Reason:     models.RejectReasonBanned,
+		GlobalHits: r.globalHits(),
+		Limit:      windows[0].AllowedRate,
+		Window:     windows[0].Size,
+		ResetAt:    keyPenalty.bannedUntil,
+		RetryAfter: keyPenalty.bannedUntil.Sub(now),
+	}, true
+}
+
+// violate records a rejection of key by its IP limit and bans it once it has Penalty.Violations rejections within Penalty.Within,
+// it returns whether the key got banned. The caller holds the lock of ipShard.
+func (r *RateLimiter) violate(ipShard *shard, key string, now time.Time) bool {
+	keyPenalty, ok := ipShard.penalties[key]
+	if !ok {
+		keyPenalty = &penalty{}
+		ipShard.penalties[key] = keyPenalty
+	}
+	if keyPenalty.violations == nil {
+		keyPenalty.violations = counter.New(counter.ModeExact, r.penalty.Within, r.resolution, []models.Entry{}, r.clock)
+	}
+	if keyPenalty.violations.Hit() < r.penalty.Violations {
+		return false
+	}
+	keyPenalty.offences++
+	keyPenalty.bannedUntil = now.Add(r.penalty.banDuration(keyPenalty.offences))
+	keyPenalty.violations = nil
+	return true
+}
+
+// forgotten returns whether the penalty of a key has no ban, no recent rejection and no offence to remember at now
+func (r *RateLimiter) forgotten(keyPenalty *penalty, now time.Time) bool {
+	if keyPenalty.violations != nil && keyPenalty.violations.Count() > 0 {
+		return false
+	}
+	return keyPenalty.offences == 0 || !now.Before(keyPenalty.bannedUntil.Add(r.penalty.ForgetAfter))
+}
+
+// evictPenalties drops the forgotten penalties of ipShard
+func (r *RateLimiter) evictPenalties(ipShard *shard, now time.Time) {
+	ipShard.mu.Lock()
+	defer ipShard.mu.Unlock()
+	for key, keyPenalty := range ipShard.penalties {
+		if r.forgotten(keyPenalty, now) {
+			delete(ipShard.penalties, key)
+		}
+	}
+}
+
+// Bans returns the keys banned at the moment ordered by key.
+func (r *RateLimiter) Bans() []models.Ban {
+	now := r.clock.Now()
+	bans := []models.Ban{}
+	for _, ipShard := range r.shards {
+		ipShard.mu.Lock()
+		for key, keyPenalty := range ipShard.penalties {
+			if now.Before(keyPenalty.bannedUntil) {
+				bans = append(bans, models.Ban{Key: key, Until: keyPenalty.bannedUntil, Offences: keyPenalty.offences})
+			}
+		}
+		ipShard.mu.Unlock()
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Key < bans[j].Key
+	})
+	return bans
+}
+
+// Unban lifts the ban of key and forgets its offences, key is an IP address or a key listed by Bans.
+// It returns false when key has no penalty.
+func (r *RateLimiter) Unban(key string) bool {
+	ipShard := r.shard(key)
+	ipShard.mu.Lock()
+	defer ipShard.mu.Unlock()
+	key, _, _ = r.key(key)
+	if _, ok := ipShard.penalties[key]; !ok {
+		return false
+	}
+	delete(ipShard.penalties, key)
+	return true
+}
@@ -0,0 +1,168 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/persistence_mock"
+	"github.com/stretchr/testify/assert"
+)
+
+// penaltyConfig bans an IP for a minute after 3 rejections within 10 seconds, doubling up to 3 minutes
+func penaltyConfig() Config {
+	config := testConfig
+	config.AllowedRate = 2
+	config.Penalty = Penalty{Violations: 3, Within: 10 * time.Second, BanDuration: time.Minute, MaxBanDuration: 3 * time.Minute}
+	return config
+}
+
+// newPenaltyRateLimiter returns a rate limiter of config loading loaded
+func newPenaltyRateLimiter(t *testing.T, config Config, loaded map[string][]models.Entry, fakeClock *clock.FakeClock) (*RateLimiter, *persistence_mock.MockPersistence) {
+	ctrl := gomock.NewController(t)
+	mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+	mockPersistence.EXPECT().Load().Return(loaded, nil)
+	rateLimiterService, err := NewRateLimiter(config, mockPersistence, fakeClock)
+	assert.NoError(t, err)
+	return rateLimiterService, mockPersistence
+}
+
+// offend hits ipAddr until it is banned and returns the banning decision
+func offend(rateLimiterService *RateLimiter, ipAddr string) models.Decision {
+	for {
+		if decision := rateLimiterService.Hit(ipAddr); decision.Reason == models.RejectReasonBanned {
+			return decision
+		}
+	}
+}
+
+func TestRateLimiter_Penalty(t *testing.T) {
+	t.Run("should ban a key after repeated rejections until the ban ends", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, _ := newPenaltyRateLimiter(t, penaltyConfig(), map[string][]models.Entry{}, fakeClock)
+		assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		assert.Equal(t, models.RejectReasonIP, rateLimiterService.Hit("10.0.0.1").Reason)
+		assert.Equal(t, models.RejectReasonIP, rateLimiterService.Hit("10.0.0.1").Reason)
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.Equal(t, models.RejectReasonBanned, decision.Reason)
+		assert.Equal(t, time.Minute, decision.RetryAfter)
+		assert.Equal(t, int64(2), decision.Limit)
+		assert.Equal(t, models.RejectReasonBanned, rateLimiterService.Peek("10.0.0.1").Reason)
+		assert.True(t, rateLimiterService.Hit("10.0.0.2").Allowed)
+		fakeClock.Advance(59 * time.Second)
+		decision = rateLimiterService.Hit("10.0.0.1")
+		assert.Equal(t, models.RejectReasonBanned, decision.Reason)
+		assert.Equal(t, time.Second, decision.RetryAfter)
+		fakeClock.Advance(time.Second)
+		assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+	})
+	t.Run("should not ban on rejections spread beyond the penalty window", func(t *testing.T) {
+		config := penaltyConfig()
+		config.IPWindowSize = time.Hour
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, _ := newPenaltyRateLimiter(t, config, map[string][]models.Entry{}, fakeClock)
+		rateLimiterService.HitN("10.0.0.1", 2)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, models.RejectReasonIP, rateLimiterService.Hit("10.0.0.1").Reason)
+			fakeClock.Advance(6 * time.Second)
+		}
+	})
+	t.Run("should not count global rejections", func(t *testing.T) {
+		config := penaltyConfig()
+		config.GlobalAllowedRate = 1
+		rateLimiterService, _ := newPenaltyRateLimiter(t, config, map[string][]models.Entry{}, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		rateLimiterService.Hit("10.0.0.2")
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, models.RejectReasonGlobal, rateLimiterService.Hit("10.0.0.1").Reason)
+		}
+		assert.Empty(t, rateLimiterService.Bans())
+	})
+	t.Run("should double the ban on repeat offences up to the max ban duration", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, _ := newPenaltyRateLimiter(t, penaltyConfig(), map[string][]models.Entry{}, fakeClock)
+		for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+			assert.Equal(t, expected, offend(rateLimiterService, "10.0.0.1").RetryAfter)
+			fakeClock.Advance(expected)
+		}
+	})
+	t.Run("should forget the offences after forget after", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, _ := newPenaltyRateLimiter(t, penaltyConfig(), map[string][]models.Entry{}, fakeClock)
+		offend(rateLimiterService, "10.0.0.1")
+		fakeClock.Advance(time.Minute + 3*time.Minute)
+		rateLimiterService.EvictIdle()
+		assert.Empty(t, rateLimiterService.shard("10.0.0.1").penalties)
+		assert.Equal(t, time.Minute, offend(rateLimiterService, "10.0.0.1").RetryAfter)
+	})
+	t.Run("should return error on invalid penalties", func(t *testing.T) {
+		for _, penalty := range []Penalty{
+			{Violations: -1},
+			{Violations: 3, BanDuration: time.Minute},
+			{Violations: 3, Within: time.Second},
+			{Violations: 3, Within: time.Second, BanDuration: time.Minute, MaxBanDuration: time.Second},
+		} {
+			config := testConfig
+			config.Penalty = penalty
+			_, err := NewRateLimiter(config, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestRateLimiter_Penalty_Persistence(t *testing.T) {
+	t.Run("should dump bans and remembered offences and load them back", func(t *testing.T) {
+		now := time.Unix(1624974458, 0)
+		fakeClock := clock.NewFakeClock(now)
+		rateLimiterService, mockPersistence := newPenaltyRateLimiter(t, penaltyConfig(), map[string][]models.Entry{
+			PenaltyKeyPrefix + "10.0.0.2": {models.NewEntry(now.Add(-time.Minute), 2)},
+			PenaltyKeyPrefix + "10.0.0.3": {models.NewEntry(now.Add(-time.Hour), 1)},
+		}, fakeClock)
+		offend(rateLimiterService, "10.0.0.1")
+		mockPersistence.EXPECT().Dump(gomock.Any()).DoAndReturn(func(entries map[string][]models.Entry) error {
+			assert.Equal(t, []models.Entry{models.NewEntry(now.Add(time.Minute), 1)}, entries[PenaltyKeyPrefix+"10.0.0.1"])
+			assert.Equal(t, []models.Entry{models.NewEntry(now.Add(-time.Minute), 2)}, entries[PenaltyKeyPrefix+"10.0.0.2"])
+			assert.NotContains(t, entries, PenaltyKeyPrefix+"10.0.0.3")
+			return nil
+		})
+		assert.NoError(t, rateLimiterService.Dump())
+
+		loaded, _ := newPenaltyRateLimiter(t, penaltyConfig(), map[string][]models.Entry{
+			PenaltyKeyPrefix + "10.0.0.1": {models.NewEntry(now.Add(time.Minute), 1)},
+		}, fakeClock)
+		decision := loaded.Hit("10.0.0.1")
+		assert.Equal(t, models.RejectReasonBanned, decision.Reason)
+		assert.Equal(t, time.Minute, decision.RetryAfter)
+		assert.True(t, tracked(loaded, "10.0.0.1"))
+	})
+	t.Run("should drop persisted penalties when the penalty box is disabled", func(t *testing.T) {
+		now := time.Unix(1624974458, 0)
+		rateLimiterService, _ := newPenaltyRateLimiter(t, testConfig, map[string][]models.Entry{
+			PenaltyKeyPrefix + "10.0.0.1": {models.NewEntry(now.Add(time.Minute), 1)},
+		}, clock.NewFakeClock(now))
+		assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		assert.Empty(t, rateLimiterService.Bans())
+	})
+}
+
+func TestRateLimiter_Bans(t *testing.T) {
+	t.Run("should list the banned keys and lift a ban", func(t *testing.T) {
+		now := time.Unix(1624974458, 0)
+		config := penaltyConfig()
+		config.IPv4Prefix = 24
+		rateLimiterService, _ := newPenaltyRateLimiter(t, config, map[string][]models.Entry{}, clock.NewFakeClock(now))
+		offend(rateLimiterService, "203.0.113.7")
+		offend(rateLimiterService, "10.0.0.1")
+		assert.Equal(t, []models.Ban{
+			{Key: "10.0.0.0/24", Until: now.Add(time.Minute), Offences: 1},
+			{Key: "203.0.113.0/24", Until: now.Add(time.Minute), Offences: 1},
+		}, rateLimiterService.Bans())
+		assert.True(t, rateLimiterService.Unban("203.0.113.9"))
+		assert.True(t, rateLimiterService.Unban("10.0.0.0/24"))
+		assert.False(t, rateLimiterService.Unban("10.0.0.1"))
+		assert.Empty(t, rateLimiterService.Bans())
+		assert.Equal(t, models.RejectReasonIP, rateLimiterService.Hit("10.0.0.1").Reason)
+	})
+}
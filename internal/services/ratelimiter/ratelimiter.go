@@ -1,8 +1,14 @@
 package ratelimiter
 
 import (
+	"context"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/ipkey"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
@@ -12,82 +18,624 @@ import (
 // GlobalCounterKey is the key to store global rate counter.
 const GlobalCounterKey = "GLOBAL"
 
+// Config is the configuration of a RateLimiter.
+type Config struct {
+	// GlobalWindowSize is the window size for the global counter.
+	GlobalWindowSize time.Duration
+	// IPWindowSize is the window size for each IP counter.
+	IPWindowSize time.Duration
+	// Resolution is the width of the buckets hits are grouped in, defaults to a second.
+	Resolution time.Duration
+	// CounterMode selects the counter used for the windows, defaults to counter.ModeExact.
+	CounterMode counter.Mode
+	// AllowedRate is the number of requests allowed for an IP in IPWindowSize.
+	AllowedRate int64
+	// GlobalAllowedRate is the number of requests allowed across all IPs in GlobalWindowSize, 0 disables it.
+	GlobalAllowedRate int64
+	// MaxKeys is the number of IPs tracked at once, 0 is unlimited. It is split evenly between the shards
+	// and the least recently hit IP of a shard is evicted to track a new one on it.
+	MaxKeys int
+	// Shards is the number of shards the IP counters are split in, defaults to DefaultShards.
+	Shards int
+	// Overrides replace AllowedRate and IPWindowSize for the keys and CIDRs they match.
+	// They are matched against the IP address before it is keyed by its network.
+	Overrides []Override
+	// IPv4Prefix and IPv6Prefix are the prefix lengths IP addresses are keyed by, like 24 and 64,
+	// so that every address of a network shares its limit. 0 keeps each address as its own key.
+	IPv4Prefix int
+	IPv6Prefix int
+	// Windows are additional windows an IP must also have capacity in, like 10 requests per second
+	// besides AllowedRate per IPWindowSize, or calendar quotas like 100000 requests per month.
+	// Their sizes and periods must differ from each other and from IPWindowSize.
+	Windows []Window
+	// QuotaLocation is the time zone the calendar periods of quotas start in, defaults to UTC.
+	QuotaLocation *time.Location
+	// Penalty bans keys which keep getting rejected by their IP limit, it is disabled unless Penalty.Violations is set.
+	Penalty Penalty
+	// Shadow are the windows of a candidate policy evaluated alongside the IP windows of keys without an override.
+	// Its decisions are never enforced, the requests it would reject are counted and passed to OnShadowReject.
+	Shadow         []Window
+	OnShadowReject ShadowRejectFunc
+}
+
+// Stats are the number of tracked IPs and the evictions since the RateLimiter was created.
+type Stats struct {
+	// Keys is the number of IPs tracked.
+	Keys int64
+	// IdleEvictions is the number of IPs evicted after their window had fully expired.
+	IdleEvictions int64
+	// CapacityEvictions is the number of IPs evicted to stay within MaxKeys.
+	CapacityEvictions int64
+	// ShadowRejections is the number of requests the shadow policy would have rejected.
+	ShadowRejections int64
+	// JournalFailures is the number of hits and evictions which could not be recorded in the journal.
+	JournalFailures int64
+}
+
 // RateLimiter is the rate limiter, it decides whether to discard a request or not.
+// The IP counters are split in shards locked separately, the global counter has a stripe per shard
+// summed atomically, so no lock is shared by the shards. It is only counted when the global limit is enabled.
+// The limits, global, windows, overrides, globalAllowedRate and globalWindowSize, are read under the lock of a shard
+// and swapped by Reload under the locks of every shard.
 type RateLimiter struct {
-	mu               sync.Mutex
-	counters         map[string]services.CounterServiceInterface
-	allowedRate      int64
-	ipWindowSize     int
-	globalWindowSize int
+	shards []*shard
+	global *globalCounter
+	// windows are the windows of IPs without an override, the IPWindowSize window first
+	windows           []Window
+	globalAllowedRate int64
+	globalWindowSize  time.Duration
+	overrides         *overrides
+	resolution        time.Duration
+	counterMode       counter.Mode
+	quotaLocation     *time.Location
+	penalty           Penalty
+	shadow            []Window
+	onShadowReject    ShadowRejectFunc
+	normalizer        ipkey.Normalizer
 	// persistence is to load and dump the counter window to a json file
 	persistence persistence.Persistence
+	// journal is the persistence when it is a persistence.Journal, the recorded hits and the evicted keys are appended to it
+	journal persistence.Journal
+	// clock is the time source passed to every counter
+	clock clock.Clock
+	// keys, idleEvictions, capacityEvictions, shadowRejections and journalFailures are the Stats, updated atomically
+	keys              int64
+	idleEvictions     int64
+	capacityEvictions int64
+	shadowRejections  int64
+	journalFailures   int64
+	// dumpMu orders the dumps, which are written without holding the locks of the shards
+	dumpMu sync.Mutex
 }
 
 // NewRateLimiter returns a RateLimiter with the provided configurations.
-// globalWindowSize is windowSize for the global counter
-// ipWindowSize is the windowSize for each IP counter.
-// dataPersistence is the persistent storage.
-func NewRateLimiter(globalWindowSize, ipWindowSize int, allowedRate int64, dataPersistence persistence.Persistence) (*RateLimiter, error) {
+// dataPersistence is the persistent storage, the recorded hits are appended to it when it is a persistence.Journal.
+// clk is the time source for the counters.
+func NewRateLimiter(config Config, dataPersistence persistence.Persistence, clk clock.Clock) (*RateLimiter, error) {
+	windows := ipWindows(config)
+	if err := validateWindows(windows); err != nil {
+		return nil, err
+	}
+	ipOverrides, err := newOverrides(config.Overrides, config.IPWindowSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Penalty.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateShadow(config.Shadow); err != nil {
+		return nil, err
+	}
+	if _, err := ipkey.NewNormalizer(config.IPv4Prefix, config.IPv6Prefix); err != nil {
+		return nil, err
+	}
 	ipCounterEntries, err := dataPersistence.Load()
 	if err != nil {
 		return nil, err
 	}
 	var counters = make(map[string]services.CounterServiceInterface)
-	for ipAddr, entries := range ipCounterEntries {
-		if ipAddr == GlobalCounterKey {
-			counters[GlobalCounterKey] = counter.NewCounterService(globalWindowSize, entries)
+	var penalties = make(map[string]*penalty)
+	for persistedKey, entries := range ipCounterEntries {
+		if persistedKey == GlobalCounterKey {
+			continue
+		}
+		if strings.HasPrefix(persistedKey, PenaltyKeyPrefix) {
+			if len(entries) > 0 {
+				entry := entries[len(entries)-1]
+				penalties[strings.TrimPrefix(persistedKey, PenaltyKeyPrefix)] = &penalty{offences: entry.Hits, bannedUntil: time.Unix(0, entry.UnixNano())}
+			}
 			continue
 		}
-		counters[ipAddr] = counter.NewCounterService(ipWindowSize, entries)
+		ipAddr, window, ok := splitWindowKey(persistedKey, windows)
+		if !ok {
+			continue
+		}
+		override, overridden := ipOverrides.match(ipAddr)
+		switch {
+		case !overridden:
+			counters[persistedKey] = windows[window].counter(config.CounterMode, config.Resolution, config.QuotaLocation, entries, clk)
+		case override.Action == OverrideLimit && window == 0:
+			counters[persistedKey] = counter.New(config.CounterMode, override.WindowSize, config.Resolution, entries, clk)
+		}
 	}
 
-	// initialize global counter if not found
-	if _, ok := ipCounterEntries[GlobalCounterKey]; !ok {
-		counters[GlobalCounterKey] = counter.NewCounterService(globalWindowSize, []models.Entry{})
+	rateLimiter := newRateLimiter(config, ipCounterEntries[GlobalCounterKey], counters, dataPersistence, clk)
+	rateLimiter.overrides = ipOverrides
+	if rateLimiter.journal != nil {
+		rateLimiter.journal.SetRetention(rateLimiter.retention())
+	}
+	if config.Penalty.Violations > 0 {
+		now := clk.Now()
+		for key, keyPenalty := range penalties {
+			if !rateLimiter.forgotten(keyPenalty, now) {
+				rateLimiter.shard(key).penalties[key] = keyPenalty
+			}
+		}
 	}
+	return rateLimiter, nil
+}
 
-	return &RateLimiter{
-		mu:               sync.Mutex{},
-		counters:         counters,
-		allowedRate:      allowedRate,
-		ipWindowSize:     ipWindowSize,
-		globalWindowSize: globalWindowSize,
-		persistence:      dataPersistence,
-	}, nil
+// newRateLimiter returns a RateLimiter with a global counter holding globalEntries and the IP counters
+// under their persisted keys spread over the shards. MaxKeys is split evenly between the shards, with no more shards than MaxKeys.
+// The IP prefixes of config are valid.
+func newRateLimiter(config Config, globalEntries []models.Entry, counters map[string]services.CounterServiceInterface,
+	dataPersistence persistence.Persistence, clk clock.Clock) *RateLimiter {
+	shardCount := config.Shards
+	if shardCount <= 0 {
+		shardCount = DefaultShards
+	}
+	if config.MaxKeys > 0 && shardCount > config.MaxKeys {
+		shardCount = config.MaxKeys
+	}
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		var maxKeys int
+		if config.MaxKeys > 0 {
+			maxKeys = config.MaxKeys / shardCount
+			if i < config.MaxKeys%shardCount {
+				maxKeys++
+			}
+		}
+		shards[i] = newShard(i, maxKeys)
+	}
+	normalizer, _ := ipkey.NewNormalizer(config.IPv4Prefix, config.IPv6Prefix)
+	rateLimiter := &RateLimiter{
+		shards:            shards,
+		global:            newGlobalCounter(config.GlobalWindowSize, config.Resolution, shardCount, globalEntries, clk),
+		windows:           ipWindows(config),
+		globalAllowedRate: config.GlobalAllowedRate,
+		globalWindowSize:  config.GlobalWindowSize,
+		resolution:        config.Resolution,
+		counterMode:       config.CounterMode,
+		quotaLocation:     config.QuotaLocation,
+		penalty:           config.Penalty.withDefaults(),
+		shadow:            config.Shadow,
+		onShadowReject:    config.OnShadowReject,
+		normalizer:        normalizer,
+		persistence:       dataPersistence,
+		clock:             clk,
+	}
+	rateLimiter.journal, _ = dataPersistence.(persistence.Journal)
+	if rateLimiter.journal != nil {
+		for _, ipShard := range shards {
+			ipShard.forget = rateLimiter.forget
+		}
+	}
+	for persistedKey, ipCounter := range counters {
+		ipAddr, window, ok := splitWindowKey(persistedKey, rateLimiter.windows)
+		if !ok {
+			continue
+		}
+		ipShard := rateLimiter.shard(ipAddr)
+		ipCounters, tracked := ipShard.counters[ipAddr]
+		if !tracked {
+			ipCounters = make([]services.CounterServiceInterface, len(rateLimiter.windows))
+			ipShard.counters[ipAddr] = ipCounters
+			ipShard.touch(ipAddr)
+			rateLimiter.keys++
+		}
+		ipCounters[window] = ipCounter
+	}
+	for _, ipShard := range shards {
+		evicted := ipShard.evictOverCapacity()
+		rateLimiter.keys -= evicted
+		rateLimiter.capacityEvictions += evicted
+	}
+	return rateLimiter
+}
+
+// shard returns the shard holding the counters of key, which is the shard of the network key of key,
+// so that the shard of an IP is known before its override is matched under the lock of the shard
+func (r *RateLimiter) shard(key string) *shard {
+	return r.shards[shardIndex(r.normalizer.Key(key), len(r.shards))]
+}
+
+// key returns the key counting the requests of ipAddr and its override. ipAddr is counted under the key of its network,
+// unless it matches an override the whole network does not match: it is counted on its own then,
+// so that the IPs sharing a key share its override. The caller holds the lock of the shard of ipAddr.
+func (r *RateLimiter) key(ipAddr string) (string, Override, bool) {
+	key := r.normalizer.Key(ipAddr)
+	override, overridden := r.overrides.match(ipAddr)
+	if networkOverride, networkOverridden := r.overrides.match(key); networkOverridden != overridden || networkOverride.Key != override.Key {
+		return ipkey.Normalizer{}.Key(ipAddr), override, overridden
+	}
+	return key, override, overridden
 }
 
 // Hit records a request and increments global counter and IP counter.
-func (r *RateLimiter) Hit(ipAddr string) (int64, int64, bool) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	globalHits := r.counters[GlobalCounterKey].Hit()
-	ipHitCounter, ok := r.counters[ipAddr]
+// A request is recorded only if neither the IP limit nor the global limit is reached,
+// rate limited requests are reported with the reason and the current counts.
+func (r *RateLimiter) Hit(ipAddr string) models.Decision {
+	return r.HitN(ipAddr, 1)
+}
+
+// HitN records a request costing cost hits on the global counter and every IP window.
+// The request is rate limited when the hits left in any window are less than cost, costs below 1 are counted as 1.
+// Overrides are consulted first, denied and unlimited keys are decided without touching the counters.
+// Banned keys are rejected without a hit, a rejection by the IP limit counts towards a ban when the penalty box is enabled.
+// The shadow policy is evaluated for keys without an override, its decision never changes the one returned.
+func (r *RateLimiter) HitN(ipAddr string, cost int64) models.Decision {
+	if cost < 1 {
+		cost = 1
+	}
+	ipShard := r.shard(ipAddr)
+	var key string
+	var shadowDecision models.Decision
+	defer func() {
+		// reported once the shard is unlocked
+		if shadowDecision.Reason != models.RejectReasonNone && r.onShadowReject != nil {
+			r.onShadowReject(key, shadowDecision)
+		}
+	}()
+	ipShard.mu.Lock()
+	defer ipShard.mu.Unlock()
+	key, override, overridden := r.key(ipAddr)
+	if overridden && override.Action != OverrideLimit {
+		return r.decideOverride(override)
+	}
+	windows := r.policy(override, overridden)
+	ipCounters, ok := ipShard.counters[key]
 	if !ok {
-		ipHitCounter = counter.NewCounterService(r.ipWindowSize, []models.Entry{})
-		r.counters[ipAddr] = ipHitCounter
-		ipHit := ipHitCounter.Hit()
-		return globalHits, ipHit, false
+		ipCounters = make([]services.CounterServiceInterface, len(r.windows))
+		ipShard.counters[key] = ipCounters
+		atomic.AddInt64(&r.keys, 1)
+	}
+	for i, window := range windows {
+		if ipCounters[i] == nil {
+			ipCounters[i] = window.counter(r.counterMode, r.resolution, r.quotaLocation, []models.Entry{}, r.clock)
+		}
+	}
+	ipShard.touch(key)
+	if evicted := ipShard.evictOverCapacity(); evicted > 0 {
+		atomic.AddInt64(&r.keys, -evicted)
+		atomic.AddInt64(&r.capacityEvictions, evicted)
+	}
+	now := r.clock.Now()
+	decision, banned := r.banned(ipShard, key, windows, now)
+	if !banned {
+		decision = r.decide(ipShard, ipCounters, windows, cost, true)
+		if decision.Allowed && r.journal != nil {
+			r.append(key, windows, cost)
+		}
+		if len(r.shadow) > 0 && !overridden {
+			shadowDecision = r.decideShadow(ipShard, key, cost)
+		}
+		if decision.Reason == models.RejectReasonIP && r.penalty.Violations > 0 && r.violate(ipShard, key, now) {
+			decision, _ = r.banned(ipShard, key, windows, now)
+		}
+	}
+	decision.Rule = override.Key
+	return decision
+}
+
+// append appends the hits of a request of key costing cost, recorded on the global counter and windows, to the journal.
+// The caller holds the lock of the shard of key, so that Dump copies either none or all of them, the journal only buffers them.
+func (r *RateLimiter) append(key string, windows []Window, cost int64) {
+	resolution := r.resolution
+	if resolution <= 0 {
+		resolution = counter.DefaultResolution
+	}
+	entry := models.NewEntry(r.clock.Now().Truncate(resolution), cost)
+	if r.globalAllowedRate > 0 {
+		if err := r.journal.Append(GlobalCounterKey, entry); err != nil {
+			atomic.AddInt64(&r.journalFailures, 1)
+			return
+		}
+	}
+	for i := range windows {
+		if err := r.journal.Append(windowKey(key, r.windows, i), entry); err != nil {
+			atomic.AddInt64(&r.journalFailures, 1)
+			return
+		}
+	}
+}
+
+// forget records in the journal that the windows of the evicted key are dropped. The caller holds the lock of the shard of key.
+func (r *RateLimiter) forget(key string) {
+	for i := range r.windows {
+		if err := r.journal.Forget(windowKey(key, r.windows, i)); err != nil {
+			atomic.AddInt64(&r.journalFailures, 1)
+			return
+		}
+	}
+}
+
+// retention returns how long the persisted entries are needed after their time: the longest window of the keys, of their overrides
+// and of the global limit, or the time the offences of a key are remembered after its ban when it is longer.
+// The caller holds the lock of every shard, or has not shared the RateLimiter yet.
+func (r *RateLimiter) retention() time.Duration {
+	retention := windowSize(r.globalWindowSize)
+	for _, window := range r.windows {
+		size := windowSize(window.Size)
+		if window.Period != "" {
+			size = maxPeriod
+		}
+		if size > retention {
+			retention = size
+		}
+	}
+	if size := windowSize(r.overrides.longestWindow()); size > retention {
+		retention = size
+	}
+	if r.penalty.Violations > 0 && r.penalty.ForgetAfter > retention {
+		retention = r.penalty.ForgetAfter
 	}
+	return retention
+}
 
-	ipHitSoFar := ipHitCounter.Count()
-	if ipHitSoFar >= r.allowedRate {
-		return globalHits, ipHitSoFar, true
+// windowSize returns size, or the size the counters default to when it is not positive
+func windowSize(size time.Duration) time.Duration {
+	if size <= 0 {
+		return counter.DefaultWindowSize
 	}
+	return size
+}
 
-	return globalHits, ipHitCounter.Hit(), false
+// Peek returns the decision for a request from ipAddr without recording it.
+func (r *RateLimiter) Peek(ipAddr string) models.Decision {
+	ipShard := r.shard(ipAddr)
+	ipShard.mu.Lock()
+	defer ipShard.mu.Unlock()
+	key, override, overridden := r.key(ipAddr)
+	if overridden && override.Action != OverrideLimit {
+		return r.decideOverride(override)
+	}
+	windows := r.policy(override, overridden)
+	decision, banned := r.banned(ipShard, key, windows, r.clock.Now())
+	if !banned {
+		decision = r.decide(ipShard, ipShard.counters[key], windows, 1, false)
+	}
+	decision.Rule = override.Key
+	return decision
+}
+
+// policy returns the windows limiting a key, the window of its OverrideLimit override replaces every window
+func (r *RateLimiter) policy(override Override, overridden bool) []Window {
+	return policy(r.windows, override, overridden)
+}
+
+// policy returns the windows limiting a key among windows, the window of its OverrideLimit override replaces every window
+func policy(windows []Window, override Override, overridden bool) []Window {
+	if overridden {
+		return []Window{{Size: override.WindowSize, AllowedRate: override.AllowedRate}}
+	}
+	return windows
+}
+
+// decideOverride returns the decision for a key matching an OverrideUnlimited or OverrideDeny override,
+// such decisions have no limit. The caller holds the lock of a shard.
+func (r *RateLimiter) decideOverride(override Override) models.Decision {
+	decision := models.Decision{Allowed: true, Rule: override.Key, GlobalHits: r.globalHits(), ResetAt: r.clock.Now()}
+	if override.Action == OverrideDeny {
+		decision.Allowed, decision.Reason = false, models.RejectReasonDenied
+	}
+	return decision
+}
+
+// globalHits returns the hits in the global window, 0 when the global limit is disabled.
+// The caller holds the lock of a shard.
+func (r *RateLimiter) globalHits() int64 {
+	if r.globalAllowedRate <= 0 {
+		return 0
+	}
+	return r.global.Count()
+}
+
+// decide returns the decision for a request costing cost and records it on the global counter and every IP window
+// when record is set and it is allowed. ipCounters are the counters of the windows of the key, nil for keys without counters.
+// The IP window reported is the one rejecting the request, or the one with the fewest hits left.
+// The request is recorded on the stripe of the global counter of ipShard before the global count is checked and taken back
+// when it is over the limit, so concurrent requests never exceed the global limit, though near it they may be rejected
+// by each other's hits. The caller holds the lock of ipShard.
+func (r *RateLimiter) decide(ipShard *shard, ipCounters []services.CounterServiceInterface, windows []Window, cost int64, record bool) models.Decision {
+	decision := models.Decision{Allowed: true}
+
+	ipWindow, rejected := 0, false
+	var ipHits int64
+	for i, window := range windows {
+		var hits int64
+		if i < len(ipCounters) && ipCounters[i] != nil {
+			hits = ipCounters[i].Count()
+		}
+		if hits+cost > window.AllowedRate {
+			ipWindow, ipHits, rejected = i, hits, true
+			break
+		}
+		if i == 0 || window.AllowedRate-hits < windows[ipWindow].AllowedRate-ipHits {
+			ipWindow, ipHits = i, hits
+		}
+	}
+	decision.IPHits = ipHits
+
+	globalEnabled := r.globalAllowedRate > 0
+	if globalEnabled {
+		start := r.global.now()
+		if record && !rejected {
+			r.global.add(ipShard.stripe, start, cost)
+			decision.GlobalHits = r.global.count(start)
+			if decision.GlobalHits > r.globalAllowedRate {
+				r.global.add(ipShard.stripe, start, -cost)
+				decision.GlobalHits -= cost
+				decision.Allowed, decision.Reason = false, models.RejectReasonGlobal
+			}
+		} else {
+			decision.GlobalHits = r.global.count(start)
+			if !rejected && decision.GlobalHits+cost > r.globalAllowedRate {
+				decision.Allowed, decision.Reason = false, models.RejectReasonGlobal
+			}
+		}
+	}
+
+	switch {
+	case rejected:
+		decision.Allowed, decision.Reason = false, models.RejectReasonIP
+	case decision.Allowed && record:
+		for i := range windows {
+			if hits := ipCounters[i].HitN(cost); i == ipWindow {
+				decision.IPHits = hits
+			}
+		}
+	}
+
+	// report the limit the request is rejected by, or the one with fewer hits left
+	var limitCounter interface{ ExpiresAt(n int64) time.Time }
+	if ipWindow < len(ipCounters) && ipCounters[ipWindow] != nil {
+		limitCounter = ipCounters[ipWindow]
+	}
+	limit, hits, windowSize := windows[ipWindow].AllowedRate, decision.IPHits, windows[ipWindow].Size
+	if decision.Reason == models.RejectReasonGlobal ||
+		(decision.Allowed && globalEnabled && r.globalAllowedRate-decision.GlobalHits < limit-decision.IPHits) {
+		limitCounter, limit, hits, windowSize = r.global, r.globalAllowedRate, decision.GlobalHits, r.globalWindowSize
+	}
+	now := r.clock.Now()
+	decision.Limit = limit
+	decision.Window = windowSize
+	decision.Remaining = limit - hits
+	if decision.Remaining < 0 {
+		decision.Remaining = 0
+	}
+	decision.ResetAt = now
+	if limitCounter != nil {
+		decision.ResetAt = limitCounter.ExpiresAt(1)
+		if !decision.Allowed {
+			decision.RetryAfter = limitCounter.ExpiresAt(hits + cost - limit).Sub(now)
+		}
+	}
+	return decision
+}
+
+// EvictIdle evicts the IPs whose window has fully expired and returns the number of IPs evicted.
+// An evicted IP starts over with an empty counter, which holds the same hits as the expired one.
+// Penalties whose offences are forgotten are dropped as well.
+func (r *RateLimiter) EvictIdle() int64 {
+	var evicted int64
+	for _, ipShard := range r.shards {
+		evicted += ipShard.evictIdle()
+	}
+	if r.penalty.Violations > 0 {
+		now := r.clock.Now()
+		for _, ipShard := range r.shards {
+			r.evictPenalties(ipShard, now)
+		}
+	}
+	atomic.AddInt64(&r.keys, -evicted)
+	atomic.AddInt64(&r.idleEvictions, evicted)
+	return evicted
+}
+
+// RunJanitor evicts idle IPs every interval until ctx is done.
+func (r *RateLimiter) RunJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.EvictIdle()
+		}
+	}
+}
+
+// Stats returns the number of tracked IPs and the evictions so far.
+func (r *RateLimiter) Stats() Stats {
+	return Stats{
+		Keys:              atomic.LoadInt64(&r.keys),
+		IdleEvictions:     atomic.LoadInt64(&r.idleEvictions),
+		CapacityEvictions: atomic.LoadInt64(&r.capacityEvictions),
+		ShadowRejections:  atomic.LoadInt64(&r.shadowRejections),
+		JournalFailures:   atomic.LoadInt64(&r.journalFailures),
+	}
 }
 
 // Dump dumps current counter information to the underlying persistence storage.
+// The shards are locked one at a time while their windows and penalties are copied,
+// the copy is written without holding them and dumps run one at a time.
+// With a journal, every shard is locked while the journal is rotated and the copy is taken,
+// so that the copy holds exactly the hits appended before the rotation.
 func (r *RateLimiter) Dump() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	r.dumpMu.Lock()
+	defer r.dumpMu.Unlock()
+	var now time.Time
+	if r.penalty.Violations > 0 {
+		now = r.clock.Now()
+	}
 	var counterEntries = make(map[string][]models.Entry)
-	for ipAddr, ipCounter := range r.counters {
-		entries := ipCounter.Window()
-		if len(entries) > 0 {
-			counterEntries[ipAddr] = entries
+	if r.journal != nil {
+		for _, ipShard := range r.shards {
+			ipShard.mu.Lock()
+		}
+		err := r.journal.Rotate()
+		if err == nil {
+			r.copyGlobal(counterEntries)
+			for _, ipShard := range r.shards {
+				r.copyShard(ipShard, now, counterEntries)
+			}
 		}
+		for _, ipShard := range r.shards {
+			ipShard.mu.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+		return r.persistence.Dump(counterEntries)
+	}
+	// the global counter is swapped by Reload under the lock of every shard
+	r.shards[0].mu.Lock()
+	r.copyGlobal(counterEntries)
+	r.shards[0].mu.Unlock()
+	for _, ipShard := range r.shards {
+		ipShard.mu.Lock()
+		r.copyShard(ipShard, now, counterEntries)
+		ipShard.mu.Unlock()
 	}
 
 	return r.persistence.Dump(counterEntries)
 }
+
+// copyGlobal copies the window of the global counter to counterEntries. The caller holds the lock of a shard.
+func (r *RateLimiter) copyGlobal(counterEntries map[string][]models.Entry) {
+	if globalEntries := r.global.Window(); len(globalEntries) > 0 {
+		counterEntries[GlobalCounterKey] = globalEntries
+	}
+}
+
+// copyShard copies the windows and the penalties not yet forgotten at now of ipShard to counterEntries.
+// The caller holds the lock of ipShard.
+func (r *RateLimiter) copyShard(ipShard *shard, now time.Time, counterEntries map[string][]models.Entry) {
+	for ipAddr, ipCounters := range ipShard.counters {
+		for i, ipCounter := range ipCounters {
+			if ipCounter == nil {
+				continue
+			}
+			if entries := ipCounter.Window(); len(entries) > 0 {
+				counterEntries[windowKey(ipAddr, r.windows, i)] = entries
+			}
+		}
+	}
+	for key, keyPenalty := range ipShard.penalties {
+		if keyPenalty.offences > 0 && !r.forgotten(keyPenalty, now) {
+			counterEntries[PenaltyKeyPrefix+key] = []models.Entry{models.NewEntry(keyPenalty.bannedUntil, keyPenalty.offences)}
+		}
+	}
+}
@@ -2,28 +2,62 @@ package ratelimiter
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/persistence_mock"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/counter"
 	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/services_mock"
 	"github.com/stretchr/testify/assert"
 
 	//"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
 	//"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/services_mock"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// testConfig counts the global window under a global limit no test reaches
+var testConfig = Config{GlobalWindowSize: 60 * time.Second, GlobalAllowedRate: 1 << 40, IPWindowSize: 20 * time.Second, AllowedRate: 15}
+
+// trackedKeys returns the number of IP counters held by rateLimiter
+func trackedKeys(rateLimiter *RateLimiter) int {
+	var keys int
+	for _, ipShard := range rateLimiter.shards {
+		ipShard.mu.Lock()
+		keys += len(ipShard.counters)
+		ipShard.mu.Unlock()
+	}
+	return keys
+}
+
+// tracked returns whether rateLimiter holds a counter for ipAddr
+func tracked(rateLimiter *RateLimiter, ipAddr string) bool {
+	ipShard := rateLimiter.shard(ipAddr)
+	ipShard.mu.Lock()
+	defer ipShard.mu.Unlock()
+	_, ok := ipShard.counters[ipAddr]
+	return ok
+}
+
+func globalLimitConfig(globalAllowedRate int64) Config {
+	config := testConfig
+	config.GlobalAllowedRate = globalAllowedRate
+	return config
+}
+
 func TestNewRateLimiter(t *testing.T) {
 	t.Run("should return error when persistence load fails", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockPersistence.EXPECT().Load().Return(nil, errors.New("something failed while loading persisted file"))
-		rateLimiterService, err := NewRateLimiter(60, 20, 15, mockPersistence)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, fakeClock)
 		assert.Error(t, err)
 		assert.Nil(t, rateLimiterService)
 	})
@@ -33,12 +67,13 @@ func TestNewRateLimiter(t *testing.T) {
 		defer ctrl.Finish()
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
-		rateLimiterService, err := NewRateLimiter(60, 20, 15, mockPersistence)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, fakeClock)
 		assert.Nil(t, err)
-		assert.Equal(t, 60, rateLimiterService.globalWindowSize)
-		assert.Equal(t, 20, rateLimiterService.ipWindowSize)
-		assert.Equal(t, int64(15), rateLimiterService.allowedRate)
-		assert.NotNil(t, rateLimiterService.counters)
+		assert.Equal(t, 60*time.Second, rateLimiterService.globalWindowSize)
+		assert.Equal(t, []Window{{Size: 20 * time.Second, AllowedRate: 15}}, rateLimiterService.windows)
+		assert.NotNil(t, rateLimiterService.global)
+		assert.Len(t, rateLimiterService.shards, DefaultShards)
 	})
 }
 
@@ -46,62 +81,66 @@ func TestRateLimiter_Hit(t *testing.T) {
 	t.Run("should include loaded global count and discard loaded ip count  50 seconds ago with latest hit", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		epochNow := time.Now().Unix()
+		epochNow := int64(1624974458)
 		ipAddr := "10.0.0.1"
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockEntries := map[string][]models.Entry{GlobalCounterKey: {{EpochTimestamp: epochNow - 50, Hits: int64(50)}}, ipAddr: {{EpochTimestamp: epochNow - 50, Hits: int64(50)}}}
 		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
-		rateLimiterService, err := NewRateLimiter(60, 20, 15, mockPersistence)
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
 		assert.NoError(t, err)
-		globalHit, ipHit, shouldDiscard := rateLimiterService.Hit(ipAddr)
+		decision := rateLimiterService.Hit(ipAddr)
 		var expectedGlobalHits, ipHits int64 = 51, 1
-		assert.Equal(t, expectedGlobalHits, globalHit)
-		assert.Equal(t, ipHits, ipHit)
-		assert.False(t, shouldDiscard)
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonNone, decision.Reason)
 	})
 
 	t.Run("should include loaded ip count 15 seconds ago", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		ipAddr := "10.0.0.1"
-		epochNow := time.Now().Unix()
+		epochNow := int64(1624974458)
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockEntries := map[string][]models.Entry{GlobalCounterKey: {{EpochTimestamp: epochNow - 50, Hits: int64(50)}}, ipAddr: {{EpochTimestamp: epochNow - 15, Hits: int64(10)}}}
 		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
-		rateLimiterService, err := NewRateLimiter(60, 20, 15, mockPersistence)
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
 		assert.NoError(t, err)
-		globalHit, ipHit, shouldDiscard := rateLimiterService.Hit(ipAddr)
+		decision := rateLimiterService.Hit(ipAddr)
 		var expectedGlobalHits, ipHits int64 = 51, 11
-		assert.Equal(t, expectedGlobalHits, globalHit)
-		assert.Equal(t, ipHits, ipHit)
-		assert.False(t, shouldDiscard)
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonNone, decision.Reason)
 	})
 
-	t.Run("should rateLimit with loaded ip count 15 seconds ago", func(t *testing.T) {
+	t.Run("should rateLimit with loaded ip count 15 seconds ago without recording the hit", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		ipAddr := "10.0.0.1"
-		epochNow := time.Now().Unix()
+		epochNow := int64(1624974458)
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockEntries := map[string][]models.Entry{GlobalCounterKey: {{EpochTimestamp: epochNow - 50, Hits: int64(50)}}, ipAddr: {{EpochTimestamp: epochNow - 15, Hits: int64(15)}}}
 		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
-		rateLimiterService, err := NewRateLimiter(60, 20, 15, mockPersistence)
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
 		assert.NoError(t, err)
-		globalHit, ipHit, shouldDiscard := rateLimiterService.Hit(ipAddr)
-		var expectedGlobalHits, ipHits int64 = 51, 15
-		assert.Equal(t, expectedGlobalHits, globalHit)
-		assert.Equal(t, ipHits, ipHit)
-		assert.True(t, shouldDiscard)
+		decision := rateLimiterService.Hit(ipAddr)
+		var expectedGlobalHits, ipHits int64 = 50, 15
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
 	})
 
-	t.Run("do concurrent requests and ensure the rate limited for IP and valid count for global counter", func(t *testing.T) {
+	t.Run("do concurrent requests and ensure the rate limited for IP and global counter counts only allowed requests", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
 		ipAddr := "10.0.0.1"
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockEntries := map[string][]models.Entry{}
 		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
-		rateLimiterService, err := NewRateLimiter(60, 20, 15, mockPersistence)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, fakeClock)
 		assert.NoError(t, err)
 		wg := sync.WaitGroup{}
 		for i := 0; i < 20; i++ {
@@ -114,11 +153,12 @@ func TestRateLimiter_Hit(t *testing.T) {
 			}()
 		}
 		wg.Wait()
-		globalHit, ipHit, shouldDiscard := rateLimiterService.Hit(ipAddr)
-		var expectedGlobalHits, ipHits int64 = 61, 15
-		assert.Equal(t, expectedGlobalHits, globalHit)
-		assert.Equal(t, ipHits, ipHit)
-		assert.True(t, shouldDiscard)
+		decision := rateLimiterService.Hit(ipAddr)
+		var expectedGlobalHits, ipHits int64 = 15, 15
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
 	})
 
 	t.Run("do concurrent requests and ensure the rate limited for two IP addresses valid count for global counter", func(t *testing.T) {
@@ -129,7 +169,8 @@ func TestRateLimiter_Hit(t *testing.T) {
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockEntries := map[string][]models.Entry{}
 		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
-		rateLimiterService, err := NewRateLimiter(60, 20, 15, mockPersistence)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, fakeClock)
 		assert.NoError(t, err)
 		wg := sync.WaitGroup{}
 		for i := 0; i < 20; i++ {
@@ -141,16 +182,18 @@ func TestRateLimiter_Hit(t *testing.T) {
 			}()
 		}
 		wg.Wait()
-		globalHit, ipHit, shouldDiscard := rateLimiterService.Hit(ipAddr1)
-		var expectedGlobalHits, ipHits int64 = 41, 15
-		assert.Equal(t, expectedGlobalHits, globalHit)
-		assert.Equal(t, ipHits, ipHit)
-		assert.True(t, shouldDiscard)
-		globalHit, ipHit, shouldDiscard = rateLimiterService.Hit(ipAddr2)
-		expectedGlobalHits, ipHits = 42, 15
-		assert.Equal(t, expectedGlobalHits, globalHit)
-		assert.Equal(t, ipHits, ipHit)
-		assert.True(t, shouldDiscard)
+		decision := rateLimiterService.Hit(ipAddr1)
+		var expectedGlobalHits, ipHits int64 = 30, 15
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		decision = rateLimiterService.Hit(ipAddr2)
+		expectedGlobalHits, ipHits = 30, 15
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
 	})
 
 	t.Run("do concurrent requests and ensure the not rate limited for two IP addresses when requested below threshold valid count for global counter", func(t *testing.T) {
@@ -161,7 +204,8 @@ func TestRateLimiter_Hit(t *testing.T) {
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockEntries := map[string][]models.Entry{}
 		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
-		rateLimiterService, err := NewRateLimiter(60, 20, 15, mockPersistence)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, fakeClock)
 		assert.NoError(t, err)
 		wg := sync.WaitGroup{}
 		for i := 0; i < 5; i++ {
@@ -173,16 +217,281 @@ func TestRateLimiter_Hit(t *testing.T) {
 			}()
 		}
 		wg.Wait()
-		globalHit, ipHit, shouldDiscard := rateLimiterService.Hit(ipAddr1)
+		decision := rateLimiterService.Hit(ipAddr1)
 		var expectedGlobalHits, ipHits int64 = 11, 6
-		assert.Equal(t, expectedGlobalHits, globalHit)
-		assert.Equal(t, ipHits, ipHit)
-		assert.False(t, shouldDiscard)
-		globalHit, ipHit, shouldDiscard = rateLimiterService.Hit(ipAddr2)
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonNone, decision.Reason)
+		decision = rateLimiterService.Hit(ipAddr2)
 		expectedGlobalHits, ipHits = 12, 6
-		assert.Equal(t, expectedGlobalHits, globalHit)
-		assert.Equal(t, ipHits, ipHit)
-		assert.False(t, shouldDiscard)
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonNone, decision.Reason)
+	})
+
+	t.Run("should allow the IP again once its rate limited hits slide out of the window", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockEntries := map[string][]models.Entry{ipAddr: {{EpochTimestamp: epochNow - 15, Hits: int64(15)}}}
+		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(epochNow, 0))
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit(ipAddr)
+		assert.False(t, decision.Allowed)
+		fakeClock.Advance(5 * time.Second)
+		decision = rateLimiterService.Hit(ipAddr)
+		assert.False(t, decision.Allowed)
+		fakeClock.Advance(time.Second)
+		decision = rateLimiterService.Hit(ipAddr)
+		var expectedGlobalHits, ipHits int64 = 1, 1
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonNone, decision.Reason)
+	})
+
+	t.Run("should rate limit on a sub-second window", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		config := Config{GlobalWindowSize: time.Second, IPWindowSize: 500 * time.Millisecond, Resolution: 100 * time.Millisecond, AllowedRate: 5}
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			decision := rateLimiterService.Hit(ipAddr)
+			assert.True(t, decision.Allowed)
+			fakeClock.Advance(50 * time.Millisecond)
+		}
+		decision := rateLimiterService.Hit(ipAddr)
+		assert.Equal(t, int64(5), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		fakeClock.Advance(400 * time.Millisecond)
+		decision = rateLimiterService.Hit(ipAddr)
+		assert.Equal(t, int64(4), decision.IPHits)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("should rate limit with approximate counters", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974440, 0))
+		config := testConfig
+		config.CounterMode = counter.ModeApproximate
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 0; i < 15; i++ {
+			decision := rateLimiterService.Hit(ipAddr)
+			assert.True(t, decision.Allowed)
+		}
+		decision := rateLimiterService.Hit(ipAddr)
+		assert.Equal(t, int64(15), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		// a quarter into the next fixed window three quarters of the previous window still count
+		fakeClock.Advance(25 * time.Second)
+		decision = rateLimiterService.Hit(ipAddr)
+		assert.Equal(t, int64(12), decision.IPHits)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("should rate limit a weighted hit when the hits left are less than its cost without overdrawing", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		rateLimiterService, err := NewRateLimiter(globalLimitConfig(20), mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		decision := rateLimiterService.HitN(ipAddr, 10)
+		assert.Equal(t, int64(10), decision.GlobalHits)
+		assert.Equal(t, int64(10), decision.IPHits)
+		assert.True(t, decision.Allowed)
+		decision = rateLimiterService.HitN(ipAddr, 6)
+		assert.Equal(t, int64(10), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		decision = rateLimiterService.HitN(ipAddr, 5)
+		assert.Equal(t, int64(15), decision.IPHits)
+		assert.True(t, decision.Allowed)
+		decision = rateLimiterService.HitN("10.0.0.2", 6)
+		assert.Equal(t, int64(15), decision.GlobalHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonGlobal, decision.Reason)
+	})
+
+	t.Run("should rateLimit with global reason when global allowed rate is reached", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockEntries := map[string][]models.Entry{GlobalCounterKey: {{EpochTimestamp: epochNow - 50, Hits: int64(100)}}, ipAddr: {{EpochTimestamp: epochNow - 15, Hits: int64(10)}}}
+		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
+		rateLimiterService, err := NewRateLimiter(globalLimitConfig(100), mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit(ipAddr)
+		var expectedGlobalHits, ipHits int64 = 100, 10
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonGlobal, decision.Reason)
+	})
+
+	t.Run("should report IP reason when both IP and global allowed rates are reached", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockEntries := map[string][]models.Entry{GlobalCounterKey: {{EpochTimestamp: epochNow - 50, Hits: int64(100)}}, ipAddr: {{EpochTimestamp: epochNow - 15, Hits: int64(15)}}}
+		mockPersistence.EXPECT().Load().Return(mockEntries, nil)
+		rateLimiterService, err := NewRateLimiter(globalLimitConfig(100), mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit(ipAddr)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+	})
+
+	t.Run("do concurrent requests from many IP addresses and ensure the global allowed rate is enforced", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(globalLimitConfig(50), mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		wg := sync.WaitGroup{}
+		var mu sync.Mutex
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ipAddr := fmt.Sprintf("10.0.0.%d", i)
+				for j := 0; j < 5; j++ {
+					decision := rateLimiterService.Hit(ipAddr)
+					if decision.Allowed {
+						mu.Lock()
+						allowed++
+						mu.Unlock()
+						continue
+					}
+					assert.Equal(t, models.RejectReasonGlobal, decision.Reason)
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, 50, allowed)
+		decision := rateLimiterService.Hit("10.0.0.100")
+		var expectedGlobalHits, ipHits int64 = 50, 0
+		assert.Equal(t, expectedGlobalHits, decision.GlobalHits)
+		assert.Equal(t, ipHits, decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonGlobal, decision.Reason)
+	})
+}
+
+func TestRateLimiter_Decision(t *testing.T) {
+	t.Run("should report limit, remaining and reset of the IP window on allowed requests", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{ipAddr: {{EpochTimestamp: epochNow - 15, Hits: 10}}}, nil)
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit(ipAddr)
+		assert.Equal(t, models.Decision{
+			Allowed:    true,
+			GlobalHits: 1,
+			IPHits:     11,
+			Limit:      15,
+			Window:     20 * time.Second,
+			Remaining:  4,
+			ResetAt:    time.Unix(epochNow+6, 0),
+		}, decision)
+	})
+
+	t.Run("should report retry after as the time enough hits slide out for the cost", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{ipAddr: {{EpochTimestamp: epochNow - 15, Hits: 10}, {EpochTimestamp: epochNow - 5, Hits: 5}}}, nil)
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit(ipAddr)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, int64(0), decision.Remaining)
+		assert.Equal(t, 6*time.Second, decision.RetryAfter)
+		decision = rateLimiterService.HitN(ipAddr, 12)
+		assert.Equal(t, 16*time.Second, decision.RetryAfter)
+	})
+
+	t.Run("should report the global limit when it has fewer hits left or rejects the request", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{GlobalCounterKey: {{EpochTimestamp: epochNow - 50, Hits: 18}}}, nil)
+		rateLimiterService, err := NewRateLimiter(globalLimitConfig(20), mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(20), decision.Limit)
+		assert.Equal(t, 60*time.Second, decision.Window)
+		assert.Equal(t, int64(1), decision.Remaining)
+		assert.Equal(t, time.Unix(epochNow+11, 0), decision.ResetAt)
+		decision = rateLimiterService.HitN("10.0.0.2", 2)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonGlobal, decision.Reason)
+		assert.Equal(t, int64(20), decision.Limit)
+		assert.Equal(t, 11*time.Second, decision.RetryAfter)
+	})
+}
+
+func TestRateLimiter_Peek(t *testing.T) {
+	t.Run("should return the decision without recording a hit or tracking the IP", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{ipAddr: {{EpochTimestamp: epochNow - 15, Hits: 14}}}, nil)
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			decision := rateLimiterService.Peek(ipAddr)
+			assert.True(t, decision.Allowed)
+			assert.Equal(t, int64(14), decision.IPHits)
+			assert.Equal(t, int64(1), decision.Remaining)
+		}
+		decision := rateLimiterService.Peek("10.0.0.2")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(15), decision.Remaining)
+		assert.Equal(t, time.Unix(epochNow, 0), decision.ResetAt)
+		ok := tracked(rateLimiterService, "10.0.0.2")
+		assert.False(t, ok)
+		assert.True(t, rateLimiterService.Hit(ipAddr).Allowed)
+		decision = rateLimiterService.Peek(ipAddr)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, 6*time.Second, decision.RetryAfter)
 	})
 }
 
@@ -190,19 +499,10 @@ func TestRateLimiter_Dump(t *testing.T) {
 	t.Run("should empty map when there is no entries in each key", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		mockCounterService := services_mock.NewMockCounterServiceInterface(ctrl)
-		mockCounterService.EXPECT().Window().Return([]models.Entry{})
 		mockCounterEntries := map[string][]models.Entry{}
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockPersistence.EXPECT().Dump(mockCounterEntries).Return(nil)
-		rateLimiterService := RateLimiter{
-			allowedRate:      15,
-			globalWindowSize: 60,
-			counters:         map[string]services.CounterServiceInterface{GlobalCounterKey: mockCounterService},
-			ipWindowSize:     20,
-			persistence:      mockPersistence,
-			mu:               sync.Mutex{},
-		}
+		rateLimiterService := newRateLimiter(testConfig, nil, map[string]services.CounterServiceInterface{}, mockPersistence, clock.RealClock{})
 		err := rateLimiterService.Dump()
 		assert.NoError(t, err)
 	})
@@ -210,25 +510,17 @@ func TestRateLimiter_Dump(t *testing.T) {
 	t.Run("should properly dump entries", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		now := time.Now().Unix()
+		now := int64(1624974458)
 		ipAddr := "10.0.0.1"
-		mockCounterServiceGlobal := services_mock.NewMockCounterServiceInterface(ctrl)
 		mockGlobalEntries := []models.Entry{{EpochTimestamp: now - 10, Hits: 60}}
-		mockCounterServiceGlobal.EXPECT().Window().Return(mockGlobalEntries)
 		mockCounterServiceIP := services_mock.NewMockCounterServiceInterface(ctrl)
 		mockIPEntries := []models.Entry{{EpochTimestamp: now - 10, Hits: 15}}
 		mockCounterServiceIP.EXPECT().Window().Return(mockIPEntries)
 		mockCounterEntries := map[string][]models.Entry{GlobalCounterKey: mockGlobalEntries, ipAddr: mockIPEntries}
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockPersistence.EXPECT().Dump(mockCounterEntries).Return(nil)
-		rateLimiterService := RateLimiter{
-			allowedRate:      15,
-			globalWindowSize: 60,
-			counters:         map[string]services.CounterServiceInterface{GlobalCounterKey: mockCounterServiceGlobal, ipAddr: mockCounterServiceIP},
-			ipWindowSize:     20,
-			persistence:      mockPersistence,
-			mu:               sync.Mutex{},
-		}
+		rateLimiterService := newRateLimiter(testConfig, mockGlobalEntries, map[string]services.CounterServiceInterface{ipAddr: mockCounterServiceIP},
+			mockPersistence, clock.NewFakeClock(time.Unix(now, 0)))
 		err := rateLimiterService.Dump()
 		assert.NoError(t, err)
 	})
@@ -236,27 +528,569 @@ func TestRateLimiter_Dump(t *testing.T) {
 	t.Run("should return error when persistence returns error", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		now := time.Now().Unix()
+		now := int64(1624974458)
 		ipAddr := "10.0.0.1"
-		mockCounterServiceGlobal := services_mock.NewMockCounterServiceInterface(ctrl)
 		mockGlobalEntries := []models.Entry{{EpochTimestamp: now - 10, Hits: 60}}
-		mockCounterServiceGlobal.EXPECT().Window().Return(mockGlobalEntries)
 		mockCounterServiceIP := services_mock.NewMockCounterServiceInterface(ctrl)
 		mockIPEntries := []models.Entry{{EpochTimestamp: now - 10, Hits: 15}}
 		mockCounterServiceIP.EXPECT().Window().Return(mockIPEntries)
 		mockCounterEntries := map[string][]models.Entry{GlobalCounterKey: mockGlobalEntries, ipAddr: mockIPEntries}
 		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
 		mockPersistence.EXPECT().Dump(mockCounterEntries).Return(errors.New("some error occurred while dumping"))
-		rateLimiterService := RateLimiter{
-			allowedRate:      15,
-			globalWindowSize: 60,
-			counters:         map[string]services.CounterServiceInterface{GlobalCounterKey: mockCounterServiceGlobal, ipAddr: mockCounterServiceIP},
-			ipWindowSize:     20,
-			persistence:      mockPersistence,
-			mu:               sync.Mutex{},
-		}
+		rateLimiterService := newRateLimiter(testConfig, mockGlobalEntries, map[string]services.CounterServiceInterface{ipAddr: mockCounterServiceIP},
+			mockPersistence, clock.NewFakeClock(time.Unix(now, 0)))
 		err := rateLimiterService.Dump()
 		assert.EqualError(t, err, "some error occurred while dumping")
 	})
 
 }
+
+func TestRateLimiter_EvictIdle(t *testing.T) {
+	t.Run("should evict the IPs whose window has fully expired and keep the global counter", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		rateLimiterService.Hit("10.0.0.1")
+		fakeClock.Advance(10 * time.Second)
+		rateLimiterService.Hit("10.0.0.2")
+		assert.Equal(t, int64(0), rateLimiterService.EvictIdle())
+		fakeClock.Advance(15 * time.Second)
+		assert.Equal(t, int64(1), rateLimiterService.EvictIdle())
+		ok := tracked(rateLimiterService, "10.0.0.1")
+		assert.False(t, ok)
+		ok = tracked(rateLimiterService, "10.0.0.2")
+		assert.True(t, ok)
+		assert.NotNil(t, rateLimiterService.global)
+		assert.Equal(t, Stats{Keys: 1, IdleEvictions: 1}, rateLimiterService.Stats())
+	})
+}
+
+func TestRateLimiter_MaxKeys(t *testing.T) {
+	t.Run("should evict the least recently hit IP when a new IP exceeds max keys", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := testConfig
+		config.MaxKeys = 2
+		config.Shards = 1
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		rateLimiterService.Hit("10.0.0.1")
+		rateLimiterService.Hit("10.0.0.2")
+		rateLimiterService.Hit("10.0.0.1")
+		rateLimiterService.Hit("10.0.0.3")
+		ok := tracked(rateLimiterService, "10.0.0.2")
+		assert.False(t, ok)
+		assert.Equal(t, int64(2), rateLimiterService.Peek("10.0.0.1").IPHits)
+		assert.Equal(t, int64(1), rateLimiterService.Peek("10.0.0.3").IPHits)
+		assert.Equal(t, Stats{Keys: 2, CapacityEvictions: 1}, rateLimiterService.Stats())
+	})
+	t.Run("should evict loaded IPs over max keys", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		now := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{
+			"10.0.0.1": {{EpochTimestamp: now - 5, Hits: 1}},
+			"10.0.0.2": {{EpochTimestamp: now - 5, Hits: 1}},
+			"10.0.0.3": {{EpochTimestamp: now - 5, Hits: 1}},
+		}, nil)
+		config := testConfig
+		config.MaxKeys = 2
+		config.Shards = 1
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, clock.NewFakeClock(time.Unix(now, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, trackedKeys(rateLimiterService))
+		assert.Equal(t, Stats{Keys: 2, CapacityEvictions: 1}, rateLimiterService.Stats())
+	})
+	t.Run("do concurrent requests from more IPs than max keys and ensure the cap holds", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := testConfig
+		config.MaxKeys = 10
+		config.Shards = 1
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				rateLimiterService.Hit(fmt.Sprintf("10.0.0.%d", i))
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, 10, trackedKeys(rateLimiterService))
+		assert.Equal(t, Stats{Keys: 10, CapacityEvictions: 90}, rateLimiterService.Stats())
+	})
+}
+
+func TestRateLimiter_Shards(t *testing.T) {
+	t.Run("do concurrent requests from more IPs than max keys over shards and ensure the cap holds", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := testConfig
+		config.MaxKeys = 10
+		config.Shards = 4
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				rateLimiterService.Hit(fmt.Sprintf("10.0.0.%d", i))
+			}(i)
+		}
+		wg.Wait()
+		stats := rateLimiterService.Stats()
+		assert.LessOrEqual(t, trackedKeys(rateLimiterService), 10)
+		assert.Equal(t, int64(trackedKeys(rateLimiterService)), stats.Keys)
+		assert.Equal(t, int64(100), stats.Keys+stats.CapacityEvictions)
+		assert.Equal(t, int64(100), rateLimiterService.global.Count())
+	})
+	t.Run("should use no more shards than max keys", func(t *testing.T) {
+		config := testConfig
+		config.MaxKeys = 3
+		rateLimiterService := newRateLimiter(config, nil, map[string]services.CounterServiceInterface{}, nil, clock.RealClock{})
+		assert.Len(t, rateLimiterService.shards, 3)
+	})
+}
+
+// benchmarkHit hits a RateLimiter configured with config from parallel goroutines, each on its own set of IPs,
+// and returns the nanoseconds per hit
+func benchmarkHit(b *testing.B, config Config) float64 {
+	ctrl := gomock.NewController(b)
+	defer ctrl.Finish()
+	mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+	mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+	rateLimiterService, err := NewRateLimiter(config, mockPersistence, clock.RealClock{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var goroutine int64
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddInt64(&goroutine, 1)
+		ipAddrs := make([]string, 256)
+		for i := range ipAddrs {
+			ipAddrs[i] = fmt.Sprintf("10.%d.%d.%d", id%256, i/256, i%256)
+		}
+		for i := 0; pb.Next(); i++ {
+			rateLimiterService.Hit(ipAddrs[i%len(ipAddrs)])
+		}
+	})
+	return float64(time.Since(start).Nanoseconds()) / float64(b.N)
+}
+
+// BenchmarkRateLimiter_Hit compares one shard with the default shards without a global limit, with one and with one
+// of a fine resolution over a long window. The default shards report their speedup over one shard, run with -cpu 1,8
+// to see it grow with the CPUs.
+func BenchmarkRateLimiter_Hit(b *testing.B) {
+	config := testConfig
+	config.AllowedRate = 1 << 40
+	config.GlobalAllowedRate = 0
+	globalConfig := config
+	globalConfig.GlobalAllowedRate = 1 << 40
+	fineConfig := globalConfig
+	fineConfig.GlobalWindowSize = time.Minute
+	fineConfig.Resolution = 10 * time.Millisecond
+	for _, variant := range []struct {
+		name   string
+		config Config
+	}{
+		{"", config},
+		{"/global", globalConfig},
+		{"/global/resolution=10ms", fineConfig},
+	} {
+		var baseline float64
+		for _, shards := range []int{1, DefaultShards} {
+			variant.config.Shards = shards
+			b.Run(fmt.Sprintf("shards=%d%s", shards, variant.name), func(b *testing.B) {
+				nsPerOp := benchmarkHit(b, variant.config)
+				if shards == 1 {
+					baseline = nsPerOp
+				} else if baseline > 0 {
+					b.ReportMetric(baseline/nsPerOp, "speedup")
+				}
+			})
+		}
+	}
+}
+
+func TestRateLimiter_Overrides(t *testing.T) {
+	newOverriddenRateLimiter := func(t *testing.T, fakeClock *clock.FakeClock) *RateLimiter {
+		ctrl := gomock.NewController(t)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := globalLimitConfig(30)
+		config.Overrides = []Override{
+			{Key: "10.0.0.0/8", Action: OverrideUnlimited},
+			{Key: "203.0.113.0/24", AllowedRate: 20, WindowSize: 5 * time.Second},
+			{Key: "198.51.100.7", Action: OverrideDeny},
+		}
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		return rateLimiterService
+	}
+	t.Run("should always reject denied keys without counting them", func(t *testing.T) {
+		rateLimiterService := newOverriddenRateLimiter(t, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		decision := rateLimiterService.Hit("198.51.100.7")
+		assert.Equal(t, models.Decision{Reason: models.RejectReasonDenied, Rule: "198.51.100.7", ResetAt: time.Unix(1624974458, 0)}, decision)
+		assert.Equal(t, decision, rateLimiterService.Peek("198.51.100.7"))
+		assert.False(t, tracked(rateLimiterService, "198.51.100.7"))
+	})
+	t.Run("should allow unlimited keys past every limit without counting them", func(t *testing.T) {
+		rateLimiterService := newOverriddenRateLimiter(t, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		for i := 0; i < 100; i++ {
+			decision := rateLimiterService.Hit("10.1.2.3")
+			assert.True(t, decision.Allowed)
+			assert.Equal(t, "10.0.0.0/8", decision.Rule)
+		}
+		assert.Equal(t, int64(0), rateLimiterService.global.Count())
+		assert.False(t, tracked(rateLimiterService, "10.1.2.3"))
+	})
+	t.Run("should limit keys in an overridden CIDR to the override rate and window", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService := newOverriddenRateLimiter(t, fakeClock)
+		var decision models.Decision
+		for i := 0; i < 21; i++ {
+			decision = rateLimiterService.Hit("203.0.113.9")
+		}
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, "203.0.113.0/24", decision.Rule)
+		assert.Equal(t, int64(20), decision.Limit)
+		fakeClock.Advance(6 * time.Second)
+		decision = rateLimiterService.Peek("203.0.113.9")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(0), decision.IPHits)
+		// the global window still holds the 20 allowed hits, leaving fewer hits than the override
+		assert.Equal(t, int64(10), decision.Remaining)
+	})
+	t.Run("should apply the default limit and no rule to other keys", func(t *testing.T) {
+		rateLimiterService := newOverriddenRateLimiter(t, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		decision := rateLimiterService.Hit("192.0.2.1")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, "", decision.Rule)
+		assert.Equal(t, int64(15), decision.Limit)
+	})
+	t.Run("should return error on invalid overrides", func(t *testing.T) {
+		config := testConfig
+		config.Overrides = []Override{{Key: "10.0.0.0/40", Action: OverrideDeny}}
+		_, err := NewRateLimiter(config, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.Error(t, err)
+	})
+}
+
+func TestRateLimiter_Prefix(t *testing.T) {
+	t.Run("should count the addresses of a network on one counter and match overrides on the address", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := testConfig
+		config.IPv4Prefix, config.IPv6Prefix = 24, 64
+		config.Overrides = []Override{{Key: "2001:db8::dead", Action: OverrideDeny}}
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		for i := 0; i < 15; i++ {
+			assert.True(t, rateLimiterService.Hit(fmt.Sprintf("2001:db8::%x", i)).Allowed)
+		}
+		decision := rateLimiterService.Hit("2001:db8::beef")
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, int64(15), decision.IPHits)
+		assert.Equal(t, models.RejectReasonDenied, rateLimiterService.Hit("2001:db8::dead").Reason)
+		assert.True(t, rateLimiterService.Hit("2001:db8:0:1::1").Allowed)
+		assert.True(t, rateLimiterService.Hit("203.0.113.1").Allowed)
+		assert.Equal(t, int64(1), rateLimiterService.Peek("203.0.113.99").IPHits)
+		assert.True(t, tracked(rateLimiterService, "2001:db8::/64"))
+		assert.True(t, tracked(rateLimiterService, "203.0.113.0/24"))
+		assert.Equal(t, int64(3), rateLimiterService.Stats().Keys)
+	})
+}
+
+func TestRateLimiter_Windows(t *testing.T) {
+	windowsConfig := testConfig
+	windowsConfig.AllowedRate = 1000
+	windowsConfig.IPWindowSize = time.Hour
+	windowsConfig.Windows = []Window{{Size: time.Second, AllowedRate: 10}}
+	t.Run("should reject on the short window and report it as the most restrictive window", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(windowsConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		decision := rateLimiterService.HitN("10.0.0.1", 4)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(10), decision.Limit)
+		assert.Equal(t, time.Second, decision.Window)
+		assert.Equal(t, int64(6), decision.Remaining)
+		decision = rateLimiterService.HitN("10.0.0.1", 7)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, time.Second, decision.Window)
+		assert.Equal(t, 2*time.Second, decision.RetryAfter)
+		fakeClock.Advance(2 * time.Second)
+		assert.True(t, rateLimiterService.HitN("10.0.0.1", 7).Allowed)
+	})
+	t.Run("should reject on the long window once the sustained rate is used up", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, err := NewRateLimiter(windowsConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			assert.True(t, rateLimiterService.HitN("10.0.0.1", 10).Allowed)
+			fakeClock.Advance(2 * time.Second)
+		}
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, int64(1000), decision.Limit)
+		assert.Equal(t, time.Hour, decision.Window)
+		assert.Equal(t, int64(1000), decision.IPHits)
+	})
+	t.Run("should record rejected requests on no window", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		rateLimiterService, err := NewRateLimiter(windowsConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		rateLimiterService.HitN("10.0.0.1", 10)
+		rateLimiterService.HitN("10.0.0.1", 10)
+		ipShard := rateLimiterService.shard("10.0.0.1")
+		assert.Equal(t, int64(10), ipShard.counters["10.0.0.1"][0].Count())
+		assert.Equal(t, int64(10), ipShard.counters["10.0.0.1"][1].Count())
+	})
+	t.Run("should dump and load every window under its own key", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		now := int64(1624974458)
+		loaded := map[string][]models.Entry{
+			"10.0.0.1":      {{EpochTimestamp: now - 100, Hits: 50}, {EpochTimestamp: now, Hits: 5}},
+			"10.0.0.1@1s":   {{EpochTimestamp: now, Hits: 5}},
+			"10.0.0.2@1m0s": {{EpochTimestamp: now, Hits: 5}},
+		}
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(loaded, nil)
+		mockPersistence.EXPECT().Dump(map[string][]models.Entry{
+			GlobalCounterKey: {{EpochTimestamp: now, Hits: 1}},
+			"10.0.0.1":       {{EpochTimestamp: now - 100, Hits: 50}, {EpochTimestamp: now, Hits: 6}},
+			"10.0.0.1@1s":    {{EpochTimestamp: now, Hits: 6}},
+		}).Return(nil)
+		rateLimiterService, err := NewRateLimiter(windowsConfig, mockPersistence, clock.NewFakeClock(time.Unix(now, 0)))
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.Equal(t, int64(6), decision.IPHits)
+		assert.Equal(t, int64(4), decision.Remaining)
+		assert.False(t, tracked(rateLimiterService, "10.0.0.2"))
+		assert.NoError(t, rateLimiterService.Dump())
+	})
+	t.Run("should return error on invalid windows", func(t *testing.T) {
+		for _, windows := range [][]Window{{{Size: 0, AllowedRate: 1}}, {{Size: time.Second}}, {{Size: time.Hour, AllowedRate: 1}}, {{Size: time.Second, AllowedRate: 1}, {Size: time.Second, AllowedRate: 2}}} {
+			config := windowsConfig
+			config.Windows = windows
+			_, err := NewRateLimiter(config, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestRateLimiter_Quotas(t *testing.T) {
+	quotaConfig := testConfig
+	quotaConfig.Windows = []Window{{Period: counter.PeriodMonth, AllowedRate: 20}}
+	t.Run("should reject once the monthly quota is used up until the next month starts", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Date(2021, time.June, 30, 23, 0, 0, 0, time.UTC))
+		rateLimiterService, err := NewRateLimiter(quotaConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		assert.True(t, rateLimiterService.HitN("10.0.0.1", 15).Allowed)
+		fakeClock.Advance(30 * time.Second)
+		decision := rateLimiterService.HitN("10.0.0.1", 10)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, int64(20), decision.Limit)
+		assert.Equal(t, int64(5), decision.Remaining)
+		assert.True(t, time.Date(2021, time.July, 1, 0, 0, 0, 0, time.UTC).Equal(decision.ResetAt))
+		assert.Equal(t, 59*time.Minute+30*time.Second, decision.RetryAfter)
+		fakeClock.Set(time.Date(2021, time.July, 1, 0, 0, 0, 0, time.UTC))
+		assert.True(t, rateLimiterService.HitN("10.0.0.1", 10).Allowed)
+	})
+	t.Run("should start the periods in the quota location", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		tokyo, err := time.LoadLocation("Asia/Tokyo")
+		assert.NoError(t, err)
+		config := quotaConfig
+		config.Windows = []Window{{Period: counter.PeriodDay, AllowedRate: 20}}
+		config.QuotaLocation = tokyo
+		fakeClock := clock.NewFakeClock(time.Date(2021, time.June, 30, 12, 0, 0, 0, time.UTC))
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		rateLimiterService.HitN("10.0.0.1", 15)
+		fakeClock.Advance(30 * time.Second)
+		decision := rateLimiterService.HitN("10.0.0.1", 10)
+		assert.False(t, decision.Allowed)
+		assert.True(t, time.Date(2021, time.July, 1, 0, 0, 0, 0, tokyo).Equal(decision.ResetAt))
+	})
+	t.Run("should dump and load the quota under its period", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		now := time.Date(2021, time.June, 30, 23, 0, 0, 0, time.UTC)
+		monthStart := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{
+			"10.0.0.1@month": {models.NewEntry(time.Date(2021, time.May, 1, 0, 0, 0, 0, time.UTC), 20), models.NewEntry(monthStart, 12)},
+			"10.0.0.2@week":  {models.NewEntry(monthStart, 12)},
+		}, nil)
+		mockPersistence.EXPECT().Dump(map[string][]models.Entry{
+			GlobalCounterKey: {models.NewEntry(now, 1)},
+			"10.0.0.1":       {models.NewEntry(now, 1)},
+			"10.0.0.1@month": {models.NewEntry(monthStart, 13)},
+		}).Return(nil)
+		rateLimiterService, err := NewRateLimiter(quotaConfig, mockPersistence, clock.NewFakeClock(now))
+		assert.NoError(t, err)
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.Equal(t, int64(20), decision.Limit)
+		assert.Equal(t, int64(7), decision.Remaining)
+		assert.False(t, tracked(rateLimiterService, "10.0.0.2"))
+		assert.NoError(t, rateLimiterService.Dump())
+	})
+	t.Run("should return error on unknown periods", func(t *testing.T) {
+		config := quotaConfig
+		config.Windows = []Window{{Period: "year", AllowedRate: 20}}
+		_, err := NewRateLimiter(config, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.Error(t, err)
+	})
+}
+
+func TestParseWindows(t *testing.T) {
+	t.Run("should parse comma separated windows", func(t *testing.T) {
+		windows, err := ParseWindows("10/1s, 1000/1h, 100000/month")
+		assert.NoError(t, err)
+		assert.Equal(t, []Window{{Size: time.Second, AllowedRate: 10}, {Size: time.Hour, AllowedRate: 1000}, {Period: counter.PeriodMonth, AllowedRate: 100000}}, windows)
+	})
+	t.Run("should return error on malformed windows", func(t *testing.T) {
+		for _, s := range []string{"10", "ten/1s", "10/soon"} {
+			_, err := ParseWindows(s)
+			assert.Error(t, err, s)
+		}
+	})
+}
+
+func TestRateLimiter_Journal(t *testing.T) {
+	t.Run("should append the allowed hits of the global counter and every window", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, int64(500*time.Millisecond)))
+		config := testConfig
+		config.AllowedRate = 2
+		config.Windows = []Window{{Size: time.Second, AllowedRate: 5}}
+		mockJournal := persistence_mock.NewMockJournal(ctrl)
+		mockJournal.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		mockJournal.EXPECT().SetRetention(time.Minute)
+		entry := models.Entry{EpochTimestamp: 1624974458, Hits: 1}
+		mockJournal.EXPECT().Append(GlobalCounterKey, entry).Return(nil).Times(2)
+		mockJournal.EXPECT().Append(ipAddr, entry).Return(nil).Times(2)
+		mockJournal.EXPECT().Append(ipAddr+WindowKeySeparator+"1s", entry).Return(nil).Times(2)
+		rateLimiterService, err := NewRateLimiter(config, mockJournal, fakeClock)
+		assert.NoError(t, err)
+		assert.True(t, rateLimiterService.Hit(ipAddr).Allowed)
+		assert.True(t, rateLimiterService.Hit(ipAddr).Allowed)
+		assert.False(t, rateLimiterService.Hit(ipAddr).Allowed)
+	})
+	t.Run("should count the hits which could not be appended", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockJournal := persistence_mock.NewMockJournal(ctrl)
+		mockJournal.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		mockJournal.EXPECT().SetRetention(time.Minute)
+		mockJournal.EXPECT().Append(GlobalCounterKey, gomock.Any()).Return(errors.New("disk full"))
+		rateLimiterService, err := NewRateLimiter(testConfig, mockJournal, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		assert.Equal(t, int64(1), rateLimiterService.Stats().JournalFailures)
+	})
+	t.Run("should rotate the journal before copying the counters", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockCounterService := services_mock.NewMockCounterServiceInterface(ctrl)
+		mockJournal := persistence_mock.NewMockJournal(ctrl)
+		mockEntries := []models.Entry{{EpochTimestamp: 1624974458, Hits: 1}}
+		gomock.InOrder(
+			mockJournal.EXPECT().Rotate().Return(nil),
+			mockCounterService.EXPECT().Window().Return(mockEntries),
+			mockJournal.EXPECT().Dump(map[string][]models.Entry{"10.0.0.1": mockEntries}).Return(nil),
+		)
+		rateLimiterService := newRateLimiter(testConfig, nil, map[string]services.CounterServiceInterface{"10.0.0.1": mockCounterService},
+			mockJournal, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, rateLimiterService.Dump())
+	})
+	t.Run("should not dump when the journal cannot be rotated", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockJournal := persistence_mock.NewMockJournal(ctrl)
+		mockJournal.EXPECT().Rotate().Return(errors.New("disk full"))
+		rateLimiterService := newRateLimiter(testConfig, nil, map[string]services.CounterServiceInterface{}, mockJournal, clock.RealClock{})
+		assert.EqualError(t, rateLimiterService.Dump(), "disk full")
+	})
+	t.Run("should forget the windows of evicted keys", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		config := testConfig
+		config.GlobalAllowedRate = 0
+		config.MaxKeys = 1
+		config.Windows = []Window{{Size: time.Second, AllowedRate: 5}}
+		mockJournal := persistence_mock.NewMockJournal(ctrl)
+		mockJournal.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		mockJournal.EXPECT().SetRetention(time.Minute)
+		mockJournal.EXPECT().Append(gomock.Any(), gomock.Any()).Return(nil).Times(4)
+		mockJournal.EXPECT().Forget("10.0.0.1").Return(nil)
+		mockJournal.EXPECT().Forget("10.0.0.1" + WindowKeySeparator + "1s").Return(nil)
+		rateLimiterService, err := NewRateLimiter(config, mockJournal, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		assert.True(t, rateLimiterService.Hit("10.0.0.2").Allowed)
+	})
+	t.Run("should keep the entries for the longest window, override or penalty", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		config := testConfig
+		config.Overrides = []Override{{Key: "10.0.0.0/8", AllowedRate: 10, WindowSize: time.Hour}}
+		config.Penalty = Penalty{Violations: 3, Within: time.Minute, BanDuration: time.Minute, ForgetAfter: 2 * time.Hour}
+		mockJournal := persistence_mock.NewMockJournal(ctrl)
+		mockJournal.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		gomock.InOrder(
+			mockJournal.EXPECT().SetRetention(2*time.Hour),
+			mockJournal.EXPECT().SetRetention(time.Hour),
+			mockJournal.EXPECT().SetRetention(maxPeriod),
+		)
+		rateLimiterService, err := NewRateLimiter(config, mockJournal, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		rateLimiterService.penalty.Violations = 0
+		assert.NoError(t, rateLimiterService.Reload(config))
+		config.Windows = []Window{{Period: counter.PeriodMonth, AllowedRate: 1000}}
+		assert.NoError(t, rateLimiterService.Reload(config))
+	})
+}
@@ -0,0 +1,62 @@
+package ratelimiter
+
+import (
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+)
+
+// Reload swaps the limits of the RateLimiter for the AllowedRate, IPWindowSize, Windows, Overrides, GlobalAllowedRate
+// and GlobalWindowSize of config, its other settings are kept. The counters of the tracked keys are kept too,
+// a counter whose window changed size or period is rebuilt from its hits, so a grown window keeps every hit it held
+// and a shrunk one drops the hits falling out of it. Requests wait for the swap and are decided by either the old
+// or the new limits. The limits are left unchanged when config is invalid.
+func (r *RateLimiter) Reload(config Config) error {
+	windows := ipWindows(config)
+	if err := validateWindows(windows); err != nil {
+		return err
+	}
+	ipOverrides, err := newOverrides(config.Overrides, config.IPWindowSize)
+	if err != nil {
+		return err
+	}
+	for _, ipShard := range r.shards {
+		ipShard.mu.Lock()
+		defer ipShard.mu.Unlock()
+	}
+	for _, ipShard := range r.shards {
+		for key, ipCounters := range ipShard.counters {
+			ipShard.counters[key] = r.resize(key, ipCounters, windows, ipOverrides)
+		}
+	}
+	if config.GlobalWindowSize != r.globalWindowSize {
+		r.global = newGlobalCounter(config.GlobalWindowSize, r.resolution, len(r.shards), r.global.Window(), r.clock)
+	}
+	r.windows, r.overrides = windows, ipOverrides
+	r.globalAllowedRate, r.globalWindowSize = config.GlobalAllowedRate, config.GlobalWindowSize
+	if r.journal != nil {
+		r.journal.SetRetention(r.retention())
+	}
+	return nil
+}
+
+// resize returns the counters of key under windows and ipOverrides, a counter is kept when the size and period of its window
+// are unchanged and rebuilt from its hits otherwise. Counters of windows which are no longer configured are dropped.
+// The caller holds the lock of every shard.
+func (r *RateLimiter) resize(key string, ipCounters []services.CounterServiceInterface, windows []Window,
+	ipOverrides *overrides) []services.CounterServiceInterface {
+	override, overridden := r.overrides.match(key)
+	current := policy(r.windows, override, overridden && override.Action == OverrideLimit)
+	override, overridden = ipOverrides.match(key)
+	next := policy(windows, override, overridden && override.Action == OverrideLimit)
+	resized := make([]services.CounterServiceInterface, len(windows))
+	for i, ipCounter := range ipCounters {
+		if ipCounter == nil || i >= len(next) {
+			continue
+		}
+		if i < len(current) && current[i].name() == next[i].name() {
+			resized[i] = ipCounter
+			continue
+		}
+		resized[i] = next[i].counter(r.counterMode, r.resolution, r.quotaLocation, ipCounter.Window(), r.clock)
+	}
+	return resized
+}
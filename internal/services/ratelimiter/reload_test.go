@@ -0,0 +1,170 @@
+package ratelimiter
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/persistence_mock"
+	"github.com/stretchr/testify/assert"
+)
+
+// newReloadRateLimiter returns a rate limiter of config loading nothing
+func newReloadRateLimiter(t *testing.T, config Config, fakeClock *clock.FakeClock) (*RateLimiter, *persistence_mock.MockPersistence) {
+	ctrl := gomock.NewController(t)
+	mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+	mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+	rateLimiterService, err := NewRateLimiter(config, mockPersistence, fakeClock)
+	assert.NoError(t, err)
+	return rateLimiterService, mockPersistence
+}
+
+func TestRateLimiter_Reload(t *testing.T) {
+	t.Run("should apply a new allowed rate keeping the hits", func(t *testing.T) {
+		config := testConfig
+		config.AllowedRate = 2
+		rateLimiterService, _ := newReloadRateLimiter(t, config, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		rateLimiterService.HitN("10.0.0.1", 2)
+		assert.Equal(t, models.RejectReasonIP, rateLimiterService.Hit("10.0.0.1").Reason)
+		config.AllowedRate = 3
+		assert.NoError(t, rateLimiterService.Reload(config))
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(3), decision.IPHits)
+		assert.Equal(t, int64(3), decision.Limit)
+		assert.Equal(t, models.RejectReasonIP, rateLimiterService.Hit("10.0.0.1").Reason)
+	})
+	t.Run("should resize the windows of tracked keys", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, _ := newReloadRateLimiter(t, testConfig, fakeClock)
+		rateLimiterService.Hit("10.0.0.1")
+		fakeClock.Advance(10 * time.Second)
+		rateLimiterService.Hit("10.0.0.1")
+		config := testConfig
+		config.IPWindowSize = 5 * time.Second
+		assert.NoError(t, rateLimiterService.Reload(config))
+		decision := rateLimiterService.Peek("10.0.0.1")
+		assert.Equal(t, int64(1), decision.IPHits)
+		assert.Equal(t, 5*time.Second, decision.Window)
+
+		config.IPWindowSize = time.Minute
+		assert.NoError(t, rateLimiterService.Reload(config))
+		fakeClock.Advance(30 * time.Second)
+		assert.Equal(t, int64(1), rateLimiterService.Peek("10.0.0.1").IPHits)
+	})
+	t.Run("should add and drop windows", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, mockPersistence := newReloadRateLimiter(t, testConfig, fakeClock)
+		rateLimiterService.Hit("10.0.0.1")
+		config := testConfig
+		config.Windows = []Window{{Size: time.Second, AllowedRate: 2}}
+		assert.NoError(t, rateLimiterService.Reload(config))
+		assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, time.Second, decision.Window)
+		mockPersistence.EXPECT().Dump(gomock.Any()).DoAndReturn(func(entries map[string][]models.Entry) error {
+			assert.Contains(t, entries, "10.0.0.1@1s")
+			return nil
+		})
+		assert.NoError(t, rateLimiterService.Dump())
+
+		assert.NoError(t, rateLimiterService.Reload(testConfig))
+		decision = rateLimiterService.Hit("10.0.0.1")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(4), decision.IPHits)
+	})
+	t.Run("should swap the overrides", func(t *testing.T) {
+		rateLimiterService, _ := newReloadRateLimiter(t, testConfig, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		rateLimiterService.HitN("10.0.0.1", 3)
+		config := testConfig
+		config.Overrides = []Override{{Key: "10.0.0.0/8", AllowedRate: 3, WindowSize: time.Minute}, {Key: "10.0.0.2", Action: OverrideDeny}}
+		assert.NoError(t, rateLimiterService.Reload(config))
+		decision := rateLimiterService.Hit("10.0.0.1")
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, "10.0.0.0/8", decision.Rule)
+		assert.Equal(t, time.Minute, decision.Window)
+		assert.Equal(t, models.RejectReasonDenied, rateLimiterService.Hit("10.0.0.2").Reason)
+
+		assert.NoError(t, rateLimiterService.Reload(testConfig))
+		decision = rateLimiterService.Hit("10.0.0.1")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(4), decision.IPHits)
+		assert.True(t, rateLimiterService.Hit("10.0.0.2").Allowed)
+	})
+	t.Run("should match the overrides of the keys of networks like their IPs", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		config := testConfig
+		config.IPv4Prefix = 24
+		config.Overrides = []Override{{Key: "203.0.113.7", AllowedRate: 10, WindowSize: time.Minute}, {Key: "198.51.0.0/16", AllowedRate: 4, WindowSize: time.Minute}}
+		rateLimiterService, _ := newReloadRateLimiter(t, config, fakeClock)
+		rateLimiterService.HitN("203.0.113.7", 2)
+		rateLimiterService.HitN("203.0.113.8", 3)
+		rateLimiterService.Hit("198.51.100.1")
+		rateLimiterService.Hit("198.51.100.2")
+		config.Overrides = []Override{{Key: "203.0.113.7", AllowedRate: 10, WindowSize: 2 * time.Minute}, {Key: "198.51.0.0/16", AllowedRate: 4, WindowSize: 30 * time.Second}}
+		assert.NoError(t, rateLimiterService.Reload(config))
+
+		decision := rateLimiterService.Peek("203.0.113.7")
+		assert.Equal(t, int64(2), decision.IPHits, "the overridden IP is counted on its own")
+		assert.Equal(t, 2*time.Minute, decision.Window)
+		assert.Equal(t, "203.0.113.7", decision.Rule)
+		decision = rateLimiterService.Peek("203.0.113.8")
+		assert.Equal(t, int64(3), decision.IPHits)
+		assert.Equal(t, 20*time.Second, decision.Window)
+		decision = rateLimiterService.Peek("198.51.100.1")
+		assert.Equal(t, int64(2), decision.IPHits, "the IPs of a network in an overridden CIDR share its key")
+		assert.Equal(t, "198.51.0.0/16", decision.Rule)
+		fakeClock.Advance(40 * time.Second)
+		assert.Zero(t, rateLimiterService.Peek("198.51.100.2").IPHits, "the window of the network key is resized to the override")
+		assert.Equal(t, int64(2), rateLimiterService.Peek("203.0.113.7").IPHits)
+	})
+	t.Run("should apply a new global limit and resize the global window", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService, _ := newReloadRateLimiter(t, testConfig, fakeClock)
+		rateLimiterService.Hit("10.0.0.1")
+		fakeClock.Advance(30 * time.Second)
+		rateLimiterService.Hit("10.0.0.2")
+		config := globalLimitConfig(2)
+		config.GlobalWindowSize = 10 * time.Second
+		assert.NoError(t, rateLimiterService.Reload(config))
+		assert.Equal(t, int64(1), rateLimiterService.global.Count())
+		assert.True(t, rateLimiterService.Hit("10.0.0.3").Allowed)
+		assert.Equal(t, models.RejectReasonGlobal, rateLimiterService.Hit("10.0.0.4").Reason)
+	})
+	t.Run("should keep the limits on invalid config", func(t *testing.T) {
+		rateLimiterService, _ := newReloadRateLimiter(t, testConfig, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		for _, config := range []Config{
+			{IPWindowSize: 20 * time.Second, AllowedRate: 5, Windows: []Window{{Size: 20 * time.Second, AllowedRate: 1}}},
+			{IPWindowSize: 20 * time.Second, AllowedRate: 5, Overrides: []Override{{Key: "10.0.0.1", AllowedRate: 0}}},
+		} {
+			assert.Error(t, rateLimiterService.Reload(config))
+		}
+		assert.Equal(t, []Window{{Size: 20 * time.Second, AllowedRate: 15}}, rateLimiterService.windows)
+	})
+	t.Run("should decide requests concurrently with reloads", func(t *testing.T) {
+		rateLimiterService, _ := newReloadRateLimiter(t, testConfig, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		configs := []Config{testConfig, globalLimitConfig(100)}
+		configs[1].Windows = []Window{{Size: time.Second, AllowedRate: 10}}
+		configs[1].Overrides = []Override{{Key: "10.0.0.0/8", AllowedRate: 50, WindowSize: time.Minute}}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					rateLimiterService.Hit("10.0.0.1")
+					rateLimiterService.Peek("10.0.0.2")
+				}
+			}()
+		}
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, rateLimiterService.Reload(configs[i%2]))
+		}
+		wg.Wait()
+	})
+}
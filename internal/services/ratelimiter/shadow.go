@@ -0,0 +1,78 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+)
+
+// ShadowRejectFunc is called with the key and the decision of the shadow policy for every request it would reject.
+// It is called after the lock of the key is released, from the goroutine of the request.
+type ShadowRejectFunc func(key string, decision models.Decision)
+
+// validateShadow returns an error when a shadow window is invalid or has the size or the period of another one
+func validateShadow(windows []Window) error {
+	names := make(map[string]bool, len(windows))
+	for _, window := range windows {
+		if err := validateWindow(window); err != nil {
+			return fmt.Errorf("shadow %s", err.Error())
+		}
+		if names[window.name()] {
+			return fmt.Errorf("shadow window %s is configured more than once", window.name())
+		}
+		names[window.name()] = true
+	}
+	return nil
+}
+
+// decideShadow returns the decision of the shadow windows for a request of key costing cost and records it on them
+// when the shadow policy allows it, so they count the requests as if the shadow policy was enforced.
+// A would-be rejection is counted for key. The caller holds the lock of ipShard.
+func (r *RateLimiter) decideShadow(ipShard *shard, key string, cost int64) models.Decision {
+	shadowCounters, ok := ipShard.shadows[key]
+	if !ok {
+		shadowCounters = make([]services.CounterServiceInterface, len(r.shadow))
+		for i, window := range r.shadow {
+			shadowCounters[i] = window.counter(r.counterMode, r.resolution, r.quotaLocation, []models.Entry{}, r.clock)
+		}
+		ipShard.shadows[key] = shadowCounters
+	}
+	decision := models.Decision{Allowed: true}
+	for i, window := range r.shadow {
+		hits := shadowCounters[i].Count()
+		if hits+cost > window.AllowedRate {
+			decision = models.Decision{Reason: models.RejectReasonIP, IPHits: hits, Limit: window.AllowedRate, Window: window.Size}
+			break
+		}
+		if i == 0 || window.AllowedRate-hits < decision.Remaining {
+			decision.IPHits, decision.Limit, decision.Window, decision.Remaining = hits, window.AllowedRate, window.Size, window.AllowedRate-hits
+		}
+	}
+	if !decision.Allowed {
+		ipShard.shadowRejections[key]++
+		atomic.AddInt64(&r.shadowRejections, 1)
+		return decision
+	}
+	for _, shadowCounter := range shadowCounters {
+		shadowCounter.HitN(cost)
+	}
+	decision.IPHits += cost
+	decision.Remaining -= cost
+	return decision
+}
+
+// ShadowRejections returns the number of requests the shadow policy would have rejected for each tracked key
+// with at least one, the counts of a key are dropped when it is evicted.
+func (r *RateLimiter) ShadowRejections() map[string]int64 {
+	rejections := make(map[string]int64)
+	for _, ipShard := range r.shards {
+		ipShard.mu.Lock()
+		for key, count := range ipShard.shadowRejections {
+			rejections[key] = count
+		}
+		ipShard.mu.Unlock()
+	}
+	return rejections
+}
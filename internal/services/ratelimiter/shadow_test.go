@@ -0,0 +1,78 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/persistence_mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_Shadow(t *testing.T) {
+	newShadowRateLimiter := func(t *testing.T, config Config, fakeClock *clock.FakeClock) *RateLimiter {
+		ctrl := gomock.NewController(t)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		rateLimiterService, err := NewRateLimiter(config, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		return rateLimiterService
+	}
+	t.Run("should report would-be rejections without rejecting", func(t *testing.T) {
+		type rejection struct {
+			key      string
+			decision models.Decision
+		}
+		var rejections []rejection
+		config := testConfig
+		config.IPv4Prefix = 24
+		config.Shadow = []Window{{Size: 20 * time.Second, AllowedRate: 5}, {Size: time.Second, AllowedRate: 3}}
+		config.OnShadowReject = func(key string, decision models.Decision) {
+			rejections = append(rejections, rejection{key, decision})
+		}
+		rateLimiterService := newShadowRateLimiter(t, config, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		for i := 0; i < 3; i++ {
+			assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		}
+		assert.Empty(t, rejections)
+		decision := rateLimiterService.HitN("10.0.0.2", 2)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(15), decision.Limit)
+		assert.Equal(t, []rejection{{"10.0.0.0/24", models.Decision{Reason: models.RejectReasonIP, IPHits: 3, Limit: 3, Window: time.Second}}}, rejections)
+		assert.Equal(t, map[string]int64{"10.0.0.0/24": 1}, rateLimiterService.ShadowRejections())
+		assert.Equal(t, int64(1), rateLimiterService.Stats().ShadowRejections)
+	})
+	t.Run("should count only the requests the shadow policy allows", func(t *testing.T) {
+		config := testConfig
+		config.Shadow = []Window{{Size: 20 * time.Second, AllowedRate: 5}}
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		rateLimiterService := newShadowRateLimiter(t, config, fakeClock)
+		for i := 0; i < 10; i++ {
+			assert.True(t, rateLimiterService.Hit("10.0.0.1").Allowed)
+		}
+		assert.Equal(t, map[string]int64{"10.0.0.1": 5}, rateLimiterService.ShadowRejections())
+		assert.Equal(t, int64(5), rateLimiterService.shard("10.0.0.1").shadows["10.0.0.1"][0].Count())
+		fakeClock.Advance(21 * time.Second)
+		assert.Equal(t, int64(1), rateLimiterService.EvictIdle())
+		assert.Empty(t, rateLimiterService.ShadowRejections())
+	})
+	t.Run("should not evaluate the shadow policy for overridden keys", func(t *testing.T) {
+		config := testConfig
+		config.Shadow = []Window{{Size: 20 * time.Second, AllowedRate: 1}}
+		config.Overrides = []Override{{Key: "10.0.0.1", AllowedRate: 100}}
+		rateLimiterService := newShadowRateLimiter(t, config, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		rateLimiterService.Hit("10.0.0.1")
+		rateLimiterService.Hit("10.0.0.1")
+		assert.Empty(t, rateLimiterService.ShadowRejections())
+	})
+	t.Run("should return error on invalid shadow windows", func(t *testing.T) {
+		for _, shadow := range [][]Window{{{Size: 0, AllowedRate: 1}}, {{Size: time.Second}}, {{Size: time.Second, AllowedRate: 1}, {Size: time.Second, AllowedRate: 2}}} {
+			config := testConfig
+			config.Shadow = shadow
+			_, err := NewRateLimiter(config, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+			assert.Error(t, err)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package ratelimiter
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+)
+
+// DefaultShards is the number of shards the IP counters are split in when Config.Shards is not set.
+const DefaultShards = 32
+
+// shard holds the counters of the IPs hashed to it behind its own lock,
+// so that hits from IPs on different shards do not wait for each other.
+// Each IP has a counter for every window, nil until the window is first hit.
+type shard struct {
+	mu sync.Mutex
+	// stripe is the index of the shard, and of its stripe of the global counter
+	stripe   int
+	counters map[string][]services.CounterServiceInterface
+	// maxKeys caps the counters of the shard, recent orders them from the most to the least recently hit when it is set
+	maxKeys     int
+	recent      *list.List
+	recentIndex map[string]*list.Element
+	// penalties holds the rejections and bans of the keys, they are kept when the counters of a key are evicted
+	penalties map[string]*penalty
+	// shadows holds the counters of the shadow windows of the keys and shadowRejections the requests they would have rejected,
+	// both are evicted with the counters of the key
+	shadows          map[string][]services.CounterServiceInterface
+	shadowRejections map[string]int64
+	// forget is called with every evicted IP when it is set
+	forget func(ipAddr string)
+}
+
+func newShard(stripe, maxKeys int) *shard {
+	return &shard{
+		stripe:           stripe,
+		counters:         make(map[string][]services.CounterServiceInterface),
+		maxKeys:          maxKeys,
+		recent:           list.New(),
+		recentIndex:      make(map[string]*list.Element),
+		penalties:        make(map[string]*penalty),
+		shadows:          make(map[string][]services.CounterServiceInterface),
+		shadowRejections: make(map[string]int64),
+	}
+}
+
+// touch marks ipAddr as the most recently hit IP of the shard when maxKeys is set
+func (s *shard) touch(ipAddr string) {
+	if s.maxKeys <= 0 {
+		return
+	}
+	if element, ok := s.recentIndex[ipAddr]; ok {
+		s.recent.MoveToFront(element)
+		return
+	}
+	s.recentIndex[ipAddr] = s.recent.PushFront(ipAddr)
+}
+
+// evictOverCapacity evicts the least recently hit IPs until at most maxKeys are tracked and returns the number evicted
+func (s *shard) evictOverCapacity() int64 {
+	if s.maxKeys <= 0 {
+		return 0
+	}
+	var evicted int64
+	for s.recent.Len() > s.maxKeys {
+		ipAddr := s.recent.Remove(s.recent.Back()).(string)
+		delete(s.recentIndex, ipAddr)
+		s.evict(ipAddr)
+		evicted++
+	}
+	return evicted
+}
+
+// evictIdle evicts the IPs whose windows and shadow windows have all fully expired and returns the number evicted
+func (s *shard) evictIdle() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var evicted int64
+	for ipAddr, ipCounters := range s.counters {
+		if !idle(ipCounters) || !idle(s.shadows[ipAddr]) {
+			continue
+		}
+		s.evict(ipAddr)
+		if element, ok := s.recentIndex[ipAddr]; ok {
+			s.recent.Remove(element)
+			delete(s.recentIndex, ipAddr)
+		}
+		evicted++
+	}
+	return evicted
+}
+
+// evict drops the counters of ipAddr
+func (s *shard) evict(ipAddr string) {
+	delete(s.counters, ipAddr)
+	delete(s.shadows, ipAddr)
+	delete(s.shadowRejections, ipAddr)
+	if s.forget != nil {
+		s.forget(ipAddr)
+	}
+}
+
+// idle returns whether every window of ipCounters is empty
+func idle(ipCounters []services.CounterServiceInterface) bool {
+	for _, ipCounter := range ipCounters {
+		if ipCounter != nil && ipCounter.Count() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// shardIndex returns the shard of ipAddr among n shards by its FNV-1a hash
+func shardIndex(ipAddr string, n int) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(ipAddr); i++ {
+		hash ^= uint32(ipAddr[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(n))
+}
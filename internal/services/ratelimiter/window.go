@@ -0,0 +1,149 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/counter"
+)
+
+// WindowKeySeparator separates the key of an IP from the size or the period of its window in the persisted keys of additional windows,
+// like 10.0.0.1@1h0m0s or 10.0.0.1@month. The first window of an IP is persisted under its key alone.
+const WindowKeySeparator = "@"
+
+// maxPeriod bounds the length of a calendar period, a month across a daylight saving time change
+const maxPeriod = 31*24*time.Hour + time.Hour
+
+// Window is a sliding window limit, AllowedRate requests are allowed in Size.
+// A Window with a Period is a calendar quota instead, AllowedRate requests are allowed in each period
+// starting at the calendar boundaries of Config.QuotaLocation, its Size is ignored.
+type Window struct {
+	Size        time.Duration
+	AllowedRate int64
+	Period      counter.Period
+}
+
+// name returns the size of a sliding window or the period of a quota, as persisted in its key
+func (w Window) name() string {
+	if w.Period != "" {
+		return string(w.Period)
+	}
+	return w.Size.String()
+}
+
+// counter returns the counter of the window holding entries
+func (w Window) counter(mode counter.Mode, resolution time.Duration, location *time.Location, entries []models.Entry,
+	clk clock.Clock) services.CounterServiceInterface {
+	if w.Period != "" {
+		return counter.NewQuotaCounterService(w.Period, location, entries, clk)
+	}
+	return counter.New(mode, w.Size, resolution, entries, clk)
+}
+
+// ipWindows returns the windows of the IPs without an override, the IPWindowSize window first
+func ipWindows(config Config) []Window {
+	windows := []Window{{Size: config.IPWindowSize, AllowedRate: config.AllowedRate}}
+	return append(windows, config.Windows...)
+}
+
+// validateWindows returns an error when a window is empty, allows no requests or has the size or the period of another window
+func validateWindows(windows []Window) error {
+	names := map[string]bool{windows[0].name(): true}
+	for _, window := range windows[1:] {
+		if err := validateWindow(window); err != nil {
+			return err
+		}
+		if names[window.name()] {
+			return fmt.Errorf("window %s is configured more than once", window.name())
+		}
+		names[window.name()] = true
+	}
+	return nil
+}
+
+// validateWindow returns an error when window is empty, has an unknown period or allows no requests
+func validateWindow(window Window) error {
+	if window.Period != "" {
+		if _, err := counter.ParsePeriod(string(window.Period)); err != nil {
+			return err
+		}
+	} else if window.Size <= 0 {
+		return fmt.Errorf("window size %s must be positive", window.Size)
+	}
+	if window.AllowedRate <= 0 {
+		return fmt.Errorf("allowed rate of window %s must be positive", window.name())
+	}
+	return nil
+}
+
+// windowKey returns the key the i-th window of key is persisted under
+func windowKey(key string, windows []Window, i int) string {
+	if i == 0 {
+		return key
+	}
+	return key + WindowKeySeparator + windows[i].name()
+}
+
+// splitWindowKey returns the key and the index of the window persisted under persistedKey,
+// false when it is the key of a window which is no longer configured
+func splitWindowKey(persistedKey string, windows []Window) (string, int, bool) {
+	separator := strings.LastIndex(persistedKey, WindowKeySeparator)
+	if separator < 0 {
+		return persistedKey, 0, true
+	}
+	window, err := parseWindowName(persistedKey[separator+1:])
+	if err != nil {
+		// the key itself holds the separator
+		return persistedKey, 0, true
+	}
+	for i := 1; i < len(windows); i++ {
+		if windows[i].name() == window.name() {
+			return persistedKey[:separator], i, true
+		}
+	}
+	return "", 0, false
+}
+
+// parseWindowName returns the window of the size or the period name, like 1h or month
+func parseWindowName(name string) (Window, error) {
+	if period, err := counter.ParsePeriod(name); err == nil {
+		return Window{Period: period}, nil
+	}
+	size, err := time.ParseDuration(name)
+	if err != nil {
+		return Window{}, err
+	}
+	return Window{Size: size}, nil
+}
+
+// ParseWindows parses comma separated windows of the form rate/window, like 10/1s,1000/1h,
+// the window being a duration or a calendar period, day, week or month, like 100000/month.
+func ParseWindows(s string) ([]Window, error) {
+	var windows []Window
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("window %q: expected rate/window", field)
+		}
+		rate, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("window %q: invalid rate %s", field, parts[0])
+		}
+		window, err := parseWindowName(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("window %q: invalid window %s", field, parts[1])
+		}
+		window.AllowedRate = rate
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
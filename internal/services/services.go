@@ -1,18 +1,44 @@
 package services
 
-import "github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+import (
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+)
 
 //go:generate mockgen -source=services.go -destination=./services_mock/services_mock.go -package=services_mock
 
 // CounterServiceInterface handles the counter
+// HitN records n hits at once, Hit is HitN(1).
+// ExpiresAt returns the time at which at least n of the hits in the window will have slid out of it.
 type CounterServiceInterface interface {
 	Hit() int64
+	HitN(n int64) int64
 	Count() int64
 	Window() []models.Entry
+	ExpiresAt(n int64) time.Time
 }
 
 // RateLimiterInterface handles the rate limiting part and global counter
+// Hit records a request and returns the decision for it.
+// HitN is Hit for a request which costs cost hits, it is rate limited when the remaining budget is less than cost.
+// Peek returns the decision a request would get without recording it.
 type RateLimiterInterface interface {
-	Hit(ipAddr string) (int64, int64, bool)
+	Hit(ipAddr string) models.Decision
+	HitN(ipAddr string, cost int64) models.Decision
+	Peek(ipAddr string) models.Decision
 	Dump() error
 }
+
+// ConcurrencyLimiterInterface limits the requests in flight
+// Acquire takes a slot for a request if it is allowed and returns the decision with the func releasing the slot.
+type ConcurrencyLimiterInterface interface {
+	Acquire(ipAddr string) (models.Decision, func())
+}
+
+// PenaltyBoxInterface handles the bans of keys rejected repeatedly
+// Bans returns the banned keys and Unban lifts the ban of a key, returning false when it has none.
+type PenaltyBoxInterface interface {
+	Bans() []models.Ban
+	Unban(key string) bool
+}
@@ -6,9 +6,10 @@ package services_mock
 
 import (
 	reflect "reflect"
-	models "github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
+	models "github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
 )
 
 // MockCounterServiceInterface is a mock of CounterServiceInterface interface.
@@ -48,6 +49,20 @@ func (mr *MockCounterServiceInterfaceMockRecorder) Count() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Count", reflect.TypeOf((*MockCounterServiceInterface)(nil).Count))
 }
 
+// ExpiresAt mocks base method.
+func (m *MockCounterServiceInterface) ExpiresAt(n int64) time.Time {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpiresAt", n)
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// ExpiresAt indicates an expected call of ExpiresAt.
+func (mr *MockCounterServiceInterfaceMockRecorder) ExpiresAt(n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpiresAt", reflect.TypeOf((*MockCounterServiceInterface)(nil).ExpiresAt), n)
+}
+
 // Hit mocks base method.
 func (m *MockCounterServiceInterface) Hit() int64 {
 	m.ctrl.T.Helper()
@@ -62,6 +77,20 @@ func (mr *MockCounterServiceInterfaceMockRecorder) Hit() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Hit", reflect.TypeOf((*MockCounterServiceInterface)(nil).Hit))
 }
 
+// HitN mocks base method.
+func (m *MockCounterServiceInterface) HitN(n int64) int64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HitN", n)
+	ret0, _ := ret[0].(int64)
+	return ret0
+}
+
+// HitN indicates an expected call of HitN.
+func (mr *MockCounterServiceInterfaceMockRecorder) HitN(n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HitN", reflect.TypeOf((*MockCounterServiceInterface)(nil).HitN), n)
+}
+
 // Window mocks base method.
 func (m *MockCounterServiceInterface) Window() []models.Entry {
 	m.ctrl.T.Helper()
@@ -114,13 +143,11 @@ func (mr *MockRateLimiterInterfaceMockRecorder) Dump() *gomock.Call {
 }
 
 // Hit mocks base method.
-func (m *MockRateLimiterInterface) Hit(ipAddr string) (int64, int64, bool) {
+func (m *MockRateLimiterInterface) Hit(ipAddr string) models.Decision {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Hit", ipAddr)
-	ret0, _ := ret[0].(int64)
-	ret1, _ := ret[1].(int64)
-	ret2, _ := ret[2].(bool)
-	return ret0, ret1, ret2
+	ret0, _ := ret[0].(models.Decision)
+	return ret0
 }
 
 // Hit indicates an expected call of Hit.
@@ -128,3 +155,120 @@ func (mr *MockRateLimiterInterfaceMockRecorder) Hit(ipAddr interface{}) *gomock.
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Hit", reflect.TypeOf((*MockRateLimiterInterface)(nil).Hit), ipAddr)
 }
+
+// HitN mocks base method.
+func (m *MockRateLimiterInterface) HitN(ipAddr string, cost int64) models.Decision {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HitN", ipAddr, cost)
+	ret0, _ := ret[0].(models.Decision)
+	return ret0
+}
+
+// HitN indicates an expected call of HitN.
+func (mr *MockRateLimiterInterfaceMockRecorder) HitN(ipAddr, cost interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HitN", reflect.TypeOf((*MockRateLimiterInterface)(nil).HitN), ipAddr, cost)
+}
+
+// Peek mocks base method.
+func (m *MockRateLimiterInterface) Peek(ipAddr string) models.Decision {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Peek", ipAddr)
+	ret0, _ := ret[0].(models.Decision)
+	return ret0
+}
+
+// Peek indicates an expected call of Peek.
+func (mr *MockRateLimiterInterfaceMockRecorder) Peek(ipAddr interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Peek", reflect.TypeOf((*MockRateLimiterInterface)(nil).Peek), ipAddr)
+}
+
+// MockConcurrencyLimiterInterface is a mock of ConcurrencyLimiterInterface interface.
+type MockConcurrencyLimiterInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockConcurrencyLimiterInterfaceMockRecorder
+}
+
+// MockConcurrencyLimiterInterfaceMockRecorder is the mock recorder for MockConcurrencyLimiterInterface.
+type MockConcurrencyLimiterInterfaceMockRecorder struct {
+	mock *MockConcurrencyLimiterInterface
+}
+
+// NewMockConcurrencyLimiterInterface creates a new mock instance.
+func NewMockConcurrencyLimiterInterface(ctrl *gomock.Controller) *MockConcurrencyLimiterInterface {
+	mock := &MockConcurrencyLimiterInterface{ctrl: ctrl}
+	mock.recorder = &MockConcurrencyLimiterInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockConcurrencyLimiterInterface) EXPECT() *MockConcurrencyLimiterInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Acquire mocks base method.
+func (m *MockConcurrencyLimiterInterface) Acquire(ipAddr string) (models.Decision, func()) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Acquire", ipAddr)
+	ret0, _ := ret[0].(models.Decision)
+	ret1, _ := ret[1].(func())
+	return ret0, ret1
+}
+
+// Acquire indicates an expected call of Acquire.
+func (mr *MockConcurrencyLimiterInterfaceMockRecorder) Acquire(ipAddr interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Acquire", reflect.TypeOf((*MockConcurrencyLimiterInterface)(nil).Acquire), ipAddr)
+}
+
+// MockPenaltyBoxInterface is a mock of PenaltyBoxInterface interface.
+type MockPenaltyBoxInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockPenaltyBoxInterfaceMockRecorder
+}
+
+// MockPenaltyBoxInterfaceMockRecorder is the mock recorder for MockPenaltyBoxInterface.
+type MockPenaltyBoxInterfaceMockRecorder struct {
+	mock *MockPenaltyBoxInterface
+}
+
+// NewMockPenaltyBoxInterface creates a new mock instance.
+func NewMockPenaltyBoxInterface(ctrl *gomock.Controller) *MockPenaltyBoxInterface {
+	mock := &MockPenaltyBoxInterface{ctrl: ctrl}
+	mock.recorder = &MockPenaltyBoxInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockPenaltyBoxInterface) EXPECT() *MockPenaltyBoxInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Bans mocks base method.
+func (m *MockPenaltyBoxInterface) Bans() []models.Ban {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Bans")
+	ret0, _ := ret[0].([]models.Ban)
+	return ret0
+}
+
+// Bans indicates an expected call of Bans.
+func (mr *MockPenaltyBoxInterfaceMockRecorder) Bans() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Bans", reflect.TypeOf((*MockPenaltyBoxInterface)(nil).Bans))
+}
+
+// Unban mocks base method.
+func (m *MockPenaltyBoxInterface) Unban(key string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unban", key)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Unban indicates an expected call of Unban.
+func (mr *MockPenaltyBoxInterfaceMockRecorder) Unban(key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unban", reflect.TypeOf((*MockPenaltyBoxInterface)(nil).Unban), key)
+}
@@ -0,0 +1,275 @@
+package tokenbucket
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/ipkey"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence"
+)
+
+// GlobalBucketKey is the key to store the global bucket, an IP keyed GlobalBucketKey is limited but not persisted.
+const GlobalBucketKey = "GLOBAL"
+
+var (
+	// ErrInvalidCapacity is returned when the IP bucket capacity is not positive.
+	ErrInvalidCapacity = errors.New("token bucket capacity must be positive")
+	// ErrInvalidRefillInterval is returned when a refill interval of an enabled bucket is not positive.
+	ErrInvalidRefillInterval = errors.New("token bucket refill interval must be positive")
+)
+
+// Config is the configuration of a TokenBucket.
+type Config struct {
+	// Capacity is the number of tokens an IP bucket holds, it is the burst allowed for an IP.
+	Capacity int64
+	// RefillInterval is the time it takes to add one token to an IP bucket.
+	RefillInterval time.Duration
+	// GlobalCapacity is the number of tokens the global bucket holds, 0 disables global limiting.
+	GlobalCapacity int64
+	// GlobalRefillInterval is the time it takes to add one token to the global bucket.
+	GlobalRefillInterval time.Duration
+	// IPv4Prefix and IPv6Prefix are the prefix lengths IP addresses are keyed by, like 24 and 64,
+	// so that every address of a network shares its limit. 0 keeps each address as its own key.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// bucket holds the tokens left for a key and the time tokens were last added
+type bucket struct {
+	capacity       int64
+	refillInterval time.Duration
+	tokens         int64
+	lastRefill     time.Time
+}
+
+// refill adds the tokens earned since lastRefill, the time left over from a partial token is kept for the next refill
+func (b *bucket) refill(now time.Time) {
+	if b.tokens >= b.capacity {
+		b.tokens = b.capacity
+		b.lastRefill = now
+		return
+	}
+	earned := int64(now.Sub(b.lastRefill) / b.refillInterval)
+	if earned <= 0 {
+		return
+	}
+	b.tokens += earned
+	b.lastRefill = b.lastRefill.Add(time.Duration(earned) * b.refillInterval)
+	if b.tokens >= b.capacity {
+		b.tokens = b.capacity
+		b.lastRefill = now
+	}
+}
+
+// used returns the number of tokens taken out of the bucket
+func (b *bucket) used() int64 {
+	return b.capacity - b.tokens
+}
+
+// availableAt returns the time the bucket holds n tokens, now if it already does
+func (b *bucket) availableAt(n int64, now time.Time) time.Time {
+	if b.tokens >= n {
+		return now
+	}
+	return b.lastRefill.Add(time.Duration(n-b.tokens) * b.refillInterval)
+}
+
+// TokenBucket is a rate limiter which refills each IP bucket at a steady rate and allows bursts up to the bucket capacity.
+type TokenBucket struct {
+	mu sync.Mutex
+	// buckets holds the bucket of each key, the full buckets are deleted by a sweep at most once per refill of an IP bucket
+	buckets map[string]*bucket
+	// global is the global bucket, nil when global limiting is disabled. It is kept apart from buckets so that no IP key can share it
+	global *bucket
+	// nextSweep is the time of the next sweep of buckets
+	nextSweep  time.Time
+	config     Config
+	normalizer ipkey.Normalizer
+	// persistence is to load and dump the buckets
+	persistence persistence.Persistence
+	clock       clock.Clock
+	// dumpMu orders the dumps, which are written without holding mu
+	dumpMu sync.Mutex
+}
+
+// NewTokenBucket returns a TokenBucket with the provided configuration.
+// Buckets are loaded from dataPersistence, each key is persisted as a single entry
+// with the last refill time and the number of tokens used as hits.
+// clk is the time source used to refill the buckets.
+func NewTokenBucket(config Config, dataPersistence persistence.Persistence, clk clock.Clock) (*TokenBucket, error) {
+	if config.Capacity <= 0 {
+		return nil, ErrInvalidCapacity
+	}
+	if config.RefillInterval <= 0 || (config.GlobalCapacity > 0 && config.GlobalRefillInterval <= 0) {
+		return nil, ErrInvalidRefillInterval
+	}
+	normalizer, err := ipkey.NewNormalizer(config.IPv4Prefix, config.IPv6Prefix)
+	if err != nil {
+		return nil, err
+	}
+	bucketEntries, err := dataPersistence.Load()
+	if err != nil {
+		return nil, err
+	}
+	t := &TokenBucket{
+		mu:          sync.Mutex{},
+		buckets:     make(map[string]*bucket),
+		config:      config,
+		normalizer:  normalizer,
+		persistence: dataPersistence,
+		clock:       clk,
+	}
+	if config.GlobalCapacity > 0 {
+		t.global = t.newBucket(config.GlobalCapacity, config.GlobalRefillInterval)
+	}
+	for key, entries := range bucketEntries {
+		if len(entries) == 0 || (key == GlobalBucketKey && t.global == nil) {
+			continue
+		}
+		b := t.global
+		if key != GlobalBucketKey {
+			b = t.newBucket(config.Capacity, config.RefillInterval)
+			t.buckets[key] = b
+		}
+		entry := entries[len(entries)-1]
+		b.tokens = b.capacity - entry.Hits
+		if b.tokens < 0 {
+			b.tokens = 0
+		}
+		b.lastRefill = time.Unix(0, entry.UnixNano())
+	}
+	return t, nil
+}
+
+// newBucket returns a full bucket of capacity refilled every refillInterval
+func (t *TokenBucket) newBucket(capacity int64, refillInterval time.Duration) *bucket {
+	return &bucket{capacity: capacity, refillInterval: refillInterval, tokens: capacity, lastRefill: t.clock.Now()}
+}
+
+// getBucket returns the refilled bucket of the IP key, creating it if not found
+func (t *TokenBucket) getBucket(key string, now time.Time) *bucket {
+	b, ok := t.buckets[key]
+	if !ok {
+		b = t.newBucket(t.config.Capacity, t.config.RefillInterval)
+		t.buckets[key] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// Hit takes a token from the IP bucket and the global bucket.
+// A token is taken only if both buckets have one, rate limited requests take no tokens.
+// The hits of the decision are the tokens used from the buckets.
+func (t *TokenBucket) Hit(ipAddr string) models.Decision {
+	return t.HitN(ipAddr, 1)
+}
+
+// HitN takes cost tokens from the IP bucket and the global bucket, the request is rate limited when either bucket has less than cost tokens.
+// Costs below 1 are counted as 1.
+func (t *TokenBucket) HitN(ipAddr string, cost int64) models.Decision {
+	if cost < 1 {
+		cost = 1
+	}
+	key := t.normalizer.Key(ipAddr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	t.sweep(now)
+	return t.decide(t.getBucket(key, now), cost, now, true)
+}
+
+// sweep deletes the buckets which are full at now, which are the same as no bucket at all.
+// An IP bucket is full at most a refill of its capacity after the last request of its key, so sweeping once per refill
+// keeps only the buckets hit in the last two refills while costing a walk of buckets per refill. The caller holds mu.
+func (t *TokenBucket) sweep(now time.Time) {
+	if now.Before(t.nextSweep) {
+		return
+	}
+	for key, b := range t.buckets {
+		b.refill(now)
+		if b.used() == 0 {
+			delete(t.buckets, key)
+		}
+	}
+	t.nextSweep = now.Add(time.Duration(t.config.Capacity) * t.config.RefillInterval)
+}
+
+// Peek returns the decision for a request from ipAddr without taking tokens.
+func (t *TokenBucket) Peek(ipAddr string) models.Decision {
+	key := t.normalizer.Key(ipAddr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	ipBucket, ok := t.buckets[key]
+	if !ok {
+		ipBucket = t.newBucket(t.config.Capacity, t.config.RefillInterval)
+	}
+	ipBucket.refill(now)
+	return t.decide(ipBucket, 1, now, false)
+}
+
+// decide returns the decision for a request costing cost and takes the tokens when take is set and it is allowed
+func (t *TokenBucket) decide(ipBucket *bucket, cost int64, now time.Time, take bool) models.Decision {
+	globalBucket := t.global
+	if globalBucket != nil {
+		globalBucket.refill(now)
+	}
+
+	decision := models.Decision{Allowed: true}
+	switch {
+	case ipBucket.tokens < cost:
+		decision.Allowed, decision.Reason = false, models.RejectReasonIP
+	case globalBucket != nil && globalBucket.tokens < cost:
+		decision.Allowed, decision.Reason = false, models.RejectReasonGlobal
+	case take:
+		ipBucket.tokens -= cost
+		if globalBucket != nil {
+			globalBucket.tokens -= cost
+		}
+	}
+
+	decision.IPHits = ipBucket.used()
+	if globalBucket != nil {
+		decision.GlobalHits = globalBucket.used()
+	}
+	// report the bucket the request is rejected by, or the one with fewer tokens
+	limitBucket := ipBucket
+	if decision.Reason == models.RejectReasonGlobal || (decision.Allowed && globalBucket != nil && globalBucket.tokens < ipBucket.tokens) {
+		limitBucket = globalBucket
+	}
+	decision.Limit = limitBucket.capacity
+	decision.Remaining = limitBucket.tokens
+	decision.ResetAt = limitBucket.availableAt(limitBucket.capacity, now)
+	if !decision.Allowed {
+		decision.RetryAfter = limitBucket.availableAt(cost, now).Sub(now)
+	}
+	return decision
+}
+
+// Dump dumps the buckets which are not full to the underlying persistence storage.
+// The buckets are locked only while they are copied, dumps run one at a time.
+func (t *TokenBucket) Dump() error {
+	t.dumpMu.Lock()
+	defer t.dumpMu.Unlock()
+	t.mu.Lock()
+	now := t.clock.Now()
+	var bucketEntries = make(map[string][]models.Entry)
+	for key, b := range t.buckets {
+		b.refill(now)
+		if b.used() > 0 && key != GlobalBucketKey {
+			bucketEntries[key] = []models.Entry{models.NewEntry(b.lastRefill, b.used())}
+		}
+	}
+	if t.global != nil {
+		t.global.refill(now)
+		if t.global.used() > 0 {
+			bucketEntries[GlobalBucketKey] = []models.Entry{models.NewEntry(t.global.lastRefill, t.global.used())}
+		}
+	}
+	t.mu.Unlock()
+
+	return t.persistence.Dump(bucketEntries)
+}
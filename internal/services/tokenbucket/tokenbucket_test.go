@@ -0,0 +1,344 @@
+package tokenbucket
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/persistence_mock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = Config{Capacity: 5, RefillInterval: time.Second}
+
+func TestNewTokenBucket(t *testing.T) {
+	t.Run("should return error when persistence load fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(nil, errors.New("something failed while loading persisted file"))
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.Error(t, err)
+		assert.Nil(t, tokenBucket)
+	})
+
+	t.Run("should return error on invalid configuration", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		_, err := NewTokenBucket(Config{RefillInterval: time.Second}, mockPersistence, fakeClock)
+		assert.Equal(t, ErrInvalidCapacity, err)
+		_, err = NewTokenBucket(Config{Capacity: 5}, mockPersistence, fakeClock)
+		assert.Equal(t, ErrInvalidRefillInterval, err)
+		_, err = NewTokenBucket(Config{Capacity: 5, RefillInterval: time.Second, GlobalCapacity: 10}, mockPersistence, fakeClock)
+		assert.Equal(t, ErrInvalidRefillInterval, err)
+	})
+
+	t.Run("should restore used tokens from loaded entries and refill since the persisted time", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{ipAddr: {{EpochTimestamp: epochNow - 2, Hits: 5}}}, nil)
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		decision := tokenBucket.Hit(ipAddr)
+		assert.Equal(t, int64(4), decision.IPHits)
+		assert.True(t, decision.Allowed)
+	})
+}
+
+func TestTokenBucket_Hit(t *testing.T) {
+	t.Run("should allow a burst up to capacity and rate limit after", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		for i := 1; i <= 5; i++ {
+			decision := tokenBucket.Hit(ipAddr)
+			assert.Equal(t, int64(i), decision.IPHits)
+			assert.True(t, decision.Allowed)
+		}
+		decision := tokenBucket.Hit(ipAddr)
+		assert.Equal(t, int64(5), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+	})
+
+	t.Run("should refill one token per refill interval keeping partial progress", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			tokenBucket.Hit(ipAddr)
+		}
+		fakeClock.Advance(1500 * time.Millisecond)
+		decision := tokenBucket.Hit(ipAddr)
+		assert.True(t, decision.Allowed)
+		decision = tokenBucket.Hit(ipAddr)
+		assert.False(t, decision.Allowed)
+		fakeClock.Advance(500 * time.Millisecond)
+		decision = tokenBucket.Hit(ipAddr)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("should not refill beyond capacity", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		tokenBucket.Hit(ipAddr)
+		fakeClock.Advance(time.Hour)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if tokenBucket.Hit(ipAddr).Allowed {
+				allowed++
+			}
+		}
+		assert.Equal(t, 5, allowed)
+	})
+
+	t.Run("should rate limit with global reason when the global bucket is empty", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := Config{Capacity: 5, RefillInterval: time.Second, GlobalCapacity: 3, GlobalRefillInterval: time.Second}
+		tokenBucket, err := NewTokenBucket(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		tokenBucket.Hit("10.0.0.1")
+		tokenBucket.Hit("10.0.0.2")
+		decision := tokenBucket.Hit("10.0.0.3")
+		assert.Equal(t, int64(3), decision.GlobalHits)
+		assert.True(t, decision.Allowed)
+		decision = tokenBucket.Hit("10.0.0.4")
+		assert.Equal(t, int64(3), decision.GlobalHits)
+		assert.Equal(t, int64(0), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, models.RejectReasonGlobal, decision.Reason)
+	})
+
+	t.Run("should take cost tokens and rate limit when fewer tokens are left", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		decision := tokenBucket.HitN(ipAddr, 3)
+		assert.Equal(t, int64(3), decision.IPHits)
+		assert.True(t, decision.Allowed)
+		decision = tokenBucket.HitN(ipAddr, 3)
+		assert.Equal(t, int64(3), decision.IPHits)
+		assert.False(t, decision.Allowed)
+		decision = tokenBucket.HitN(ipAddr, 2)
+		assert.Equal(t, int64(5), decision.IPHits)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("do concurrent requests and ensure only capacity tokens are taken", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		tokenBucket, err := NewTokenBucket(Config{Capacity: 15, RefillInterval: time.Second}, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tokenBucket.Hit(ipAddr)
+				tokenBucket.Hit(ipAddr)
+				tokenBucket.Hit(ipAddr)
+			}()
+		}
+		wg.Wait()
+		decision := tokenBucket.Hit(ipAddr)
+		assert.Equal(t, int64(15), decision.IPHits)
+		assert.False(t, decision.Allowed)
+	})
+}
+
+func TestTokenBucket_Sweep(t *testing.T) {
+	t.Run("should delete the buckets which are full again once per refill", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			tokenBucket.Hit(fmt.Sprintf("10.0.0.%d", i))
+		}
+		tokenBucket.HitN("10.0.1.1", 5)
+		assert.Len(t, tokenBucket.buckets, 101)
+		// the refill of 5 seconds has not passed since the last sweep, the buckets full again are kept
+		fakeClock.Advance(2 * time.Second)
+		tokenBucket.Hit("10.0.1.2")
+		assert.Len(t, tokenBucket.buckets, 102)
+		fakeClock.Advance(3 * time.Second)
+		tokenBucket.Hit("10.0.1.3")
+		assert.Equal(t, []string{"10.0.1.3"}, keys(tokenBucket.buckets))
+		assert.Equal(t, int64(4), tokenBucket.Hit("10.0.0.1").Remaining)
+	})
+}
+
+// keys returns the keys of buckets sorted
+func keys(buckets map[string]*bucket) []string {
+	sorted := make([]string, 0, len(buckets))
+	for key := range buckets {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func TestTokenBucket_Decision(t *testing.T) {
+	t.Run("should report tokens left, the time the bucket is full and the time enough tokens are added", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		decision := tokenBucket.HitN(ipAddr, 4)
+		assert.Equal(t, models.Decision{Allowed: true, IPHits: 4, Limit: 5, Remaining: 1, ResetAt: time.Unix(epochNow+4, 0)}, decision)
+		decision = tokenBucket.HitN(ipAddr, 3)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, 2*time.Second, decision.RetryAfter)
+	})
+
+	t.Run("should peek without taking tokens", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ipAddr := "10.0.0.1"
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		tokenBucket.HitN(ipAddr, 5)
+		for i := 0; i < 3; i++ {
+			decision := tokenBucket.Peek(ipAddr)
+			assert.False(t, decision.Allowed)
+			assert.Equal(t, time.Second, decision.RetryAfter)
+		}
+		assert.Equal(t, int64(5), tokenBucket.Peek("10.0.0.2").Remaining)
+		assert.Len(t, tokenBucket.buckets, 1)
+	})
+}
+
+func TestTokenBucket_Dump(t *testing.T) {
+	t.Run("should dump buckets which are not full", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		fakeClock := clock.NewFakeClock(time.Unix(epochNow, 0))
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, fakeClock)
+		assert.NoError(t, err)
+		tokenBucket.Hit("10.0.0.1")
+		tokenBucket.Hit("10.0.0.1")
+		tokenBucket.Hit("10.0.0.2")
+		fakeClock.Advance(1500 * time.Millisecond)
+		mockPersistence.EXPECT().Dump(map[string][]models.Entry{
+			"10.0.0.1": {{EpochTimestamp: epochNow + 1, Hits: 1}},
+		}).Return(nil)
+		err = tokenBucket.Dump()
+		assert.NoError(t, err)
+	})
+
+	t.Run("should return error when persistence returns error", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		tokenBucket.Hit("10.0.0.1")
+		mockPersistence.EXPECT().Dump(gomock.Any()).Return(errors.New("some error occurred while dumping"))
+		err = tokenBucket.Dump()
+		assert.EqualError(t, err, "some error occurred while dumping")
+	})
+}
+
+func TestTokenBucket_GlobalKey(t *testing.T) {
+	t.Run("should keep an IP keyed GLOBAL apart from the global bucket", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		epochNow := int64(1624974458)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil).Times(2)
+		tokenBucket, err := NewTokenBucket(testConfig, mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		assert.True(t, tokenBucket.Hit(GlobalBucketKey).Allowed)
+		mockPersistence.EXPECT().Dump(map[string][]models.Entry{}).Return(nil)
+		assert.NoError(t, tokenBucket.Dump())
+
+		tokenBucket, err = NewTokenBucket(Config{Capacity: 5, RefillInterval: time.Second, GlobalCapacity: 10, GlobalRefillInterval: time.Second},
+			mockPersistence, clock.NewFakeClock(time.Unix(epochNow, 0)))
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			assert.True(t, tokenBucket.Hit(GlobalBucketKey).Allowed)
+		}
+		decision := tokenBucket.Hit(GlobalBucketKey)
+		assert.Equal(t, models.RejectReasonIP, decision.Reason)
+		assert.Equal(t, int64(5), decision.GlobalHits)
+		mockPersistence.EXPECT().Dump(map[string][]models.Entry{
+			GlobalBucketKey: {{EpochTimestamp: epochNow, Hits: 5}},
+		}).Return(nil)
+		assert.NoError(t, tokenBucket.Dump())
+	})
+}
+
+func TestTokenBucket_Prefix(t *testing.T) {
+	t.Run("should share the bucket between the addresses of a network", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(map[string][]models.Entry{}, nil)
+		config := testConfig
+		config.IPv4Prefix = 24
+		limiter, err := NewTokenBucket(config, mockPersistence, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			assert.True(t, limiter.Hit(fmt.Sprintf("203.0.113.%d", i)).Allowed)
+		}
+		assert.False(t, limiter.Hit("203.0.113.200").Allowed)
+		assert.True(t, limiter.Hit("203.0.114.1").Allowed)
+		_, ok := limiter.buckets["203.0.113.0/24"]
+		assert.True(t, ok)
+	})
+	t.Run("should return error on invalid prefix lengths", func(t *testing.T) {
+		config := testConfig
+		config.IPv4Prefix = 33
+		_, err := NewTokenBucket(config, nil, clock.NewFakeClock(time.Unix(1624974458, 0)))
+		assert.Error(t, err)
+	})
+}
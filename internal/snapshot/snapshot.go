@@ -0,0 +1,96 @@
+// Package snapshot dumps a limiter periodically while it serves requests,
+// so that a crash loses at most the hits of one interval instead of everything since the last shutdown.
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+)
+
+// ErrInvalidInterval is returned when the snapshot interval is not positive.
+var ErrInvalidInterval = errors.New("snapshot interval must be positive")
+
+// Dumper dumps its state to its persistence, it is called while requests are being served.
+type Dumper interface {
+	Dump() error
+}
+
+// Stats are the snapshots taken by a Scheduler.
+type Stats struct {
+	// Snapshots is the number of snapshots written and Failures the number of snapshots which failed.
+	Snapshots int64
+	Failures  int64
+	// LastSnapshot is when the last snapshot was written and LastDuration how long writing it took.
+	LastSnapshot time.Time
+	LastDuration time.Duration
+	// LastError is the error of the last failed snapshot, empty once a snapshot succeeds.
+	LastError string
+}
+
+// Scheduler dumps a Dumper every interval.
+type Scheduler struct {
+	dumper   Dumper
+	interval time.Duration
+	clock    clock.Clock
+	mu       sync.Mutex
+	stats    Stats
+}
+
+// NewScheduler returns a Scheduler dumping dumper every interval once it runs, clk times the snapshots.
+func NewScheduler(dumper Dumper, interval time.Duration, clk clock.Clock) (*Scheduler, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	return &Scheduler{
+		dumper:   dumper,
+		interval: interval,
+		clock:    clk,
+	}, nil
+}
+
+// Run takes a snapshot every interval until ctx is done, failed snapshots are logged and retried on the next tick.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				log.Printf("snapshot failed %s", err.Error())
+			}
+		}
+	}
+}
+
+// Snapshot dumps the Dumper now and records the outcome in the Stats.
+func (s *Scheduler) Snapshot() error {
+	start := s.clock.Now()
+	err := s.dumper.Dump()
+	end := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.stats.Failures++
+		s.stats.LastError = err.Error()
+		return err
+	}
+	s.stats.Snapshots++
+	s.stats.LastSnapshot = end
+	s.stats.LastDuration = end.Sub(start)
+	s.stats.LastError = ""
+	return nil
+}
+
+// Stats returns the snapshots taken so far.
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
@@ -0,0 +1,97 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/jsonpersistence"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/ratelimiter"
+	"github.com/stretchr/testify/assert"
+)
+
+// dumpFunc is a Dumper calling itself
+type dumpFunc func() error
+
+func (f dumpFunc) Dump() error {
+	return f()
+}
+
+func TestNewScheduler(t *testing.T) {
+	t.Run("should return error on invalid interval", func(t *testing.T) {
+		_, err := NewScheduler(dumpFunc(func() error { return nil }), 0, clock.RealClock{})
+		assert.Equal(t, ErrInvalidInterval, err)
+	})
+}
+
+func TestScheduler_Snapshot(t *testing.T) {
+	t.Run("should record the snapshots and the failures", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		var dumpErr error
+		scheduler, err := NewScheduler(dumpFunc(func() error {
+			fakeClock.Advance(10 * time.Millisecond)
+			return dumpErr
+		}), time.Minute, fakeClock)
+		assert.NoError(t, err)
+		assert.NoError(t, scheduler.Snapshot())
+		assert.Equal(t, Stats{Snapshots: 1, LastSnapshot: time.Unix(1624974458, 0).Add(10 * time.Millisecond), LastDuration: 10 * time.Millisecond},
+			scheduler.Stats())
+		dumpErr = errors.New("disk full")
+		assert.Equal(t, dumpErr, scheduler.Snapshot())
+		stats := scheduler.Stats()
+		assert.Equal(t, int64(1), stats.Snapshots)
+		assert.Equal(t, int64(1), stats.Failures)
+		assert.Equal(t, "disk full", stats.LastError)
+	})
+}
+
+func TestScheduler_Run(t *testing.T) {
+	t.Run("should dump the limiter repeatedly while it serves requests", func(t *testing.T) {
+		dumpFile := filepath.Join(t.TempDir(), "dump.json")
+		jsonPersistence, err := jsonpersistence.NewFilePersistence(dumpFile)
+		assert.NoError(t, err)
+		rateLimiterService, err := ratelimiter.NewRateLimiter(ratelimiter.Config{
+			GlobalWindowSize: time.Minute, IPWindowSize: time.Minute, AllowedRate: 1000,
+		}, jsonPersistence, clock.RealClock{})
+		assert.NoError(t, err)
+		scheduler, err := NewScheduler(rateLimiterService, time.Millisecond, clock.RealClock{})
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			scheduler.Run(ctx)
+			close(done)
+		}()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					rateLimiterService.Hit("10.0.0.1")
+					time.Sleep(100 * time.Microsecond)
+				}
+			}()
+		}
+		wg.Wait()
+		for scheduler.Stats().Snapshots < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		<-done
+		assert.Zero(t, scheduler.Stats().Failures)
+
+		assert.NoError(t, scheduler.Snapshot())
+		entries, err := jsonPersistence.Load()
+		assert.NoError(t, err)
+		var hits int64
+		for _, entry := range entries["10.0.0.1"] {
+			hits += entry.Hits
+		}
+		assert.Equal(t, int64(400), hits)
+	})
+}
@@ -0,0 +1,532 @@
+// Package limiter is the public API of the rate limiter, it lets other Go services limit requests in process
+// with the sliding window, token bucket or GCRA algorithms instead of running the limiter as an HTTP service.
+//
+// A Limiter is built with New and configured with options:
+//
+//	l, err := limiter.New(
+//		limiter.WithLimit(15, 20*time.Second),
+//		limiter.WithGlobalLimit(100, time.Minute),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	if decision := l.Hit(ip); !decision.Allowed {
+//		// reject, retry after decision.RetryAfter
+//	}
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/models"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/concurrency"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/counter"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/gcra"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/ratelimiter"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/services/tokenbucket"
+)
+
+// Decision is the result of a hit or a peek, see Limiter.
+type Decision = models.Decision
+
+// RejectReason is the limit which rejected a request.
+type RejectReason = models.RejectReason
+
+const (
+	// RejectReasonNone is the reason of allowed requests.
+	RejectReasonNone = models.RejectReasonNone
+	// RejectReasonGlobal is the reason of requests rejected by the global limit.
+	RejectReasonGlobal = models.RejectReasonGlobal
+	// RejectReasonIP is the reason of requests rejected by the limit of their key.
+	RejectReasonIP = models.RejectReasonIP
+	// RejectReasonDenied is the reason of requests from keys denied by an override.
+	RejectReasonDenied = models.RejectReasonDenied
+	// RejectReasonBanned is the reason of requests from keys banned by the penalty box, see WithPenalty.
+	RejectReasonBanned = models.RejectReasonBanned
+	// RejectReasonConcurrency is the reason of requests rejected by the in-flight limit of their key.
+	RejectReasonConcurrency = models.RejectReasonConcurrency
+	// RejectReasonGlobalConcurrency is the reason of requests rejected by the global in-flight limit.
+	RejectReasonGlobalConcurrency = models.RejectReasonGlobalConcurrency
+)
+
+// Override replaces the limit of a key or of every IP in a CIDR, see WithOverrides.
+type Override = ratelimiter.Override
+
+// OverrideAction is what an Override does with the requests of the keys it matches.
+type OverrideAction = ratelimiter.OverrideAction
+
+const (
+	// OverrideLimit limits each matched key to the rate and window of the override.
+	OverrideLimit = ratelimiter.OverrideLimit
+	// OverrideUnlimited allows every request of the matched keys without counting it.
+	OverrideUnlimited = ratelimiter.OverrideUnlimited
+	// OverrideDeny rejects every request of the matched keys.
+	OverrideDeny = ratelimiter.OverrideDeny
+)
+
+// Window is an additional sliding window limit or a calendar quota, see WithWindows.
+type Window = ratelimiter.Window
+
+// Period is the calendar period of a quota Window.
+type Period = counter.Period
+
+const (
+	// PeriodDay resets at midnight.
+	PeriodDay = counter.PeriodDay
+	// PeriodWeek resets at midnight on Monday.
+	PeriodWeek = counter.PeriodWeek
+	// PeriodMonth resets at midnight on the first day of the month.
+	PeriodMonth = counter.PeriodMonth
+)
+
+// ParseWindows parses comma separated windows of the form rate/window, like 10/1s,1000/1h,
+// the window being a duration or a calendar period, day, week or month, like 100000/month.
+func ParseWindows(s string) ([]Window, error) {
+	return ratelimiter.ParseWindows(s)
+}
+
+// ParseOverrides parses comma separated overrides of the form key=action, the action being deny, unlimited
+// or a limit of rate/window, like 10.0.0.0/8=unlimited,203.0.113.7=500/1m,198.51.100.0/24=deny.
+func ParseOverrides(s string) ([]Override, error) {
+	return ratelimiter.ParseOverrides(s)
+}
+
+// Penalty configures the penalty box banning keys which keep getting rejected, see WithPenalty.
+type Penalty = ratelimiter.Penalty
+
+// ShadowRejectFunc is called with the key and the decision of the shadow policy for every request it would reject, see WithShadow.
+type ShadowRejectFunc = ratelimiter.ShadowRejectFunc
+
+// Ban is a key banned by the penalty box.
+type Ban = models.Ban
+
+// Entry is a persisted bucket of hits.
+type Entry = models.Entry
+
+// Persistence loads the state of a Limiter when it is created and stores it on Dump.
+type Persistence = persistence.Persistence
+
+// Clock is the time source of a Limiter.
+type Clock = clock.Clock
+
+// Limiter limits the requests of each key, usually an IP address, and of all keys together when a global limit is set.
+// It is safe for concurrent use.
+type Limiter interface {
+	// Hit records a request from key if it is allowed and returns the decision.
+	Hit(key string) Decision
+	// HitN records a request from key costing cost hits if it is allowed, costs below 1 are counted as 1.
+	// The request is rejected when the hits left are less than cost.
+	HitN(key string, cost int64) Decision
+	// Peek returns the decision for a request from key without recording it.
+	Peek(key string) Decision
+	// Dump stores the state of the limiter with its Persistence.
+	Dump() error
+}
+
+var (
+	_ Limiter = (*ratelimiter.RateLimiter)(nil)
+	_ Limiter = (*tokenbucket.TokenBucket)(nil)
+	_ Limiter = (*gcra.GCRA)(nil)
+)
+
+// Stats are the number of keys a Limiter tracks and the keys it evicted.
+type Stats = ratelimiter.Stats
+
+// Evictor is implemented by limiters which evict keys, SlidingWindow limiters implement it.
+type Evictor interface {
+	// EvictIdle evicts the keys whose window has fully expired and returns the number of keys evicted.
+	EvictIdle() int64
+	// RunJanitor evicts idle keys every interval until ctx is done.
+	RunJanitor(ctx context.Context, interval time.Duration)
+	// Stats returns the number of tracked keys and the evictions so far.
+	Stats() Stats
+}
+
+var _ Evictor = (*ratelimiter.RateLimiter)(nil)
+
+// PenaltyBox is implemented by limiters with a penalty box, SlidingWindow limiters implement it.
+type PenaltyBox interface {
+	// Bans returns the keys banned at the moment.
+	Bans() []Ban
+	// Unban lifts the ban of key and forgets its offences, it returns false when key has none.
+	Unban(key string) bool
+}
+
+var _ PenaltyBox = (*ratelimiter.RateLimiter)(nil)
+
+// Shadower is implemented by limiters evaluating a shadow policy, SlidingWindow limiters implement it.
+type Shadower interface {
+	// ShadowRejections returns the number of requests the shadow policy would have rejected for each tracked key.
+	ShadowRejections() map[string]int64
+}
+
+var _ Shadower = (*ratelimiter.RateLimiter)(nil)
+
+// Algorithm is the rate limiting algorithm of a Limiter.
+type Algorithm string
+
+const (
+	// SlidingWindow counts the requests in a sliding window, it is the default.
+	SlidingWindow Algorithm = "sliding_window"
+	// TokenBucket refills the budget of each key evenly over the window and allows bursts of up to the limit.
+	TokenBucket Algorithm = "token_bucket"
+	// GCRA is the generic cell rate algorithm, it behaves like TokenBucket and keeps a single timestamp per key.
+	GCRA Algorithm = "gcra"
+)
+
+// CounterMode selects the counter of SlidingWindow.
+type CounterMode = counter.Mode
+
+const (
+	// ExactCounter keeps every bucket of hits in the window, it is the default.
+	ExactCounter = counter.ModeExact
+	// ApproximateCounter weights the previous fixed window by its overlap with the sliding window.
+	ApproximateCounter = counter.ModeApproximate
+)
+
+var (
+	// ErrInvalidLimit is returned when the limit is not positive or a global limit is negative.
+	ErrInvalidLimit = errors.New("limit must be positive")
+	// ErrInvalidWindow is returned when a window is not positive.
+	ErrInvalidWindow = errors.New("window must be positive")
+	// ErrInvalidMaxKeys is returned when the max keys is negative.
+	ErrInvalidMaxKeys = errors.New("max keys must not be negative")
+)
+
+// options holds the configuration built by the options passed to New
+type options struct {
+	algorithm    Algorithm
+	limit        int64
+	window       time.Duration
+	globalLimit  int64
+	globalWindow time.Duration
+	resolution   time.Duration
+	counterMode  CounterMode
+	maxKeys      int
+	shards       int
+	overrides    []Override
+	ipv4Prefix   int
+	ipv6Prefix   int
+	windows      []Window
+	location     *time.Location
+	penalty      Penalty
+	shadow       []Window
+	onShadow     ShadowRejectFunc
+	persistence  Persistence
+	clock        Clock
+}
+
+// Option configures a Limiter built by New.
+type Option func(*options)
+
+// WithAlgorithm sets the rate limiting algorithm, an empty algorithm selects SlidingWindow.
+func WithAlgorithm(algorithm Algorithm) Option {
+	return func(o *options) {
+		o.algorithm = algorithm
+	}
+}
+
+// WithLimit allows limit requests from a key per window, it is required.
+func WithLimit(limit int64, window time.Duration) Option {
+	return func(o *options) {
+		o.limit = limit
+		o.window = window
+	}
+}
+
+// WithGlobalLimit allows limit requests from all keys together per window, a limit of 0 disables it, the default.
+func WithGlobalLimit(limit int64, window time.Duration) Option {
+	return func(o *options) {
+		o.globalLimit = limit
+		o.globalWindow = window
+	}
+}
+
+// WithResolution sets the width of the buckets SlidingWindow groups hits in, defaults to a second.
+func WithResolution(resolution time.Duration) Option {
+	return func(o *options) {
+		o.resolution = resolution
+	}
+}
+
+// WithCounterMode sets the counter of SlidingWindow, defaults to ExactCounter.
+func WithCounterMode(mode CounterMode) Option {
+	return func(o *options) {
+		o.counterMode = mode
+	}
+}
+
+// WithMaxKeys caps the keys a SlidingWindow limiter tracks, the least recently hit key is evicted to track a new one.
+// A max of 0 is unlimited, the default.
+func WithMaxKeys(max int) Option {
+	return func(o *options) {
+		o.maxKeys = max
+	}
+}
+
+// WithShards sets the number of separately locked shards a SlidingWindow limiter splits its keys in,
+// defaults to 32. More shards let more requests from different keys be decided in parallel.
+func WithShards(shards int) Option {
+	return func(o *options) {
+		o.shards = shards
+	}
+}
+
+// WithOverrides replaces the limit of the keys and CIDRs matched by overrides in a SlidingWindow limiter,
+// an exact key takes precedence over CIDRs and a longer prefix over a shorter one.
+// The override a request matched is reported in Decision.Rule.
+func WithOverrides(overrides ...Override) Option {
+	return func(o *options) {
+		o.overrides = append(o.overrides, overrides...)
+	}
+}
+
+// WithIPPrefixes keys IP addresses by their network, ipv4Prefix and ipv6Prefix being the prefix lengths, like 24 and 64,
+// so that a client rotating through the addresses of its network shares one limit. Keys of networks are CIDRs,
+// like 203.0.113.0/24. A prefix of 0 keeps each address as its own key, the default.
+func WithIPPrefixes(ipv4Prefix, ipv6Prefix int) Option {
+	return func(o *options) {
+		o.ipv4Prefix = ipv4Prefix
+		o.ipv6Prefix = ipv6Prefix
+	}
+}
+
+// WithWindows adds windows a key of a SlidingWindow limiter must also have capacity in besides the WithLimit one,
+// like a burst limit of 10 per second on top of 1000 per hour. A request is recorded in every window or in none,
+// the window rejecting it, or with the fewest requests left, is reported in the decision.
+// A Window with a Period is a calendar quota, like Window{Period: PeriodMonth, AllowedRate: 100000}, which resets at once
+// at the start of each period.
+func WithWindows(windows ...Window) Option {
+	return func(o *options) {
+		o.windows = append(o.windows, windows...)
+	}
+}
+
+// WithQuotaLocation sets the time zone the periods of calendar quotas start in, defaults to UTC.
+func WithQuotaLocation(location *time.Location) Option {
+	return func(o *options) {
+		o.location = location
+	}
+}
+
+// WithPenalty bans the keys of a SlidingWindow limiter rejected by their limit penalty.Violations times within penalty.Within
+// for penalty.BanDuration, doubling the ban on each further offence up to penalty.MaxBanDuration. Bans are persisted with the limiter
+// and can be listed and lifted through PenaltyBox.
+func WithPenalty(penalty Penalty) Option {
+	return func(o *options) {
+		o.penalty = penalty
+	}
+}
+
+// WithShadow evaluates a candidate policy of windows alongside the limit of a SlidingWindow limiter without enforcing it,
+// to see who a new limit would reject before switching over. The shadow windows count the requests they would allow,
+// onReject, which may be nil, is called for every request they would reject and the rejections are counted per key,
+// see Shadower. Keys matching an override are not evaluated.
+func WithShadow(onReject ShadowRejectFunc, windows ...Window) Option {
+	return func(o *options) {
+		o.onShadow = onReject
+		o.shadow = append(o.shadow, windows...)
+	}
+}
+
+// WithPersistence sets the storage the limiter is loaded from and dumped to, by default the state is kept only in memory.
+func WithPersistence(p Persistence) Option {
+	return func(o *options) {
+		o.persistence = p
+	}
+}
+
+// WithClock sets the time source of the limiter, defaults to the system clock.
+func WithClock(clk Clock) Option {
+	return func(o *options) {
+		o.clock = clk
+	}
+}
+
+// New returns a Limiter configured with opts, WithLimit is required.
+// Options the selected algorithm does not support are an error rather than ignored, like WithMaxKeys for TokenBucket.
+func New(opts ...Option) (Limiter, error) {
+	o := options{
+		algorithm:   SlidingWindow,
+		persistence: memoryPersistence{},
+		clock:       clock.RealClock{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validateLimits(); err != nil {
+		return nil, err
+	}
+	if o.maxKeys < 0 {
+		return nil, ErrInvalidMaxKeys
+	}
+	switch o.counterMode {
+	case "", ExactCounter, ApproximateCounter:
+	default:
+		return nil, fmt.Errorf("unknown counter mode %s", o.counterMode)
+	}
+	if o.algorithm != "" && o.algorithm != SlidingWindow {
+		if o.resolution != 0 {
+			return nil, fmt.Errorf("resolution is not supported by algorithm %s", o.algorithm)
+		}
+		if o.counterMode != "" {
+			return nil, fmt.Errorf("counter modes are not supported by algorithm %s", o.algorithm)
+		}
+		if o.maxKeys != 0 {
+			return nil, fmt.Errorf("max keys are not supported by algorithm %s", o.algorithm)
+		}
+		if o.shards != 0 {
+			return nil, fmt.Errorf("shards are not supported by algorithm %s", o.algorithm)
+		}
+		if len(o.overrides) > 0 {
+			return nil, fmt.Errorf("overrides are not supported by algorithm %s", o.algorithm)
+		}
+		if len(o.windows) > 0 {
+			return nil, fmt.Errorf("windows are not supported by algorithm %s", o.algorithm)
+		}
+		if o.penalty.Violations != 0 {
+			return nil, fmt.Errorf("penalties are not supported by algorithm %s", o.algorithm)
+		}
+		if len(o.shadow) > 0 {
+			return nil, fmt.Errorf("shadow windows are not supported by algorithm %s", o.algorithm)
+		}
+	}
+	switch o.algorithm {
+	case "", SlidingWindow:
+		l, err := ratelimiter.NewRateLimiter(o.config(), o.persistence, o.clock)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	case TokenBucket:
+		config := tokenbucket.Config{
+			Capacity:       o.limit,
+			RefillInterval: o.window / time.Duration(o.limit),
+			IPv4Prefix:     o.ipv4Prefix,
+			IPv6Prefix:     o.ipv6Prefix,
+		}
+		if o.globalLimit > 0 {
+			config.GlobalCapacity = o.globalLimit
+			config.GlobalRefillInterval = o.globalWindow / time.Duration(o.globalLimit)
+		}
+		l, err := tokenbucket.NewTokenBucket(config, o.persistence, o.clock)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	case GCRA:
+		config := gcra.Config{Rate: o.limit, Period: o.window, IPv4Prefix: o.ipv4Prefix, IPv6Prefix: o.ipv6Prefix}
+		if o.globalLimit > 0 {
+			config.GlobalRate = o.globalLimit
+			config.GlobalPeriod = o.globalWindow
+		}
+		l, err := gcra.NewGCRA(config, o.persistence, o.clock)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm %s", o.algorithm)
+	}
+}
+
+// validateLimits returns an error when the limits set by WithLimit and WithGlobalLimit are invalid
+func (o options) validateLimits() error {
+	if o.limit <= 0 || o.globalLimit < 0 {
+		return ErrInvalidLimit
+	}
+	if o.window <= 0 || (o.globalLimit > 0 && o.globalWindow <= 0) {
+		return ErrInvalidWindow
+	}
+	return nil
+}
+
+// config returns the configuration of a SlidingWindow limiter, the global window is the one of the limit when the global limit is disabled
+func (o options) config() ratelimiter.Config {
+	globalWindow := o.globalWindow
+	if o.globalLimit == 0 {
+		globalWindow = o.window
+	}
+	return ratelimiter.Config{
+		GlobalWindowSize:  globalWindow,
+		IPWindowSize:      o.window,
+		Resolution:        o.resolution,
+		CounterMode:       o.counterMode,
+		AllowedRate:       o.limit,
+		GlobalAllowedRate: o.globalLimit,
+		MaxKeys:           o.maxKeys,
+		Shards:            o.shards,
+		Overrides:         o.overrides,
+		IPv4Prefix:        o.ipv4Prefix,
+		IPv6Prefix:        o.ipv6Prefix,
+		Windows:           o.windows,
+		QuotaLocation:     o.location,
+		Penalty:           o.penalty,
+		Shadow:            o.shadow,
+		OnShadowReject:    o.onShadow,
+	}
+}
+
+// Reload swaps the limits of a SlidingWindow limiter built by New for the ones set by the WithLimit, WithGlobalLimit,
+// WithWindows and WithOverrides options of opts while it runs, WithLimit is required and the other options are ignored.
+// The hits of the tracked keys are kept, windows which changed size are resized rather than reset.
+// The limits are left unchanged when opts are invalid.
+func Reload(l Limiter, opts ...Option) error {
+	rateLimiter, ok := l.(*ratelimiter.RateLimiter)
+	if !ok {
+		return errors.New("reload is only supported by algorithm " + string(SlidingWindow))
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validateLimits(); err != nil {
+		return err
+	}
+	return rateLimiter.Reload(o.config())
+}
+
+// ConcurrencyLimiter caps the requests of each key, and of all keys together when a global limit is set, in flight at once.
+// It is safe for concurrent use.
+type ConcurrencyLimiter interface {
+	// Acquire takes a slot for a request from key if it is allowed and returns the decision with the func releasing the slot,
+	// which must be called once the request is done. Rejected requests get a release func doing nothing.
+	Acquire(key string) (Decision, func())
+}
+
+var _ ConcurrencyLimiter = (*concurrency.ConcurrencyLimiter)(nil)
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter allowing maxInFlight requests of a key and globalMaxInFlight requests
+// of all keys in flight at once, a globalMaxInFlight of 0 disables the global limit. Only the WithIPPrefixes option applies to it.
+func NewConcurrencyLimiter(maxInFlight, globalMaxInFlight int64, opts ...Option) (ConcurrencyLimiter, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	l, err := concurrency.NewConcurrencyLimiter(concurrency.Config{
+		MaxInFlight:       maxInFlight,
+		GlobalMaxInFlight: globalMaxInFlight,
+		IPv4Prefix:        o.ipv4Prefix,
+		IPv6Prefix:        o.ipv6Prefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// memoryPersistence is the persistence of limiters without one, it loads nothing and drops dumps
+type memoryPersistence struct{}
+
+func (memoryPersistence) Dump(map[string][]Entry) error {
+	return nil
+}
+
+func (memoryPersistence) Load() (map[string][]Entry, error) {
+	return map[string][]Entry{}, nil
+}
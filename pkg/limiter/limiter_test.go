@@ -0,0 +1,247 @@
+package limiter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/clock"
+	"github.com/jeffy-mathew/sliding-window-rate-limiter/internal/persistence/persistence_mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("should return an error on invalid options", func(t *testing.T) {
+		_, err := New()
+		assert.Equal(t, ErrInvalidLimit, err)
+		_, err = New(WithLimit(15, 0))
+		assert.Equal(t, ErrInvalidWindow, err)
+		_, err = New(WithLimit(15, time.Second), WithGlobalLimit(-1, time.Second))
+		assert.Equal(t, ErrInvalidLimit, err)
+		_, err = New(WithLimit(15, time.Second), WithGlobalLimit(100, 0))
+		assert.Equal(t, ErrInvalidWindow, err)
+		_, err = New(WithLimit(15, time.Second), WithMaxKeys(-1))
+		assert.Equal(t, ErrInvalidMaxKeys, err)
+		_, err = New(WithLimit(15, time.Second), WithAlgorithm("leaky_bucket"))
+		assert.EqualError(t, err, "unknown algorithm leaky_bucket")
+		_, err = New(WithLimit(15, time.Second), WithCounterMode("fuzzy"))
+		assert.EqualError(t, err, "unknown counter mode fuzzy")
+	})
+	t.Run("should return an error on options the algorithm does not support", func(t *testing.T) {
+		for _, algorithm := range []Algorithm{TokenBucket, GCRA} {
+			for message, option := range map[string]Option{
+				"resolution is not supported by algorithm ":     WithResolution(time.Second),
+				"counter modes are not supported by algorithm ": WithCounterMode(ExactCounter),
+				"max keys are not supported by algorithm ":      WithMaxKeys(100),
+				"shards are not supported by algorithm ":        WithShards(4),
+				"windows are not supported by algorithm ":       WithWindows(Window{Size: time.Second, AllowedRate: 10}),
+				"penalties are not supported by algorithm ":     WithPenalty(Penalty{Violations: 2, Within: time.Minute, BanDuration: time.Hour}),
+			} {
+				_, err := New(WithAlgorithm(algorithm), WithLimit(15, time.Second), option)
+				assert.EqualError(t, err, message+string(algorithm))
+			}
+		}
+	})
+	t.Run("should return a nil limiter when loading fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockPersistence := persistence_mock.NewMockPersistence(ctrl)
+		mockPersistence.EXPECT().Load().Return(nil, errors.New("corrupt dump"))
+		l, err := New(WithLimit(15, time.Second), WithPersistence(mockPersistence))
+		assert.Error(t, err)
+		assert.Nil(t, l)
+	})
+	for _, algorithm := range []Algorithm{SlidingWindow, TokenBucket, GCRA} {
+		t.Run("should limit each key to the limit with "+string(algorithm), func(t *testing.T) {
+			fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+			l, err := New(WithAlgorithm(algorithm), WithLimit(3, 3*time.Second), WithClock(fakeClock))
+			assert.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				assert.True(t, l.Hit("10.0.0.1").Allowed)
+			}
+			decision := l.Hit("10.0.0.1")
+			assert.False(t, decision.Allowed)
+			assert.Equal(t, RejectReasonIP, decision.Reason)
+			assert.True(t, l.Peek("10.0.0.2").Allowed)
+			fakeClock.Advance(5 * time.Second)
+			assert.True(t, l.Hit("10.0.0.1").Allowed)
+			assert.NoError(t, l.Dump())
+		})
+		t.Run("should limit all keys together to the global limit with "+string(algorithm), func(t *testing.T) {
+			fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+			l, err := New(WithAlgorithm(algorithm), WithLimit(3, 3*time.Second), WithGlobalLimit(4, 4*time.Second), WithClock(fakeClock))
+			assert.NoError(t, err)
+			assert.True(t, l.HitN("10.0.0.1", 3).Allowed)
+			assert.True(t, l.Hit("10.0.0.2").Allowed)
+			decision := l.Hit("10.0.0.3")
+			assert.False(t, decision.Allowed)
+			assert.Equal(t, RejectReasonGlobal, decision.Reason)
+		})
+	}
+}
+
+func TestWithMaxKeys(t *testing.T) {
+	t.Run("should evict keys over max keys and report it in stats", func(t *testing.T) {
+		l, err := New(WithLimit(15, time.Second), WithMaxKeys(1), WithClock(clock.NewFakeClock(time.Unix(1624974458, 0))))
+		assert.NoError(t, err)
+		l.Hit("10.0.0.1")
+		l.Hit("10.0.0.2")
+		evictor, ok := l.(Evictor)
+		assert.True(t, ok)
+		assert.Equal(t, Stats{Keys: 1, CapacityEvictions: 1}, evictor.Stats())
+	})
+}
+
+func TestWithOverrides(t *testing.T) {
+	t.Run("should deny and exempt overridden keys and report the rule", func(t *testing.T) {
+		overrides, err := ParseOverrides("10.0.0.0/8=unlimited,198.51.100.7=deny")
+		assert.NoError(t, err)
+		l, err := New(WithLimit(1, time.Second), WithOverrides(overrides...), WithClock(clock.NewFakeClock(time.Unix(1624974458, 0))))
+		assert.NoError(t, err)
+		decision := l.Hit("198.51.100.7")
+		assert.Equal(t, RejectReasonDenied, decision.Reason)
+		assert.Equal(t, "198.51.100.7", decision.Rule)
+		assert.True(t, l.Hit("10.0.0.1").Allowed)
+		assert.True(t, l.Hit("10.0.0.1").Allowed)
+	})
+	t.Run("should return error for algorithms without overrides", func(t *testing.T) {
+		_, err := New(WithAlgorithm(GCRA), WithLimit(1, time.Second), WithOverrides(Override{Key: "198.51.100.7", Action: OverrideDeny}))
+		assert.EqualError(t, err, "overrides are not supported by algorithm gcra")
+	})
+}
+
+func TestWithIPPrefixes(t *testing.T) {
+	for _, algorithm := range []Algorithm{SlidingWindow, TokenBucket, GCRA} {
+		t.Run("should limit the addresses of a network together with "+string(algorithm), func(t *testing.T) {
+			l, err := New(WithAlgorithm(algorithm), WithLimit(2, time.Minute), WithIPPrefixes(24, 64), WithClock(clock.NewFakeClock(time.Unix(1624974458, 0))))
+			assert.NoError(t, err)
+			assert.True(t, l.Hit("2001:db8::1").Allowed)
+			assert.True(t, l.Hit("2001:db8::2").Allowed)
+			assert.False(t, l.Hit("2001:db8::3").Allowed)
+			assert.True(t, l.Hit("2001:db8:0:1::3").Allowed)
+		})
+	}
+	t.Run("should return error on invalid prefix lengths", func(t *testing.T) {
+		_, err := New(WithLimit(2, time.Minute), WithIPPrefixes(40, 64))
+		assert.Error(t, err)
+	})
+}
+
+func TestWithWindows(t *testing.T) {
+	t.Run("should allow requests only when every window has capacity", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		l, err := New(WithLimit(3, time.Hour), WithWindows(Window{Size: time.Second, AllowedRate: 2}), WithClock(fakeClock))
+		assert.NoError(t, err)
+		assert.True(t, l.Hit("10.0.0.1").Allowed)
+		assert.True(t, l.Hit("10.0.0.1").Allowed)
+		decision := l.Hit("10.0.0.1")
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, time.Second, decision.Window)
+		fakeClock.Advance(2 * time.Second)
+		assert.True(t, l.Hit("10.0.0.1").Allowed)
+		decision = l.Hit("10.0.0.1")
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, time.Hour, decision.Window)
+	})
+	t.Run("should return error for algorithms without windows", func(t *testing.T) {
+		_, err := New(WithAlgorithm(TokenBucket), WithLimit(3, time.Hour), WithWindows(Window{Size: time.Second, AllowedRate: 2}))
+		assert.EqualError(t, err, "windows are not supported by algorithm token_bucket")
+	})
+}
+
+func TestWithQuotaLocation(t *testing.T) {
+	t.Run("should reset calendar quotas at midnight of the location", func(t *testing.T) {
+		newYork, err := time.LoadLocation("America/New_York")
+		assert.NoError(t, err)
+		fakeClock := clock.NewFakeClock(time.Date(2021, time.June, 30, 3, 0, 0, 0, time.UTC))
+		l, err := New(WithLimit(10, time.Second), WithWindows(Window{Period: PeriodDay, AllowedRate: 2}), WithQuotaLocation(newYork), WithClock(fakeClock))
+		assert.NoError(t, err)
+		assert.True(t, l.HitN("10.0.0.1", 2).Allowed)
+		decision := l.Hit("10.0.0.1")
+		assert.False(t, decision.Allowed)
+		assert.True(t, time.Date(2021, time.June, 30, 0, 0, 0, 0, newYork).Equal(decision.ResetAt))
+		fakeClock.Advance(time.Hour)
+		assert.True(t, l.Hit("10.0.0.1").Allowed)
+	})
+}
+
+func TestNewConcurrencyLimiter(t *testing.T) {
+	t.Run("should cap the requests in flight of a network", func(t *testing.T) {
+		l, err := NewConcurrencyLimiter(1, 0, WithIPPrefixes(24, 0))
+		assert.NoError(t, err)
+		decision, release := l.Acquire("203.0.113.7")
+		assert.True(t, decision.Allowed)
+		decision, _ = l.Acquire("203.0.113.8")
+		assert.Equal(t, RejectReasonConcurrency, decision.Reason)
+		release()
+		decision, _ = l.Acquire("203.0.113.8")
+		assert.True(t, decision.Allowed)
+	})
+	t.Run("should return error on invalid limits without a typed nil", func(t *testing.T) {
+		l, err := NewConcurrencyLimiter(0, 0)
+		assert.Error(t, err)
+		assert.Nil(t, l)
+	})
+}
+
+func TestWithPenalty(t *testing.T) {
+	t.Run("should ban keys rejected repeatedly and lift the ban through the penalty box", func(t *testing.T) {
+		fakeClock := clock.NewFakeClock(time.Unix(1624974458, 0))
+		l, err := New(WithLimit(1, time.Minute), WithPenalty(Penalty{Violations: 2, Within: time.Minute, BanDuration: time.Hour}), WithClock(fakeClock))
+		assert.NoError(t, err)
+		l.Hit("10.0.0.1")
+		l.Hit("10.0.0.1")
+		assert.Equal(t, RejectReasonBanned, l.Hit("10.0.0.1").Reason)
+		penaltyBox, ok := l.(PenaltyBox)
+		assert.True(t, ok)
+		assert.Equal(t, []Ban{{Key: "10.0.0.1", Until: time.Unix(1624974458, 0).Add(time.Hour), Offences: 1}}, penaltyBox.Bans())
+		assert.True(t, penaltyBox.Unban("10.0.0.1"))
+		assert.Equal(t, RejectReasonIP, l.Hit("10.0.0.1").Reason)
+	})
+	t.Run("should return error for algorithms without penalties", func(t *testing.T) {
+		_, err := New(WithAlgorithm(GCRA), WithLimit(1, time.Minute), WithPenalty(Penalty{Violations: 2, Within: time.Minute, BanDuration: time.Hour}))
+		assert.EqualError(t, err, "penalties are not supported by algorithm gcra")
+	})
+}
+
+func TestWithShadow(t *testing.T) {
+	t.Run("should report the requests a tighter limit would reject without rejecting them", func(t *testing.T) {
+		var rejected []string
+		l, err := New(WithLimit(10, time.Minute), WithShadow(func(key string, decision Decision) {
+			rejected = append(rejected, key)
+		}, Window{Size: time.Minute, AllowedRate: 2}), WithClock(clock.NewFakeClock(time.Unix(1624974458, 0))))
+		assert.NoError(t, err)
+		for i := 0; i < 4; i++ {
+			assert.True(t, l.Hit("10.0.0.1").Allowed)
+		}
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.1"}, rejected)
+		assert.Equal(t, map[string]int64{"10.0.0.1": 2}, l.(Shadower).ShadowRejections())
+	})
+	t.Run("should return error for algorithms without shadow windows", func(t *testing.T) {
+		_, err := New(WithAlgorithm(TokenBucket), WithLimit(10, time.Minute), WithShadow(nil, Window{Size: time.Minute, AllowedRate: 2}))
+		assert.EqualError(t, err, "shadow windows are not supported by algorithm token_bucket")
+	})
+}
+
+func TestReload(t *testing.T) {
+	t.Run("should change the limit keeping the hits", func(t *testing.T) {
+		l, err := New(WithLimit(2, time.Minute), WithClock(clock.NewFakeClock(time.Unix(1624974458, 0))))
+		assert.NoError(t, err)
+		l.HitN("10.0.0.1", 2)
+		assert.False(t, l.Hit("10.0.0.1").Allowed)
+		assert.NoError(t, Reload(l, WithLimit(3, time.Minute), WithOverrides(Override{Key: "10.0.0.2", Action: OverrideDeny})))
+		decision := l.Hit("10.0.0.1")
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, int64(3), decision.IPHits)
+		assert.Equal(t, RejectReasonDenied, l.Hit("10.0.0.2").Reason)
+	})
+	t.Run("should return error on invalid options and for other algorithms", func(t *testing.T) {
+		l, err := New(WithLimit(2, time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, ErrInvalidLimit, Reload(l))
+		assert.Equal(t, ErrInvalidWindow, Reload(l, WithLimit(2, time.Minute), WithGlobalLimit(10, 0)))
+		l, err = New(WithAlgorithm(GCRA), WithLimit(2, time.Minute))
+		assert.NoError(t, err)
+		assert.EqualError(t, Reload(l, WithLimit(3, time.Minute)), "reload is only supported by algorithm sliding_window")
+	})
+}